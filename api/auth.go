@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/alexgear/sms/config"
+	"github.com/gorilla/context"
+)
+
+type contextKey int
+
+const clientKey contextKey = 0
+
+// clients maps API keys to client names
+var clients map[string]string
+
+func initClients(conf []config.ClientConfig) {
+	clients = make(map[string]string)
+	for _, client := range conf {
+		clients[client.Key] = client.Name
+	}
+}
+
+// authenticate resolves the client from the X-API-Key header or the api_key
+// parameter. The API is open when no clients are configured.
+func authenticate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(clients) == 0 {
+			handler(w, r)
+			return
+		}
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			key = r.URL.Query().Get("api_key")
+		}
+		name, ok := clients[key]
+		if !ok {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		context.Set(r, clientKey, name)
+		handler(w, r)
+	}
+}
+
+// client returns the name of the authenticated client, empty for an open API.
+func client(r *http.Request) string {
+	name, _ := context.Get(r, clientKey).(string)
+	return name
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// callbackAttempts per callback before it is dropped
+const callbackAttempts = 3
+
+var callbacks = make(chan *http.Request, 100)
+
+var callbackClient = &http.Client{Timeout: 10 * time.Second}
+
+var startCallbacks sync.Once
+
+// queueCallback queues a status callback of the compatibility APIs. It is
+// dropped when the callbacks fall behind.
+func queueCallback(req *http.Request) bool {
+	startCallbacks.Do(func() { go callbackSender() })
+	select {
+	case callbacks <- req:
+		return true
+	default:
+		return false
+	}
+}
+
+func callbackSender() {
+	for req := range callbacks {
+		for attempt := 1; ; attempt++ {
+			resp, err := callbackClient.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode < 300 {
+					break
+				}
+				err = fmt.Errorf("status %s", resp.Status)
+			}
+			log.Printf("callbackSender: attempt %d of %s failed. %s", attempt, req.URL, err.Error())
+			if attempt == callbackAttempts {
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+			if req.GetBody != nil {
+				// the body was read by the failed attempt
+				req.Body, _ = req.GetBody()
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/database"
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+)
+
+type ContactsResponse struct {
+	Contacts []common.Contact `json:"contacts"`
+}
+
+type ImportResponse struct {
+	Imported int `json:"imported"`
+	Updated  int `json:"updated"`
+}
+
+// decodeContact reads a contact from a JSON body and normalizes its number.
+func decodeContact(w http.ResponseWriter, r *http.Request) (*common.Contact, bool) {
+	c := &common.Contact{}
+	err := json.NewDecoder(r.Body).Decode(c)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %s", err.Error()), http.StatusBadRequest)
+		return nil, false
+	}
+	c.UUID = mux.Vars(r)["uuid"]
+	if c.UUID == "" {
+		c.UUID = uuid.NewV1().String()
+	}
+	c.Number = common.NormalizeNumber(c.Number)
+	err = c.Validate()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid contact: %s", err.Error()), http.StatusBadRequest)
+		return nil, false
+	}
+	return c, true
+}
+
+// listContactsHandler returns all contacts or the members of group.
+func listContactsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	contacts, err := db.ListContacts(r.FormValue("group"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := ContactsResponse{Contacts: contacts}
+	if response.Contacts == nil {
+		response.Contacts = []common.Contact{}
+	}
+	writeJSON(w, response)
+	return
+}
+
+func createContactHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	c, ok := decodeContact(w, r)
+	if !ok {
+		return
+	}
+	err := db.InsertContact(c)
+	if err == database.ErrExists {
+		http.Error(w, fmt.Sprintf("Contact %s already exists", c.Number), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, c)
+	return
+}
+
+func getContactHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	id := mux.Vars(r)["uuid"]
+	c, err := db.GetContact(id)
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Contact %s not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, &c)
+	return
+}
+
+func updateContactHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	c, ok := decodeContact(w, r)
+	if !ok {
+		return
+	}
+	err := db.UpdateContact(c)
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Contact %s not found", c.UUID), http.StatusNotFound)
+		return
+	} else if err == database.ErrExists {
+		http.Error(w, fmt.Sprintf("Contact %s already exists", c.Number), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, c)
+	return
+}
+
+func deleteContactHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["uuid"]
+	err := db.DeleteContact(id)
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Contact %s not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// importContactsHandler reads contacts from a CSV body with a header row.
+// The number column is required, name and locale are optional and the other
+// columns become attributes. Contacts with a known number are updated and
+// all of them are added to group if given.
+func importContactsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	contacts, err := parseContactsCSV(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid CSV: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	group := r.URL.Query().Get("group")
+	imported, updated, err := db.ImportContacts(contacts, group)
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Group %s not found", group), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, ImportResponse{Imported: imported, Updated: updated})
+	return
+}
+
+func parseContactsCSV(body io.Reader) ([]*common.Contact, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("missing header")
+	} else if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+	hasNumber := false
+	for _, column := range header {
+		hasNumber = hasNumber || column == "number"
+	}
+	if !hasNumber {
+		return nil, fmt.Errorf("missing number column")
+	}
+	var contacts []*common.Contact
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		c := &common.Contact{UUID: uuid.NewV1().String(), Attributes: make(map[string]string)}
+		for i, value := range record {
+			switch header[i] {
+			case "number":
+				c.Number = common.NormalizeNumber(value)
+			case "name":
+				c.Name = value
+			case "locale":
+				c.Locale = value
+			default:
+				c.Attributes[header[i]] = value
+			}
+		}
+		err = c.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, nil
+}
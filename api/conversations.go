@@ -0,0 +1,163 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+)
+
+const defaultConversationLimit = 100
+
+type ConversationsResponse struct {
+	Conversations []common.Conversation `json:"conversations"`
+}
+
+// ConversationMessage is an outbound or inbound message of a conversation.
+type ConversationMessage struct {
+	Direction string    `json:"direction"`
+	UUID      string    `json:"uuid"`
+	Text      string    `json:"text"`
+	Status    string    `json:"status,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+type ConversationResponse struct {
+	Number   string                `json:"number"`
+	Messages []ConversationMessage `json:"messages"`
+}
+
+type byTime []ConversationMessage
+
+func (m byTime) Len() int           { return len(m) }
+func (m byTime) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byTime) Less(i, j int) bool { return m[i].Time.Before(m[j].Time) }
+
+func listConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	limit, ok := parseLimit(w, r, defaultConversationLimit)
+	if !ok {
+		return
+	}
+	conversations, err := db.ListConversations(limit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := ConversationsResponse{Conversations: conversations}
+	if response.Conversations == nil {
+		response.Conversations = []common.Conversation{}
+	}
+	toWrite, err := json.Marshal(response)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(toWrite)
+	return
+}
+
+// getConversationHandler returns the latest messages exchanged with a number
+// in time order and marks the received ones as read.
+func getConversationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	number := common.NormalizeNumber(mux.Vars(r)["number"])
+	limit, ok := parseLimit(w, r, defaultConversationLimit)
+	if !ok {
+		return
+	}
+	outbound, inbound, err := db.GetConversation(number, limit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := ConversationResponse{Number: number, Messages: []ConversationMessage{}}
+	for _, sms := range outbound {
+		response.Messages = append(response.Messages, ConversationMessage{
+			Direction: "outbound",
+			UUID:      sms.UUID,
+			Text:      sms.Body,
+			Status:    sms.Status,
+			Time:      sms.CreatedAt})
+	}
+	for _, msg := range inbound {
+		response.Messages = append(response.Messages, ConversationMessage{
+			Direction: "inbound",
+			UUID:      msg.UUID,
+			Text:      msg.Body,
+			Tags:      msg.Tags,
+			Time:      msg.CreatedAt})
+	}
+	sort.Sort(byTime(response.Messages))
+	if len(response.Messages) > limit {
+		response.Messages = response.Messages[len(response.Messages)-limit:]
+	}
+	err = db.MarkInboundRead(number)
+	if err != nil {
+		log.Println(err)
+	}
+	toWrite, err := json.Marshal(response)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(toWrite)
+	return
+}
+
+// replyHandler queues a message to the number of the conversation.
+func replyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	if r.FormValue("text") == "" {
+		http.Error(w, "text is required", http.StatusBadRequest)
+		return
+	}
+	mobile := common.NormalizeNumber(mux.Vars(r)["number"])
+	if rejectDestination(w, r, mobile) || rejectSuppressed(w, mobile) {
+		return
+	}
+	sms := &common.SMS{
+		UUID:   uuid.NewV1().String(),
+		Mobile: mobile,
+		Body:   r.FormValue("text"),
+		Status: "pending",
+		Client: client(r)}
+	err := db.InsertMessage(sms)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	toWrite, err := json.Marshal(newSMSResponse(*sms))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(toWrite)
+	return
+}
+
+func parseLimit(w http.ResponseWriter, r *http.Request, defaultLimit int) (int, bool) {
+	if r.FormValue("limit") == "" {
+		return defaultLimit, true
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 1 || limit > maxListLimit {
+		http.Error(w, fmt.Sprintf("Invalid limit: must be 1 to %d", maxListLimit), http.StatusBadRequest)
+		return 0, false
+	}
+	return limit, true
+}
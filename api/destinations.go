@@ -0,0 +1,69 @@
+package api
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/alexgear/sms/config"
+)
+
+// rejectedDestinations counts messages refused by the destination lists by
+// client, exposed at /api/metrics
+var rejectedDestinations = expvar.NewMap("rejected_destinations")
+
+var globalDestinations config.DestinationConfig
+
+// clientDestinations maps client names to their destination lists
+var clientDestinations map[string]config.DestinationConfig
+
+func initDestinations(conf config.Config) {
+	globalDestinations = conf.Destinations
+	clientDestinations = make(map[string]config.DestinationConfig)
+	for _, client := range conf.Clients {
+		clientDestinations[client.Name] = client.Destinations
+	}
+}
+
+func hasPrefix(number string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(number, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDestination returns why client may not send to a normalized number,
+// nil if it may.
+func checkDestination(client string, number string) error {
+	for _, d := range []config.DestinationConfig{globalDestinations, clientDestinations[client]} {
+		if hasPrefix(number, d.Deny) {
+			return fmt.Errorf("Destination %s is denied", number)
+		}
+		if len(d.Allow) > 0 && !hasPrefix(number, d.Allow) {
+			return fmt.Errorf("Destination %s is not allowed", number)
+		}
+	}
+	return nil
+}
+
+// rejectDestination answers 403 and returns true if the client of r may not
+// send to number.
+func rejectDestination(w http.ResponseWriter, r *http.Request, number string) bool {
+	err := checkDestination(client(r), number)
+	if err == nil {
+		return false
+	}
+	countRejected(client(r))
+	http.Error(w, err.Error(), http.StatusForbidden)
+	return true
+}
+
+func countRejected(client string) {
+	if client == "" {
+		client = "anonymous"
+	}
+	rejectedDestinations.Add(client, 1)
+}
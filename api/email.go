@@ -0,0 +1,307 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+	"github.com/alexgear/sms/database"
+	"github.com/alexgear/sms/smtpd"
+	"github.com/satori/go.uuid"
+)
+
+// emailTimeout of an SMTP command
+const emailTimeout = 5 * time.Minute
+
+var emailConf config.EmailConfig
+var emailCutAt []*regexp.Regexp
+var emailAllow []*net.IPNet
+
+// emailNumber is the local part of a recipient address
+var emailNumber = regexp.MustCompile(`^\+?\d{3,15}$`)
+
+// emailReply is the local part of the address of replies to a forwarded
+// message
+var emailReply = regexp.MustCompile(`^(?i)reply\+([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})$`)
+
+// blankLines are runs of more than one empty line
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+// emailMetadata records the sender of a message received by email
+type emailMetadata struct {
+	From string `json:"email_from"`
+	// InReplyTo is the uuid of the received message a reply answers
+	InReplyTo string `json:"in_reply_to,omitempty"`
+}
+
+// InitEmail listens for SMTP clients if configured.
+func InitEmail(store database.Store, conf config.Config) error {
+	if conf.Email.Listen == "" {
+		return nil
+	}
+	db = store
+	initDestinations(conf)
+	initEmail(conf.Email)
+	listener, err := net.Listen("tcp", conf.Email.Listen)
+	if err != nil {
+		return fmt.Errorf("InitEmail: %s", err.Error())
+	}
+	log.Println("SMTP listening on: ", conf.Email.Listen)
+	go newEmailServer().Serve(listener)
+	return nil
+}
+
+func initEmail(conf config.EmailConfig) {
+	emailConf = conf
+	emailCutAt = nil
+	for _, pattern := range conf.CutAt {
+		emailCutAt = append(emailCutAt, regexp.MustCompile(pattern))
+	}
+	emailAllow = nil
+	for _, a := range conf.Allow {
+		if !strings.Contains(a, "/") {
+			if strings.Contains(a, ":") {
+				a += "/128"
+			} else {
+				a += "/32"
+			}
+		}
+		_, network, _ := net.ParseCIDR(a)
+		emailAllow = append(emailAllow, network)
+	}
+}
+
+func newEmailServer() *smtpd.Server {
+	server := &smtpd.Server{
+		Hostname:  emailConf.Domain,
+		Allow:     emailAllowed,
+		Sender:    emailSender,
+		Recipient: emailRecipient,
+		Deliver:   deliverEmail,
+		MaxSize:   emailConf.MaxSize,
+		Timeout:   emailTimeout}
+	if len(emailConf.Users) > 0 {
+		server.Auth = emailAuth
+	}
+	return server
+}
+
+func emailAuth(username string, password string) bool {
+	for _, user := range emailConf.Users {
+		if user.Username == username &&
+			subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// emailAllowed reports whether addr may send without AUTH.
+func emailAllowed(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range emailAllow {
+		if network.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// emailSender checks MAIL FROM against Senders, which are addresses or
+// domains starting with "@".
+func emailSender(from string) error {
+	if len(emailConf.Senders) == 0 {
+		return nil
+	}
+	from = strings.ToLower(from)
+	for _, sender := range emailConf.Senders {
+		sender = strings.ToLower(sender)
+		if from == sender || (strings.HasPrefix(sender, "@") && strings.HasSuffix(from, sender)) {
+			return nil
+		}
+	}
+	log.Printf("emailSender: %s is not allowed", from)
+	return &smtpd.Error{Code: 550, Message: "Sender not allowed"}
+}
+
+// emailClient returns the client of a session authenticated as username.
+func emailClient(username string) string {
+	if username != "" {
+		return username
+	}
+	return emailConf.Client
+}
+
+// emailMobile returns the number of a recipient address, false if it is not
+// <number>@Domain.
+func emailMobile(to string) (string, bool) {
+	at := strings.LastIndex(to, "@")
+	if at < 0 || !strings.EqualFold(to[at+1:], emailConf.Domain) || !emailNumber.MatchString(to[:at]) {
+		return "", false
+	}
+	return common.NormalizeNumber(to[:at]), true
+}
+
+// emailDestination returns the number of a recipient address and, for the
+// address of replies to a forwarded message, the message.
+func emailDestination(to string) (string, *common.Inbound, error) {
+	at := strings.LastIndex(to, "@")
+	if at >= 0 && forwardConf.Replies && strings.EqualFold(to[at+1:], emailConf.Domain) {
+		if match := emailReply.FindStringSubmatch(to[:at]); match != nil {
+			msg, err := db.GetInbound(strings.ToLower(match[1]))
+			if err == database.ErrNotFound {
+				return "", nil, &smtpd.Error{Code: 550, Message: fmt.Sprintf("No such message %s", match[1])}
+			} else if err != nil {
+				return "", nil, err
+			}
+			return msg.Sender, &msg, nil
+		}
+	}
+	mobile, ok := emailMobile(to)
+	if !ok {
+		return "", nil, &smtpd.Error{Code: 550, Message: fmt.Sprintf("No such recipient %s, expected <number>@%s",
+			to, emailConf.Domain)}
+	}
+	return mobile, nil, nil
+}
+
+func emailRecipient(username string, to string) error {
+	mobile, _, err := emailDestination(to)
+	if err != nil {
+		return err
+	}
+	client := emailClient(username)
+	err = checkDestination(client, mobile)
+	if err != nil {
+		log.Printf("emailRecipient: %s %s", client, err.Error())
+		countRejected(client)
+		return &smtpd.Error{Code: 550, Message: err.Error()}
+	}
+	optedOut, err := suppressed(mobile)
+	if err != nil {
+		return err
+	}
+	if optedOut {
+		return &smtpd.Error{Code: 550, Message: fmt.Sprintf("Number %s has opted out", mobile)}
+	}
+	return nil
+}
+
+// emailText returns the text of the SMS sent for a mail.
+func emailText(t *smtpd.Text) string {
+	body := emailBody(t.Body)
+	subject := strings.TrimSpace(t.Subject)
+	text := body
+	switch {
+	case emailConf.Text == "subject" || body == "":
+		text = subject
+	case emailConf.Text == "both" && subject != "":
+		text = subject + "\n" + body
+	}
+	return emailLimit(text)
+}
+
+// replyText returns the text of the SMS sent for a reply to a forwarded
+// message, the subject is the one of the forwarded mail.
+func replyText(t *smtpd.Text) string {
+	return emailLimit(emailBody(t.Body))
+}
+
+// emailBody returns body cut at CutAt and without quoted lines.
+func emailBody(body string) string {
+	var lines []string
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		cut := false
+		for _, pattern := range emailCutAt {
+			if pattern.MatchString(line) {
+				cut = true
+				break
+			}
+		}
+		if cut {
+			break
+		}
+		if emailConf.StripQuoted && strings.HasPrefix(strings.TrimSpace(line), ">") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// emailLimit cuts text to MaxLength.
+func emailLimit(text string) string {
+	if runes := []rune(text); emailConf.MaxLength > 0 && len(runes) > emailConf.MaxLength {
+		text = string(runes[:emailConf.MaxLength])
+	}
+	return text
+}
+
+// forwardedTo reports whether the messages of sender are mailed to address.
+func forwardedTo(sender string, address string) bool {
+	for _, recipient := range forwardRecipients(sender) {
+		if strings.EqualFold(recipient, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverEmail queues the text of a mail to each of its recipients. Replies
+// to a forwarded message are only accepted from its recipients.
+func deliverEmail(e *smtpd.Envelope) error {
+	t, err := smtpd.ReadText(e.Data)
+	if err != nil {
+		log.Printf("deliverEmail: %s", err.Error())
+		return &smtpd.Error{Code: 554, Message: "Invalid message"}
+	}
+	var messages []*common.SMS
+	for _, to := range e.To {
+		mobile, replied, err := emailDestination(to)
+		if err != nil {
+			return err
+		}
+		metadata := emailMetadata{From: e.From}
+		text := emailText(t)
+		if replied != nil {
+			if !forwardedTo(replied.Sender, e.From) {
+				log.Printf("deliverEmail: %s may not reply to %s", e.From, replied.UUID)
+				return &smtpd.Error{Code: 550, Message: fmt.Sprintf("Sender may not reply to %s", to)}
+			}
+			metadata.InReplyTo = replied.UUID
+			text = replyText(t)
+		}
+		if text == "" {
+			return &smtpd.Error{Code: 554, Message: "No text to send"}
+		}
+		encoded, _ := json.Marshal(metadata)
+		messages = append(messages, &common.SMS{
+			UUID:     uuid.NewV1().String(),
+			Mobile:   mobile,
+			Body:     text,
+			Status:   "pending",
+			Client:   emailClient(e.Username),
+			Metadata: encoded,
+			Priority: common.PriorityNormal})
+	}
+	// all recipients are queued or none, the mail is retried by the sender
+	err = db.InsertMessages(messages)
+	if err != nil {
+		return err
+	}
+	for _, sms := range messages {
+		log.Printf("deliverEmail: %s queued %s from %s", sms.Client, sms.UUID, e.From)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/alexgear/sms/config"
+	"github.com/alexgear/sms/smtpd"
+)
+
+func TestEmailText(t *testing.T) {
+	initEmail(config.EmailConfig{Domain: "sms.local", Text: "both", StripQuoted: true, MaxLength: 40,
+		CutAt: []string{`^-- ?$`, `^On .* wrote:$`}})
+	defer initEmail(config.EmailConfig{})
+	text := emailText(&smtpd.Text{Subject: " Disk full ",
+		Body: "Host db1\n\n\n\n/var at 98%\n> earlier alert\n-- \nMonitoring team\n"})
+	if text != "Disk full\nHost db1\n\n/var at 98%" {
+		t.Fatalf("Unexpected text %q", text)
+	}
+	text = emailText(&smtpd.Text{Body: "Thanks\n\nOn Mon, 19 Oct 2026 Ops wrote:\n> Disk full\n"})
+	if text != "Thanks" {
+		t.Fatalf("Expected the quoted reply to be cut, got %q", text)
+	}
+	text = emailText(&smtpd.Text{Subject: "Disk full", Body: strings.Repeat("x", 50)})
+	if len([]rune(text)) != 40 {
+		t.Fatalf("Expected the text to be cut at 40 characters, got %q", text)
+	}
+	emailConf.Text = "subject"
+	text = emailText(&smtpd.Text{Subject: "Disk full", Body: "Host db1"})
+	if text != "Disk full" {
+		t.Fatalf("Expected the subject only, got %q", text)
+	}
+}
+
+func TestEmail(t *testing.T) {
+	_, cleanup := initTestServer(t)
+	defer cleanup()
+	initEmail(config.EmailConfig{Domain: "sms.local", Allow: []string{"127.0.0.0/8"}, Client: "email",
+		Senders: []string{"@example.com"}, Text: "both", StripQuoted: true, MaxSize: 1024,
+		CutAt: []string{`^-- ?$`}})
+	defer initEmail(config.EmailConfig{})
+	globalDestinations = config.DestinationConfig{Deny: []string{"+380900"}}
+	defer func() { globalDestinations = config.DestinationConfig{} }()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go newEmailServer().Serve(listener)
+	address := listener.Addr().String()
+
+	mail := []byte("From: alerts@example.com\r\nSubject: Disk full\r\n\r\nHost db1\r\n-- \r\nMonitoring\r\n")
+	err = smtp.SendMail(address, nil, "alerts@other.com", []string{"+380631234567@sms.local"}, mail)
+	if err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Fatalf("Expected the sender to be rejected, got %v", err)
+	}
+	err = smtp.SendMail(address, nil, "alerts@example.com", []string{"+380900123456@sms.local"}, mail)
+	if err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Fatalf("Expected the destination to be denied, got %v", err)
+	}
+	err = smtp.SendMail(address, nil, "alerts@example.com",
+		[]string{"+380631234567@sms.local", "380501234567@SMS.local"}, mail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := db.GetPendingMessages()
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d %v", len(messages), err)
+	}
+	for _, sms := range messages {
+		if sms.Body != "Disk full\nHost db1" || sms.Client != "email" ||
+			string(sms.Metadata) != `{"email_from":"alerts@example.com"}` {
+			t.Fatalf("Unexpected message %#v", sms)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+	"github.com/alexgear/sms/worker"
+)
+
+// forwardAttempts per mail before it is dropped
+const forwardAttempts = 3
+
+var forwardConf config.ForwardConfig
+var forwardFrom string
+var forwardRoutes []*regexp.Regexp
+
+var forwards = make(chan common.Inbound, 100)
+
+// InitForward mails received messages through the relay if configured.
+func InitForward(conf config.ForwardConfig) {
+	if conf.Relay == "" {
+		return
+	}
+	initForward(conf)
+	go forwarder()
+	worker.OnInbound(forwardInbound)
+}
+
+func initForward(conf config.ForwardConfig) {
+	forwardConf = conf
+	forwardFrom = ""
+	if from, err := mail.ParseAddress(conf.From); err == nil {
+		forwardFrom = from.Address
+	}
+	forwardRoutes = nil
+	for _, r := range conf.Routes {
+		forwardRoutes = append(forwardRoutes, regexp.MustCompile(r.Sender))
+	}
+}
+
+// forwardRecipients returns the addresses the messages of sender are mailed
+// to, of the first matching route or else To.
+func forwardRecipients(sender string) []string {
+	for i, pattern := range forwardRoutes {
+		if pattern.MatchString(sender) {
+			return forwardConf.Routes[i].To
+		}
+	}
+	return forwardConf.To
+}
+
+// forwardInbound queues a received message. It is dropped when the relay
+// falls behind.
+func forwardInbound(msg common.Inbound) {
+	if len(forwardRecipients(msg.Sender)) == 0 {
+		log.Printf("forwardInbound: no recipients for %s", msg.Sender)
+		return
+	}
+	select {
+	case forwards <- msg:
+	default:
+		log.Printf("forwardInbound: queue full, dropped %s", msg.UUID)
+	}
+}
+
+func forwarder() {
+	for msg := range forwards {
+		for attempt := 1; ; attempt++ {
+			err := forwardMail(msg)
+			if err == nil {
+				break
+			}
+			log.Printf("forwarder: attempt %d of %s failed. %s", attempt, msg.UUID, err.Error())
+			if attempt == forwardAttempts {
+				break
+			}
+			time.Sleep(time.Duration(attempt) * 10 * time.Second)
+		}
+	}
+}
+
+// forwardMail sends a received message to its recipients through the relay.
+func forwardMail(msg common.Inbound) error {
+	to := forwardRecipients(msg.Sender)
+	data, err := forwardMessage(msg, to, time.Now())
+	if err != nil {
+		return fmt.Errorf("forwardMail: %s", err.Error())
+	}
+	var auth smtp.Auth
+	if forwardConf.Username != "" {
+		host, _, _ := net.SplitHostPort(forwardConf.Relay)
+		auth = smtp.PlainAuth("", forwardConf.Username, forwardConf.Password, host)
+	}
+	err = smtp.SendMail(forwardConf.Relay, auth, forwardFrom, to, data)
+	if err != nil {
+		return fmt.Errorf("forwardMail: %s", err.Error())
+	}
+	log.Printf("forwardMail: %s from %s mailed to %s", msg.UUID, msg.Sender, strings.Join(to, ", "))
+	return nil
+}
+
+// forwardMessage renders the mail of a received message. Replies are
+// addressed to reply+<uuid>@Email.Domain if enabled.
+func forwardMessage(msg common.Inbound, to []string, now time.Time) ([]byte, error) {
+	vars := map[string]string{
+		"sender":      msg.Sender,
+		"received_at": msg.ReceivedAt.Local().Format("2006-01-02 15:04:05 MST"),
+		"text":        msg.Body,
+		"uuid":        msg.UUID}
+	subject, err := (&common.Template{Variants: map[string]string{"": forwardConf.Subject}}).Render("", vars)
+	if err != nil {
+		return nil, err
+	}
+	body, err := (&common.Template{Variants: map[string]string{"": forwardConf.Body}}).Render("", vars)
+	if err != nil {
+		return nil, err
+	}
+	domain := forwardFrom[strings.LastIndex(forwardFrom, "@")+1:]
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", forwardConf.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", headerValue(subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", msg.UUID, domain)
+	if forwardConf.Replies {
+		fmt.Fprintf(&b, "Reply-To: reply+%s@%s\r\n", msg.UUID, emailConf.Domain)
+	}
+	fmt.Fprintf(&b, "X-SMS-Sender: %s\r\n", headerValue(msg.Sender))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(&b)
+	// line breaks are written as CRLF
+	w.Write([]byte(body))
+	w.Close()
+	b.WriteString("\r\n")
+	return b.Bytes(), nil
+}
+
+// headerValue encodes s for a mail header, control characters such as line
+// breaks are replaced by spaces.
+func headerValue(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+	return mime.QEncoding.Encode("utf-8", s)
+}
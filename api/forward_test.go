@@ -0,0 +1,138 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+	"github.com/alexgear/sms/smtpd"
+)
+
+// smtpSink accepts any mail on a local port and returns its envelopes.
+func smtpSink(t *testing.T) (string, chan *smtpd.Envelope, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelopes := make(chan *smtpd.Envelope, 10)
+	server := &smtpd.Server{Hostname: "sink", MaxSize: 1024 * 1024, Timeout: time.Minute,
+		Deliver: func(e *smtpd.Envelope) error {
+			envelopes <- e
+			return nil
+		}}
+	go server.Serve(listener)
+	return listener.Addr().String(), envelopes, func() { listener.Close() }
+}
+
+func TestForward(t *testing.T) {
+	_, cleanup := initTestServer(t)
+	defer cleanup()
+	relay, envelopes, stop := smtpSink(t)
+	defer stop()
+	initEmail(config.EmailConfig{Domain: "sms.local", Allow: []string{"127.0.0.0/8"}, Client: "email",
+		Text: "both", StripQuoted: true, MaxSize: 1024, CutAt: []string{`^On .* wrote:$`}})
+	defer initEmail(config.EmailConfig{})
+	initForward(config.ForwardConfig{Relay: relay, From: "SMS <sms@example.com>", To: []string{"team@example.com"},
+		Subject: "SMS from {{sender}}", Body: "{{text}}\n\nFrom {{sender}} at {{received_at}}",
+		Routes:  []config.ForwardRoute{{Sender: `^\+38050`, To: []string{"sales@example.com"}}, {Sender: `^BANK$`}},
+		Replies: true})
+	defer initForward(config.ForwardConfig{})
+
+	if fmt.Sprint(forwardRecipients("+380501234567")) != "[sales@example.com]" ||
+		fmt.Sprint(forwardRecipients("+380631234567")) != "[team@example.com]" ||
+		len(forwardRecipients("BANK")) != 0 {
+		t.Fatal("Unexpected routing")
+	}
+
+	inbound := &common.Inbound{UUID: "20000000-0000-0000-0000-000000000001", Sender: "+380631234567",
+		Body: "Привіт, where is my order?", ReceivedAt: time.Date(2026, 10, 19, 9, 30, 0, 0, time.Local)}
+	err := db.InsertInbound(inbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = forwardMail(*inbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e *smtpd.Envelope
+	select {
+	case e = <-envelopes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a mail")
+	}
+	if e.From != "sms@example.com" || fmt.Sprint(e.To) != "[team@example.com]" {
+		t.Fatalf("Unexpected envelope %s %v", e.From, e.To)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(e.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replyTo := "reply+" + inbound.UUID + "@sms.local"
+	if msg.Header.Get("Reply-To") != replyTo || msg.Header.Get("Message-Id") != "<"+inbound.UUID+"@example.com>" ||
+		msg.Header.Get("X-Sms-Sender") != "+380631234567" {
+		t.Fatalf("Unexpected headers %v", msg.Header)
+	}
+	text, err := smtpd.ReadText(e.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text.Subject != "SMS from +380631234567" ||
+		text.Body != "Привіт, where is my order?\n\nFrom +380631234567 at 2026-10-19 09:30:00 "+
+			inbound.ReceivedAt.Format("MST")+"\n" {
+		t.Fatalf("Unexpected text %#v", text)
+	}
+
+	// line breaks in the sender must not inject headers
+	data, err := forwardMessage(common.Inbound{UUID: inbound.UUID, Sender: "BANK\r\nBcc: eve@example.com"},
+		[]string{"team@example.com"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("X-Sms-Sender"))
+	if err != nil || sender != "BANK  Bcc: eve@example.com" || msg.Header.Get("Bcc") != "" {
+		t.Fatalf("Unexpected headers %v", msg.Header)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go newEmailServer().Serve(listener)
+	address := listener.Addr().String()
+	reply := []byte("From: team@example.com\r\nSubject: Re: SMS from +380631234567\r\n\r\n" +
+		"Shipped yesterday\r\n\r\nOn Mon, 19 Oct 2026 SMS wrote:\r\n> where is my order?\r\n")
+	err = smtp.SendMail(address, nil, "someone@example.com", []string{replyTo}, reply)
+	if err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Fatalf("Expected a reply of someone else to be rejected, got %v", err)
+	}
+	err = smtp.SendMail(address, nil, "team@example.com",
+		[]string{"reply+20000000-0000-0000-0000-000000000002@sms.local"}, reply)
+	if err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Fatalf("Expected an unknown message to be rejected, got %v", err)
+	}
+	err = smtp.SendMail(address, nil, "team@example.com", []string{replyTo}, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := db.GetPendingMessages()
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d %v", len(messages), err)
+	}
+	if messages[0].Mobile != "+380631234567" || messages[0].Body != "Shipped yesterday" ||
+		string(messages[0].Metadata) != `{"email_from":"team@example.com","in_reply_to":"`+inbound.UUID+`"}` {
+		t.Fatalf("Unexpected message %#v", messages[0])
+	}
+}
@@ -0,0 +1,263 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/database"
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+)
+
+type GroupsResponse struct {
+	Groups []common.Group `json:"groups"`
+}
+
+type GroupResponse struct {
+	common.Group
+	Contacts []common.Contact `json:"contacts"`
+}
+
+type GroupMembersRequest struct {
+	Contacts []string `json:"contacts"`
+}
+
+// GroupSMSResponse lists the queued messages, the numbers of the group which
+// opted out and the ones the client may not send to.
+type GroupSMSResponse struct {
+	Group      string        `json:"group"`
+	Messages   []SMSResponse `json:"messages"`
+	Suppressed []string      `json:"suppressed"`
+	Rejected   []string      `json:"rejected"`
+}
+
+func decodeGroup(w http.ResponseWriter, r *http.Request) (*common.Group, bool) {
+	g := &common.Group{}
+	err := json.NewDecoder(r.Body).Decode(g)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %s", err.Error()), http.StatusBadRequest)
+		return nil, false
+	}
+	if id, ok := mux.Vars(r)["id"]; ok {
+		g.ID = id
+	}
+	err = g.Validate()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid group: %s", err.Error()), http.StatusBadRequest)
+		return nil, false
+	}
+	return g, true
+}
+
+func listGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	groups, err := db.ListGroups()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := GroupsResponse{Groups: groups}
+	if response.Groups == nil {
+		response.Groups = []common.Group{}
+	}
+	writeJSON(w, response)
+	return
+}
+
+func createGroupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	g, ok := decodeGroup(w, r)
+	if !ok {
+		return
+	}
+	err := db.InsertGroup(g)
+	if err == database.ErrExists {
+		http.Error(w, fmt.Sprintf("Group %s already exists", g.ID), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, g)
+	return
+}
+
+// getGroupHandler returns the group with its contacts.
+func getGroupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	id := mux.Vars(r)["id"]
+	g, err := db.GetGroup(id)
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Group %s not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	contacts, err := db.ListContacts(id)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := GroupResponse{Group: g, Contacts: contacts}
+	if response.Contacts == nil {
+		response.Contacts = []common.Contact{}
+	}
+	writeJSON(w, response)
+	return
+}
+
+func updateGroupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	g, ok := decodeGroup(w, r)
+	if !ok {
+		return
+	}
+	err := db.UpdateGroup(g)
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Group %s not found", g.ID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, g)
+	return
+}
+
+// deleteGroupHandler deletes the group but not its contacts.
+func deleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	err := db.DeleteGroup(id)
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Group %s not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// addGroupMembersHandler adds the contacts listed by uuid to the group.
+func addGroupMembersHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var request GroupMembersRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	err = db.AddGroupMembers(id, request.Contacts)
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Group %s or one of the contacts not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+func removeGroupMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := db.RemoveGroupMember(vars["id"], vars["uuid"])
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Contact %s is not in group %s", vars["uuid"], vars["id"]), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// sendToGroup queues a message to every contact of the group except the
+// ones which opted out or are not allowed destinations. All texts are
+// rendered before any message is queued, so a template missing an
+// attribute of one contact rejects the whole request.
+func sendToGroup(w http.ResponseWriter, r *http.Request, req *sendRequest, t *common.Template) {
+	_, err := db.GetGroup(req.Group)
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Group %s not found", req.Group), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	contacts, err := db.ListContacts(req.Group)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(contacts) == 0 {
+		http.Error(w, fmt.Sprintf("Group %s has no contacts", req.Group), http.StatusBadRequest)
+		return
+	}
+	var messages []*common.SMS
+	response := GroupSMSResponse{Group: req.Group, Messages: []SMSResponse{}, Suppressed: []string{}, Rejected: []string{}}
+	for i := range contacts {
+		err = checkDestination(client(r), contacts[i].Number)
+		if err != nil {
+			countRejected(client(r))
+			response.Rejected = append(response.Rejected, contacts[i].Number)
+			continue
+		}
+		optedOut, err := suppressed(contacts[i].Number)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if optedOut {
+			response.Suppressed = append(response.Suppressed, contacts[i].Number)
+			continue
+		}
+		text, status, err := req.render(t, &contacts[i])
+		if err != nil {
+			log.Println(err)
+			http.Error(w, fmt.Sprintf("Contact %s: %s", contacts[i].UUID, err.Error()), status)
+			return
+		}
+		messages = append(messages, &common.SMS{
+			UUID:       uuid.NewV1().String(),
+			Mobile:     contacts[i].Number,
+			Body:       text,
+			Status:     "pending",
+			Client:     client(r),
+			ClientRef:  req.ClientRef,
+			Metadata:   req.Metadata,
+			Priority:   req.priority,
+			QuietHours: req.QuietHours,
+			TimeZone:   req.TimeZone})
+	}
+	// all or none are queued, so that a retried request does not repeat
+	// messages
+	err = db.InsertMessages(messages)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, sms := range messages {
+		response.Messages = append(response.Messages, newSMSResponse(*sms))
+	}
+	writeJSON(w, response)
+}
@@ -0,0 +1,236 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+	"github.com/alexgear/sms/smpp"
+	"github.com/alexgear/sms/worker"
+	"github.com/satori/go.uuid"
+)
+
+var kannelConf config.KannelConfig
+
+// Delivery report types of dlr-mask
+const (
+	dlrDelivered    = 1
+	dlrUndelivered  = 2
+	dlrBuffered     = 4
+	dlrSMSCAccepted = 8
+	dlrSMSCRejected = 16
+)
+
+// kannelCallback records the delivery report callback of a message
+type kannelCallback struct {
+	DLRURL  string `json:"dlr_url"`
+	DLRMask int    `json:"dlr_mask"`
+}
+
+// InitKannel enables /cgi-bin/sendsms if configured. It is called before the
+// worker starts, so that the hook calling dlr-urls is in place.
+func InitKannel(conf config.KannelConfig) {
+	kannelConf = conf
+	if conf.Enabled {
+		worker.OnStatus(deliverDLR)
+	}
+}
+
+// kannelUser returns the user of the username and password of r, false if
+// they are invalid.
+func kannelUser(r *http.Request) (string, bool) {
+	username, password := r.FormValue("username"), r.FormValue("password")
+	for _, user := range kannelConf.Users {
+		if user.Username == username &&
+			subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1 {
+			return user.Username, true
+		}
+	}
+	return "", false
+}
+
+// kannelText decodes text in charset, by default UTF-8 or UTF-16BE for the
+// UCS-2 coding.
+func kannelText(text string, coding string, charset string) (string, error) {
+	switch coding {
+	case "", "0":
+		if charset == "" {
+			charset = "UTF-8"
+		}
+	case "2":
+		if charset == "" {
+			charset = "UTF-16BE"
+		}
+	case "1":
+		return "", fmt.Errorf("8 bit coding is not supported")
+	default:
+		return "", fmt.Errorf("Invalid coding %s", coding)
+	}
+	switch strings.ToUpper(charset) {
+	case "UTF-8", "UTF8":
+		if !utf8.ValidString(text) {
+			return "", fmt.Errorf("Invalid UTF-8 text")
+		}
+		return text, nil
+	case "ISO-8859-1", "LATIN1":
+		runes := make([]rune, len(text))
+		for i := 0; i < len(text); i++ {
+			runes[i] = rune(text[i])
+		}
+		return string(runes), nil
+	case "UTF-16BE", "UCS-2", "UCS2":
+		return smpp.DecodeText(smpp.CodingUCS2, []byte(text))
+	}
+	return "", fmt.Errorf("Unsupported charset %s", charset)
+}
+
+// kannelSendHandler queues a message to each of the numbers in to,
+// separated by spaces, like Kannel's sendsms does. Answers are plain text.
+func kannelSendHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	client, ok := kannelUser(r)
+	if !ok {
+		log.Printf("kannelSendHandler: invalid credentials of %#v", r.FormValue("username"))
+		http.Error(w, "Authorization failed for sendsms", http.StatusForbidden)
+		return
+	}
+	to := strings.Fields(r.FormValue("to"))
+	if len(to) == 0 {
+		http.Error(w, "Missing receiver number, rejected", http.StatusBadRequest)
+		return
+	}
+	text, err := kannelText(r.FormValue("text"), r.FormValue("coding"), r.FormValue("charset"))
+	if err != nil {
+		http.Error(w, err.Error()+", rejected", http.StatusBadRequest)
+		return
+	}
+	if text == "" {
+		http.Error(w, "Missing text, rejected", http.StatusBadRequest)
+		return
+	}
+	var callback json.RawMessage
+	if dlrURL := r.FormValue("dlr-url"); dlrURL != "" {
+		mask, err := strconv.Atoi(r.FormValue("dlr-mask"))
+		if err != nil || mask < 0 || mask > 31 {
+			http.Error(w, "Invalid dlr-mask, rejected", http.StatusBadRequest)
+			return
+		}
+		// not parsed as a URL, the escapes need not be valid percent-encoding
+		if !strings.HasPrefix(dlrURL, "http://") && !strings.HasPrefix(dlrURL, "https://") {
+			http.Error(w, "Invalid dlr-url, rejected", http.StatusBadRequest)
+			return
+		}
+		callback, _ = json.Marshal(kannelCallback{DLRURL: dlrURL, DLRMask: mask})
+	}
+	var messages []*common.SMS
+	for _, number := range to {
+		mobile := common.NormalizeNumber(number)
+		err = checkDestination(client, mobile)
+		if err != nil {
+			log.Printf("kannelSendHandler: %s %s", client, err.Error())
+			countRejected(client)
+			http.Error(w, "Number(s) has/have been denied by white- and/or black-lists.", http.StatusForbidden)
+			return
+		}
+		optedOut, err := suppressed(mobile)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if optedOut {
+			http.Error(w, fmt.Sprintf("Number %s has opted out, rejected", mobile), http.StatusForbidden)
+			return
+		}
+		messages = append(messages, &common.SMS{
+			UUID:     uuid.NewV1().String(),
+			Mobile:   mobile,
+			Body:     text,
+			Status:   "pending",
+			Client:   client,
+			Callback: callback,
+			Priority: common.PriorityNormal})
+	}
+	// all numbers are queued or none
+	err = db.InsertMessages(messages)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, sms := range messages {
+		log.Printf("kannelSendHandler: %s queued %s", client, sms.UUID)
+	}
+	w.Header().Set("Content-type", "text/plain")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(w, "0: Accepted for delivery")
+}
+
+// dlrType returns the delivery report type of event, 0 if there is none.
+func dlrType(sms common.SMS, event common.Event) int {
+	switch event.Event {
+	case common.EventDelivered:
+		return dlrDelivered
+	case common.EventUndelivered:
+		return dlrUndelivered
+	case common.EventSent:
+		return dlrSMSCAccepted
+	case common.EventSuppressed:
+		return dlrSMSCRejected
+	case common.EventError:
+		if !common.IsFinal(sms, event.Event) {
+			return dlrBuffered
+		}
+		return dlrSMSCRejected
+	}
+	return 0
+}
+
+// dlrURL expands the escapes of Kannel in the dlr-url of a message.
+func dlrURL(rawURL string, sms common.SMS, event common.Event, typ int) string {
+	escape := url.QueryEscape
+	return strings.NewReplacer(
+		"%%", "%",
+		"%d", strconv.Itoa(typ),
+		"%A", escape(event.Detail),
+		"%I", escape(sms.UUID),
+		"%p", escape(sms.Mobile),
+		"%F", escape(event.Code),
+		"%t", escape(event.Time.Format("2006-01-02 15:04:05")),
+		"%T", strconv.FormatInt(event.Time.Unix(), 10),
+	).Replace(rawURL)
+}
+
+// deliverDLR queues the delivery report callback of a message sent through
+// sendsms with a dlr-url if its dlr-mask asks for the event.
+func deliverDLR(sms common.SMS, event common.Event) {
+	var callback kannelCallback
+	json.Unmarshal(sms.Callback, &callback)
+	if callback.DLRURL == "" {
+		return
+	}
+	typ := dlrType(sms, event)
+	if callback.DLRMask&typ == 0 {
+		return
+	}
+	req, err := http.NewRequest("GET", dlrURL(callback.DLRURL, sms, event, typ), nil)
+	if err != nil {
+		log.Printf("deliverDLR: %s %s", sms.UUID, err.Error())
+		return
+	}
+	if !queueCallback(req) {
+		log.Printf("deliverDLR: dropped %s of %s, the callbacks are too slow", event.Event, sms.UUID)
+	}
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+)
+
+func TestKannel(t *testing.T) {
+	kannelConf = config.KannelConfig{Enabled: true,
+		Users: []config.KannelUser{{Username: "monitoring", Password: "secret"}}}
+	defer func() { kannelConf = config.KannelConfig{} }()
+	server, cleanup := initTestServer(t)
+	defer cleanup()
+
+	sendsms := func(params url.Values) (int, string) {
+		resp, err := http.Get(server.URL + "/cgi-bin/sendsms?" + params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	status, body := sendsms(url.Values{"username": {"monitoring"}, "password": {"wrong"},
+		"to": {"+380631234567"}, "text": {"test"}})
+	if status != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a wrong password, got %d %s", status, body)
+	}
+	status, body = sendsms(url.Values{"username": {"monitoring"}, "password": {"secret"},
+		"to": {"+380631234567 +380501234567"}, "text": {"\x00\x41\x04\x3f"}, "coding": {"2"},
+		"dlr-url": {"http://example.com/dlr?id=%I&type=%d"}, "dlr-mask": {"3"}})
+	if status != http.StatusAccepted || body != "0: Accepted for delivery" {
+		t.Fatalf("Expected the messages to be accepted, got %d %s", status, body)
+	}
+	messages, err := db.GetPendingMessages()
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d %v", len(messages), err)
+	}
+	for _, sms := range messages {
+		var callback kannelCallback
+		json.Unmarshal(sms.Callback, &callback)
+		if sms.Body != "Aп" || sms.Client != "monitoring" || callback.DLRMask != 3 || string(sms.Metadata) != "{}" {
+			t.Fatalf("Unexpected message %#v", sms)
+		}
+	}
+	status, body = sendsms(url.Values{"username": {"monitoring"}, "password": {"secret"},
+		"to": {"+380631234567"}, "text": {"\xe9t\xe9"}, "charset": {"ISO-8859-1"}, "coding": {"0"}})
+	if status != http.StatusAccepted {
+		t.Fatalf("Expected latin1 text to be accepted, got %d %s", status, body)
+	}
+	status, body = sendsms(url.Values{"username": {"monitoring"}, "password": {"secret"},
+		"to": {"+380631234567"}, "text": {"test"}, "coding": {"1"}})
+	if status != http.StatusBadRequest {
+		t.Fatalf("Expected 8 bit coding to be rejected, got %d %s", status, body)
+	}
+}
+
+func TestDeliverDLR(t *testing.T) {
+	callbacks := make(chan url.Values, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callbacks <- r.URL.Query()
+	}))
+	defer receiver.Close()
+
+	callback, _ := json.Marshal(kannelCallback{DLRURL: receiver.URL + "/dlr?id=%I&type=%d&to=%p&reply=%A",
+		DLRMask: dlrDelivered | dlrSMSCRejected})
+	sms := common.SMS{UUID: "70000000-0000-0000-0000-000000000000", Mobile: "+380631234567",
+		Callback: callback, Retries: 1}
+	now := time.Now()
+	// the metadata of clients is not a callback
+	deliverDLR(common.SMS{UUID: "70000000-0000-0000-0000-000000000001", Metadata: callback},
+		common.Event{Event: common.EventDelivered, Time: now})
+	// not in the mask
+	deliverDLR(sms, common.Event{Event: common.EventSent, Time: now})
+	// retried
+	deliverDLR(sms, common.Event{Event: common.EventError, Time: now})
+	deliverDLR(sms, common.Event{Event: common.EventDelivered, Detail: "stat DELIVRD", Time: now})
+	select {
+	case q := <-callbacks:
+		if q.Get("id") != sms.UUID || q.Get("type") != "1" || q.Get("to") != sms.Mobile ||
+			q.Get("reply") != "stat DELIVRD" {
+			t.Fatalf("Unexpected callback %v", q)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a delivery report callback")
+	}
+	sms.Retries = 3
+	deliverDLR(sms, common.Event{Event: common.EventError, Time: now})
+	select {
+	case q := <-callbacks:
+		if q.Get("type") != "16" {
+			t.Fatalf("Expected a final error to be reported as 16, got %v", q)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a delivery report callback")
+	}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/database"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+type SMSListResponse struct {
+	Messages   []SMSResponse `json:"messages"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// listSMSHandler searches messages by recipient (to), status, creation time
+// (since, until), body substring (q), submitting client and client_ref,
+// newest first.
+func listSMSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	filter := database.MessageFilter{
+		Mobile:    common.NormalizeNumber(r.FormValue("to")),
+		Status:    r.FormValue("status"),
+		Body:      r.FormValue("q"),
+		Client:    r.FormValue("client"),
+		ClientRef: r.FormValue("client_ref"),
+		Cursor:    r.FormValue("cursor"),
+	}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if r.FormValue(name) != "" {
+			v, err := time.Parse(time.RFC3339, r.FormValue(name))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s: %s", name, err.Error()), http.StatusBadRequest)
+				return
+			}
+			*t = v
+		}
+	}
+	limit, ok := parseLimit(w, r, defaultListLimit)
+	if !ok {
+		return
+	}
+	filter.Limit = limit
+	messages, cursor, err := db.ListMessages(filter)
+	if err == database.ErrInvalidCursor {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := SMSListResponse{Messages: []SMSResponse{}, NextCursor: cursor}
+	for _, sms := range messages {
+		response.Messages = append(response.Messages, newSMSResponse(sms))
+	}
+	toWrite, err := json.Marshal(response)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(toWrite)
+	return
+}
+
+type EventsResponse struct {
+	UUID   string         `json:"uuid"`
+	Status string         `json:"status"`
+	Events []common.Event `json:"events"`
+}
+
+func getSMSEventsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	w.Header().Set("Content-type", "application/json")
+	sms, err := db.GetMessageByUuid(vars["uuid"])
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Message %s not found", vars["uuid"]), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	events, err := db.GetEvents(sms.UUID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := EventsResponse{UUID: sms.UUID, Status: sms.Status, Events: events}
+	if response.Events == nil {
+		response.Events = []common.Event{}
+	}
+	toWrite, err := json.Marshal(response)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(toWrite)
+	return
+}
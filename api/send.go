@@ -0,0 +1,177 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/database"
+)
+
+// maxSegments of a rendered template, 0 is unlimited
+var maxSegments int
+
+// idempotencyWindow during which a repeated key returns the original message
+var idempotencyWindow = 24 * time.Hour
+
+// maxKeyLength of an idempotency key and a client_ref
+const maxKeyLength = 255
+
+// maxMetadataLength of the encoded metadata of a message
+const maxMetadataLength = 4096
+
+// sendRequest is a message submitted as a form or as a JSON object. It is
+// sent to either a number or a group, with either text or a template. Form
+// variables are passed as var.<name>.
+type sendRequest struct {
+	To        string                 `json:"to"`
+	Group     string                 `json:"group"`
+	Text      string                 `json:"text"`
+	Template  string                 `json:"template"`
+	Locale    string                 `json:"locale"`
+	Vars      map[string]interface{} `json:"vars"`
+	ClientRef string                 `json:"client_ref"`
+	Metadata  json.RawMessage        `json:"metadata"`
+	// Priority is high, normal or bulk
+	Priority string `json:"priority"`
+	priority int
+	// QuietHours such as "22:00-07:00" or "off" override the configured
+	// ones in TimeZone, by default that of the number
+	QuietHours string `json:"quiet_hours"`
+	TimeZone   string `json:"time_zone"`
+}
+
+func parseSendRequest(r *http.Request) (*sendRequest, error) {
+	req := &sendRequest{}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "application/json" {
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+		err := decoder.Decode(req)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid JSON: %s", err.Error())
+		}
+		return req, nil
+	}
+	err := r.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+	req.To = r.FormValue("to")
+	req.Group = r.FormValue("group")
+	req.Text = r.FormValue("text")
+	req.Template = r.FormValue("template")
+	req.Locale = r.FormValue("locale")
+	req.ClientRef = r.FormValue("client_ref")
+	req.Priority = r.FormValue("priority")
+	req.QuietHours = r.FormValue("quiet_hours")
+	req.TimeZone = r.FormValue("time_zone")
+	if r.FormValue("metadata") != "" {
+		req.Metadata = json.RawMessage(r.FormValue("metadata"))
+	}
+	req.Vars = make(map[string]interface{})
+	for name, values := range r.Form {
+		if strings.HasPrefix(name, "var.") {
+			req.Vars[strings.TrimPrefix(name, "var.")] = values[0]
+		}
+	}
+	return req, nil
+}
+
+// validate checks the fields stored as they are and parses the priority.
+func (req *sendRequest) validate() error {
+	var ok bool
+	req.priority, ok = common.ParsePriority(req.Priority)
+	if !ok {
+		return fmt.Errorf("priority must be high, normal or bulk")
+	}
+	if len(req.ClientRef) > maxKeyLength {
+		return fmt.Errorf("client_ref longer than %d", maxKeyLength)
+	}
+	if req.QuietHours != "" && req.QuietHours != common.QuietHoursOff {
+		_, err := common.ParseQuietHours(req.QuietHours)
+		if err != nil {
+			return fmt.Errorf("%s or %s", err.Error(), common.QuietHoursOff)
+		}
+	}
+	if req.TimeZone != "" {
+		_, err := time.LoadLocation(req.TimeZone)
+		if err != nil {
+			return fmt.Errorf("Unknown time_zone %s", req.TimeZone)
+		}
+	}
+	if len(req.Metadata) == 0 {
+		return nil
+	}
+	if len(req.Metadata) > maxMetadataLength {
+		return fmt.Errorf("metadata longer than %d", maxMetadataLength)
+	}
+	var object map[string]interface{}
+	if json.Unmarshal(req.Metadata, &object) != nil || object == nil {
+		return fmt.Errorf("metadata must be a JSON object")
+	}
+	return nil
+}
+
+// vars returns the template variables as strings.
+func (req *sendRequest) vars() map[string]string {
+	vars := make(map[string]string)
+	for name, value := range req.Vars {
+		vars[name] = fmt.Sprint(value)
+	}
+	return vars
+}
+
+// template loads the template of the request, nil if the text is given.
+// The error is meant for the client.
+func (req *sendRequest) template() (*common.Template, int, error) {
+	if req.Template == "" {
+		if req.Text == "" {
+			return nil, http.StatusBadRequest, fmt.Errorf("Either text or template is required")
+		}
+		return nil, http.StatusOK, nil
+	}
+	if req.Text != "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("Only one of text and template is allowed")
+	}
+	t, err := db.GetTemplate(req.Template)
+	if err == database.ErrNotFound {
+		return nil, http.StatusBadRequest, fmt.Errorf("Template %s not found", req.Template)
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return &t, http.StatusOK, nil
+}
+
+// render returns the text of the message to contact, which may be nil. The
+// template is rendered in the locale of the request or of the contact, with
+// the variables of both.
+func (req *sendRequest) render(t *common.Template, contact *common.Contact) (string, int, error) {
+	if t == nil {
+		return req.Text, http.StatusOK, nil
+	}
+	vars := req.vars()
+	locale := req.Locale
+	if contact != nil {
+		for name, value := range contact.Vars() {
+			vars[name] = value
+		}
+		if locale == "" {
+			locale = contact.Locale
+		}
+	}
+	text, err := t.Render(locale, vars)
+	if err != nil {
+		return "", http.StatusBadRequest, fmt.Errorf("Template %s: %s", t.ID, err.Error())
+	}
+	segments := common.Segments(text)
+	if maxSegments > 0 && segments > maxSegments {
+		return "", http.StatusBadRequest, fmt.Errorf("Template %s renders to %d segments, at most %d allowed",
+			t.ID, segments, maxSegments)
+	}
+	return text, http.StatusOK, nil
+}
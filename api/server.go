@@ -2,48 +2,143 @@ package api
 
 import (
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/alexgear/sms/common"
-	db "github.com/alexgear/sms/database"
-	"github.com/alexgear/sms/modem"
+	"github.com/alexgear/sms/config"
+	"github.com/alexgear/sms/database"
+	"github.com/alexgear/sms/worker"
 	"github.com/gorilla/mux"
 	"github.com/satori/go.uuid"
 )
 
 var err error
+var db database.Store
 
 //response structure to /sms
 type SMSResponse struct {
-	Text   string `json:"text"`
-	UUID   string `json:"uuid"`
-	Status string `json:"status"`
+	Text      string          `json:"text"`
+	UUID      string          `json:"uuid"`
+	Status    string          `json:"status"`
+	To        string          `json:"to"`
+	Retries   int             `json:"retries"`
+	Client    string          `json:"client,omitempty"`
+	ClientRef string          `json:"client_ref,omitempty"`
+	Metadata  json.RawMessage `json:"metadata,omitempty"`
+	Priority  string          `json:"priority"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt *time.Time      `json:"updated_at"`
+
+	QuietHours string `json:"quiet_hours,omitempty"`
+	TimeZone   string `json:"time_zone,omitempty"`
+}
+
+func newSMSResponse(sms common.SMS) SMSResponse {
+	return SMSResponse{
+		Text:       sms.Body,
+		UUID:       sms.UUID,
+		Status:     sms.Status,
+		To:         sms.Mobile,
+		Retries:    sms.Retries,
+		Client:     sms.Client,
+		ClientRef:  sms.ClientRef,
+		Metadata:   sms.Metadata,
+		Priority:   common.PriorityNames[sms.Priority],
+		CreatedAt:  sms.CreatedAt,
+		UpdatedAt:  sms.UpdatedAt,
+		QuietHours: sms.QuietHours,
+		TimeZone:   sms.TimeZone}
 }
 
 type BalanceResponse struct {
-	Balance float64 `json:"balance"`
+	Balance  float64   `json:"balance"`
+	Currency string    `json:"currency"`
+	Raw      string    `json:"raw"`
+	Time     time.Time `json:"time"`
 }
 
+// sendSMSHandler queues a message to a number or to every contact of a
+// group, with either text or a template rendered with vars in locale. A
+// message to a number with a known Idempotency-Key is not queued again, the
+// original one is returned instead.
 func sendSMSHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-type", "application/json")
-	vars := mux.Vars(r)
-	r.ParseForm()
-	log.Printf("sendSMSHandler: %#v %#v", vars, r.Form)
+	req, err := parseSendRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("sendSMSHandler: %#v", req)
+	if (req.To == "") == (req.Group == "") {
+		http.Error(w, "Either to or group is required", http.StatusBadRequest)
+		return
+	}
+	err = req.validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, status, err := req.template()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxKeyLength {
+		http.Error(w, fmt.Sprintf("Idempotency key longer than %d", maxKeyLength), http.StatusBadRequest)
+		return
+	}
+	if req.Group != "" {
+		if key != "" {
+			http.Error(w, "Idempotency keys are not supported when sending to a group", http.StatusBadRequest)
+			return
+		}
+		sendToGroup(w, r, req, t)
+		return
+	}
+	text, status, err := req.render(t, nil)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	mobile := common.NormalizeNumber(req.To)
+	if rejectDestination(w, r, mobile) || rejectSuppressed(w, mobile) {
+		return
+	}
 	uuid := uuid.NewV1()
 	sms := &common.SMS{
-		UUID:   uuid.String(),
-		Mobile: r.Form["to"][0],
-		Body:   r.Form["text"][0],
-		Status: "pending"}
-	err = db.InsertMessage(sms)
+		UUID:       uuid.String(),
+		Mobile:     mobile,
+		Body:       text,
+		Status:     "pending",
+		Client:     client(r),
+		ClientRef:  req.ClientRef,
+		Metadata:   req.Metadata,
+		Priority:   req.priority,
+		QuietHours: req.QuietHours,
+		TimeZone:   req.TimeZone}
+	if key == "" {
+		err = db.InsertMessage(sms)
+	} else {
+		var created bool
+		created, err = db.InsertMessageOnce(sms, key, idempotencyWindow)
+		if !created && err == nil {
+			log.Printf("sendSMSHandler: %#v repeats %s", key, sms.UUID)
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+	}
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	response := SMSResponse{Text: sms.Body, UUID: sms.UUID, Status: sms.Status}
+	response := newSMSResponse(*sms)
 	toWrite, err := json.Marshal(response)
 	if err != nil {
 		log.Println(err)
@@ -56,13 +151,78 @@ func sendSMSHandler(w http.ResponseWriter, r *http.Request) {
 
 func getBalanceHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-type", "application/json")
-	balance, err := modem.GetBalance(`*111#`)
+	balance, err := worker.QueryBalance()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := BalanceResponse{
+		Balance:  balance.Amount,
+		Currency: balance.Currency,
+		Raw:      balance.Raw,
+		Time:     balance.Time}
+	toWrite, err := json.Marshal(response)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(toWrite)
+	return
+}
+
+func getThrottleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	toWrite, err := json.Marshal(worker.ThrottleState())
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(toWrite)
+}
+
+type BalanceHistoryResponse struct {
+	Balances []common.Balance `json:"balances"`
+	common.SpendEstimate
+}
+
+func getBalanceHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	now := time.Now()
+	from, to := now.Add(-30*24*time.Hour), now
+	var err error
+	if r.FormValue("from") != "" {
+		from, err = time.Parse(time.RFC3339, r.FormValue("from"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid from: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+	if r.FormValue("to") != "" {
+		to, err = time.Parse(time.RFC3339, r.FormValue("to"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid to: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+	balances, err := db.GetBalances(from, to)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	response := BalanceResponse{Balance: balance}
+	estimate, err := worker.EstimateSpend(balances, now)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := BalanceHistoryResponse{Balances: balances, SpendEstimate: *estimate}
+	if response.Balances == nil {
+		response.Balances = []common.Balance{}
+	}
 	toWrite, err := json.Marshal(response)
 	if err != nil {
 		log.Println(err)
@@ -77,12 +237,15 @@ func getSMSHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	w.Header().Set("Content-type", "application/json")
 	sms, err := db.GetMessageByUuid(vars["uuid"])
-	if err != nil {
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Message %s not found", vars["uuid"]), http.StatusNotFound)
+		return
+	} else if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	response := SMSResponse{Text: sms.Body, UUID: sms.UUID, Status: sms.Status}
+	response := newSMSResponse(sms)
 	toWrite, err := json.Marshal(response)
 	if err != nil {
 		log.Println(err)
@@ -93,12 +256,58 @@ func getSMSHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func InitServer(host string, port int) error {
+func newRouter() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
-	router.HandleFunc("/api/sms", sendSMSHandler).Methods("POST")
-	router.HandleFunc("/api/balance", getBalanceHandler).Methods("GET")
-	router.HandleFunc("/api/sms/{uuid}", getSMSHandler).Methods("GET")
-	bind := fmt.Sprintf("%s:%d", host, port)
+	router.HandleFunc("/api/sms", authenticate(sendSMSHandler)).Methods("POST")
+	router.HandleFunc("/api/sms", authenticate(listSMSHandler)).Methods("GET")
+	router.HandleFunc("/api/balance", authenticate(getBalanceHandler)).Methods("GET")
+	router.HandleFunc("/api/balance/history", authenticate(getBalanceHistoryHandler)).Methods("GET")
+	router.HandleFunc("/api/sms/{uuid}", authenticate(getSMSHandler)).Methods("GET")
+	router.HandleFunc("/api/sms/{uuid}/events", authenticate(getSMSEventsHandler)).Methods("GET")
+	router.HandleFunc("/api/templates", authenticate(listTemplatesHandler)).Methods("GET")
+	router.HandleFunc("/api/templates", authenticate(createTemplateHandler)).Methods("POST")
+	router.HandleFunc("/api/templates/{id}", authenticate(getTemplateHandler)).Methods("GET")
+	router.HandleFunc("/api/templates/{id}", authenticate(updateTemplateHandler)).Methods("PUT")
+	router.HandleFunc("/api/templates/{id}", authenticate(deleteTemplateHandler)).Methods("DELETE")
+	router.HandleFunc("/api/contacts", authenticate(listContactsHandler)).Methods("GET")
+	router.HandleFunc("/api/contacts", authenticate(createContactHandler)).Methods("POST")
+	router.HandleFunc("/api/contacts/import", authenticate(importContactsHandler)).Methods("POST")
+	router.HandleFunc("/api/contacts/{uuid}", authenticate(getContactHandler)).Methods("GET")
+	router.HandleFunc("/api/contacts/{uuid}", authenticate(updateContactHandler)).Methods("PUT")
+	router.HandleFunc("/api/contacts/{uuid}", authenticate(deleteContactHandler)).Methods("DELETE")
+	router.HandleFunc("/api/groups", authenticate(listGroupsHandler)).Methods("GET")
+	router.HandleFunc("/api/groups", authenticate(createGroupHandler)).Methods("POST")
+	router.HandleFunc("/api/groups/{id}", authenticate(getGroupHandler)).Methods("GET")
+	router.HandleFunc("/api/groups/{id}", authenticate(updateGroupHandler)).Methods("PUT")
+	router.HandleFunc("/api/groups/{id}", authenticate(deleteGroupHandler)).Methods("DELETE")
+	router.HandleFunc("/api/groups/{id}/members", authenticate(addGroupMembersHandler)).Methods("POST")
+	router.HandleFunc("/api/groups/{id}/members/{uuid}", authenticate(removeGroupMemberHandler)).Methods("DELETE")
+	router.HandleFunc("/api/suppressions", authenticate(listSuppressionsHandler)).Methods("GET")
+	router.HandleFunc("/api/suppressions", authenticate(createSuppressionHandler)).Methods("POST")
+	router.HandleFunc("/api/suppressions/{number}", authenticate(getSuppressionHandler)).Methods("GET")
+	router.HandleFunc("/api/suppressions/{number}", authenticate(deleteSuppressionHandler)).Methods("DELETE")
+	router.HandleFunc("/api/throttle", authenticate(getThrottleHandler)).Methods("GET")
+	router.HandleFunc("/api/metrics", authenticate(expvar.Handler().ServeHTTP)).Methods("GET")
+	router.HandleFunc("/api/conversations", authenticate(listConversationsHandler)).Methods("GET")
+	router.HandleFunc("/api/conversations/{number}", authenticate(getConversationHandler)).Methods("GET")
+	router.HandleFunc("/api/conversations/{number}", authenticate(replyHandler)).Methods("POST")
+	if kannelConf.Enabled {
+		router.HandleFunc("/cgi-bin/sendsms", kannelSendHandler).Methods("GET", "POST")
+	}
+	if twilioConf.Enabled {
+		router.HandleFunc("/2010-04-01/Accounts/{sid}/Messages.json", twilioCreateMessageHandler).Methods("POST")
+		router.HandleFunc("/2010-04-01/Accounts/{sid}/Messages/{message}.json", twilioGetMessageHandler).Methods("GET")
+	}
+	return router
+}
+
+func InitServer(store database.Store, conf config.Config) error {
+	db = store
+	initClients(conf.Clients)
+	initDestinations(conf)
+	maxSegments = conf.MaxSegments
+	idempotencyWindow = time.Duration(conf.IdempotencyWindow) * time.Second
+	bind := fmt.Sprintf("%s:%d", conf.ServerHost, conf.ServerPort)
 	log.Println("listening on: ", bind)
-	return http.ListenAndServe(bind, router)
+	return http.ListenAndServe(bind, newRouter())
 }
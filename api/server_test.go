@@ -0,0 +1,421 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alexgear/sms/config"
+	"github.com/alexgear/sms/database"
+)
+
+func initTestServer(t *testing.T) (*httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "sms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = database.InitDB(filepath.Join(dir, "db.sqlite"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newRouter())
+	return server, func() {
+		server.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func postSMS(t *testing.T, server *httptest.Server, to string, text string) SMSResponse {
+	resp, err := http.PostForm(server.URL+"/api/sms", url.Values{"to": {to}, "text": {text}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	var sms SMSResponse
+	err = json.NewDecoder(resp.Body).Decode(&sms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sms
+}
+
+func TestGetSMS(t *testing.T) {
+	server, cleanup := initTestServer(t)
+	defer cleanup()
+	sent := postSMS(t, server, "+380631234567", "test")
+	resp, err := http.Get(server.URL + "/api/sms/" + sent.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var sms SMSResponse
+	err = json.NewDecoder(resp.Body).Decode(&sms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sms.UUID != sent.UUID || sms.Text != "test" || sms.To != "+380631234567" ||
+		sms.Status != "pending" || !sms.CreatedAt.Equal(sent.CreatedAt) {
+		t.Fatalf("Expected %#v, got %#v", sent, sms)
+	}
+}
+
+func TestGetSMSInjection(t *testing.T) {
+	server, cleanup := initTestServer(t)
+	defer cleanup()
+	sent := postSMS(t, server, "+380631234567", "test")
+	uuids := []string{
+		`" OR ""="`,
+		`' OR '1'='1`,
+		`x"; DROP TABLE messages; --`,
+		`x'; DROP TABLE messages; --`,
+		sent.UUID + `" OR 1=1 --`,
+		sent.UUID + `' UNION SELECT uuid, message, mobile, status, retries FROM messages --`,
+	}
+	for _, uuid := range uuids {
+		resp, err := http.Get(server.URL + "/api/sms/" + strings.Replace(url.QueryEscape(uuid), "+", "%20", -1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		// the message must come from getSMSHandler, not from an unmatched route
+		if resp.StatusCode != http.StatusNotFound || !strings.HasPrefix(string(body), "Message ") {
+			t.Fatalf("Expected 404 for %#v, got %d %s", uuid, resp.StatusCode, body)
+		}
+	}
+	// the table survived
+	_, err := db.GetMessageByUuid(sent.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendTemplate(t *testing.T) {
+	server, cleanup := initTestServer(t)
+	defer cleanup()
+	maxSegments = 1
+	defer func() { maxSegments = 0 }()
+	template := `{"id": "otp", "default_locale": "en", "variants": {"en": "Your code is {{code}}", "uk": "Ваш код {{code}}"}}`
+	resp, err := http.Post(server.URL+"/api/templates", "application/json", strings.NewReader(template))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", resp.StatusCode)
+	}
+	resp, err = http.Post(server.URL+"/api/sms", "application/json",
+		strings.NewReader(`{"to": "+380631234567", "template": "otp", "locale": "uk", "vars": {"code": 1234}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sms SMSResponse
+	err = json.NewDecoder(resp.Body).Decode(&sms)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sms.Text != "Ваш код 1234" {
+		t.Fatalf("Expected rendered text, got %#v", sms)
+	}
+	requests := []url.Values{
+		{"to": {"+380631234567"}, "template": {"otp"}},
+		{"to": {"+380631234567"}, "template": {"unknown"}, "var.code": {"1"}},
+		{"to": {"+380631234567"}, "template": {"otp"}, "var.code": {strings.Repeat("1", 160)}},
+	}
+	for _, values := range requests {
+		resp, err = http.PostForm(server.URL+"/api/sms", values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v, got %d", values, resp.StatusCode)
+		}
+	}
+	resp, err = http.PostForm(server.URL+"/api/sms", url.Values{"to": {"+380631234567"}, "template": {"otp"}, "var.code": {"42"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&sms)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sms.Text != "Your code is 42" {
+		t.Fatalf("Expected rendered text, got %#v", sms)
+	}
+}
+
+func TestSendToGroup(t *testing.T) {
+	server, cleanup := initTestServer(t)
+	defer cleanup()
+	requests := []struct {
+		path string
+		body string
+	}{
+		{"/api/templates", `{"id": "order", "default_locale": "en", "variants": {` +
+			`"en": "{{contact.name}}, order {{contact.order}} is {{status}}",` +
+			`"uk": "{{contact.name}}, замовлення {{contact.order}}: {{status}}"}}`},
+		{"/api/groups", `{"id": "customers"}`},
+		{"/api/contacts/import?group=customers", "number,name,locale,order\n" +
+			"+380631234567,Olena,uk,42\n0501234567,Taras,,43\n"},
+	}
+	for _, request := range requests {
+		resp, err := http.Post(server.URL+request.path, "application/json", strings.NewReader(request.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected success for %s, got %d %s", request.path, resp.StatusCode, body)
+		}
+	}
+	resp, err := http.PostForm(server.URL+"/api/sms",
+		url.Values{"group": {"customers"}, "template": {"order"}, "var.status": {"shipped"},
+			"client_ref": {"campaign-1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var response GroupSMSResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts := make(map[string]string)
+	for _, sms := range response.Messages {
+		texts[sms.To] = sms.Text
+		if sms.ClientRef != "campaign-1" {
+			t.Fatalf("Expected the client_ref of the group send, got %#v", sms)
+		}
+	}
+	// DefaultCountryCode is not set, national numbers are kept as they are
+	expected := map[string]string{
+		"+380631234567": "Olena, замовлення 42: shipped",
+		"0501234567":    "Taras, order 43 is shipped",
+	}
+	if fmt.Sprint(texts) != fmt.Sprint(expected) {
+		t.Fatalf("Expected %v, got %v", expected, texts)
+	}
+}
+
+func TestSuppressedNumber(t *testing.T) {
+	server, cleanup := initTestServer(t)
+	defer cleanup()
+	resp, err := http.PostForm(server.URL+"/api/suppressions", url.Values{"number": {"+380631234567"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", resp.StatusCode)
+	}
+	resp, err = http.PostForm(server.URL+"/api/sms", url.Values{"to": {"+380631234567"}, "text": {"test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403, got %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("DELETE", server.URL+"/api/suppressions/%2B380631234567", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", resp.StatusCode)
+	}
+	postSMS(t, server, "+380631234567", "test")
+}
+
+func TestDestinations(t *testing.T) {
+	server, cleanup := initTestServer(t)
+	defer cleanup()
+	conf := config.Config{
+		Clients: []config.ClientConfig{
+			{Name: "crm", Key: "crm-key", Destinations: config.DestinationConfig{Allow: []string{"+38063"}}},
+			{Name: "ops", Key: "ops-key"},
+		},
+		Destinations: config.DestinationConfig{Allow: []string{"+380"}, Deny: []string{"+380900"}},
+	}
+	initClients(conf.Clients)
+	initDestinations(conf)
+	defer initClients(nil)
+	defer initDestinations(config.Config{})
+	statuses := []struct {
+		key    string
+		to     string
+		status int
+	}{
+		{"crm-key", "+380631234567", http.StatusOK},
+		{"crm-key", "+380501234567", http.StatusForbidden},
+		{"ops-key", "+380501234567", http.StatusOK},
+		{"ops-key", "+380900123456", http.StatusForbidden},
+		{"ops-key", "+447700900123", http.StatusForbidden},
+		{"wrong-key", "+380631234567", http.StatusUnauthorized},
+	}
+	for _, s := range statuses {
+		req, _ := http.NewRequest("POST", server.URL+"/api/sms",
+			strings.NewReader(url.Values{"to": {s.to}, "text": {"test"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-API-Key", s.key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != s.status {
+			t.Fatalf("Expected %d for %s to %s, got %d", s.status, s.key, s.to, resp.StatusCode)
+		}
+	}
+	if rejected := rejectedDestinations.Get("ops").String(); rejected != "2" {
+		t.Fatalf("Expected 2 rejections of ops, got %s", rejected)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	server, cleanup := initTestServer(t)
+	defer cleanup()
+	var uuids []string
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", server.URL+"/api/sms",
+			strings.NewReader(url.Values{"to": {"+380631234567"}, "text": {"test"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Idempotency-Key", "order-1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sms SMSResponse
+		err = json.NewDecoder(resp.Body).Decode(&sms)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if replayed := resp.Header.Get("Idempotent-Replayed") == "true"; replayed != (i == 1) {
+			t.Fatalf("Expected only the second request to be replayed, got %v for %d", replayed, i)
+		}
+		uuids = append(uuids, sms.UUID)
+	}
+	if uuids[0] != uuids[1] {
+		t.Fatalf("Expected the same message, got %v", uuids)
+	}
+	if sent := postSMS(t, server, "+380631234567", "test"); sent.UUID == uuids[0] {
+		t.Fatal("Expected a message without a key to be queued")
+	}
+}
+
+func TestClientRefAndMetadata(t *testing.T) {
+	server, cleanup := initTestServer(t)
+	defer cleanup()
+	resp, err := http.Post(server.URL+"/api/sms", "application/json", strings.NewReader(
+		`{"to": "+380631234567", "text": "test", "client_ref": "order-42", "metadata": {"ticket": 7}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for _, metadata := range []string{`[1]`, `"text"`, `{`} {
+		resp, err = http.PostForm(server.URL+"/api/sms",
+			url.Values{"to": {"+380631234567"}, "text": {"test"}, "metadata": {metadata}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for metadata %s, got %d", metadata, resp.StatusCode)
+		}
+	}
+	postSMS(t, server, "+380631234567", "test")
+	resp, err = http.PostForm(server.URL+"/api/sms",
+		url.Values{"to": {"+380631234567"}, "text": {"another test"}, "client_ref": {"order-42"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = http.Get(server.URL + "/api/sms?client_ref=order-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list SMSListResponse
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Messages) != 2 || list.Messages[0].ClientRef != "order-42" ||
+		list.Messages[1].ClientRef != "order-42" {
+		t.Fatalf("Expected both messages of order-42, got %#v", list.Messages)
+	}
+	// newest first
+	if string(list.Messages[1].Metadata) != `{"ticket":7}` {
+		t.Fatalf("Expected the metadata of the first message, got %s", list.Messages[1].Metadata)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	server, cleanup := initTestServer(t)
+	defer cleanup()
+	if sms := postSMS(t, server, "+380631234567", "test"); sms.Priority != "normal" {
+		t.Fatalf("Expected normal priority by default, got %#v", sms.Priority)
+	}
+	for priority, status := range map[string]int{"high": http.StatusOK, "bulk": http.StatusOK, "urgent": http.StatusBadRequest} {
+		resp, err := http.PostForm(server.URL+"/api/sms",
+			url.Values{"to": {"+380631234567"}, "text": {"test"}, "priority": {priority}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sms SMSResponse
+		json.NewDecoder(resp.Body).Decode(&sms)
+		resp.Body.Close()
+		if resp.StatusCode != status || (status == http.StatusOK && sms.Priority != priority) {
+			t.Fatalf("Expected %d for %s, got %d %#v", status, priority, resp.StatusCode, sms)
+		}
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	server, cleanup := initTestServer(t)
+	defer cleanup()
+	tests := []struct {
+		quietHours string
+		timeZone   string
+		status     int
+	}{
+		{"22:00-07:00", "Europe/Lisbon", http.StatusOK},
+		{"off", "", http.StatusOK},
+		{"night", "", http.StatusBadRequest},
+		{"", "Mars/Olympus_Mons", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		resp, err := http.PostForm(server.URL+"/api/sms", url.Values{"to": {"+380631234567"}, "text": {"test"},
+			"quiet_hours": {test.quietHours}, "time_zone": {test.timeZone}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sms SMSResponse
+		json.NewDecoder(resp.Body).Decode(&sms)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Fatalf("Expected %d for %#v, got %d", test.status, test, resp.StatusCode)
+		}
+		if test.status == http.StatusOK && (sms.QuietHours != test.quietHours || sms.TimeZone != test.timeZone) {
+			t.Fatalf("Expected %#v to be stored, got %#v", test, sms)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+	"github.com/alexgear/sms/database"
+	"github.com/alexgear/sms/smpp"
+	"github.com/alexgear/sms/worker"
+	"github.com/satori/go.uuid"
+)
+
+var smppConf config.SMPPConfig
+
+// smppSessions are the bound sessions by system_id
+var smppSessions = struct {
+	sync.Mutex
+	bySystemID map[string][]*smppSession
+}{bySystemID: make(map[string][]*smppSession)}
+
+// smppClaims are the ids of deliveries being sent by a session, so that
+// other sessions of the same system_id skip them
+var smppClaims = struct {
+	sync.Mutex
+	byID map[int64]bool
+}{byID: make(map[int64]bool)}
+
+// smppRetryDelay after which the deliveries of a bound receiver are looked up
+// again, to retry rejected ones and pick up those queued by other instances
+var smppRetryDelay = 10 * time.Second
+
+// smppResponseTimeout after which a receiver not answering a deliver_sm is
+// disconnected
+var smppResponseTimeout = 30 * time.Second
+
+type smppSession struct {
+	conn    *smpp.Conn
+	account config.SMPPAccount
+	// bound is the bind command, 0 before the bind
+	bound uint32
+	// wakeup receives a value when a delivery is queued for the session
+	wakeup chan struct{}
+	// responses receives deliver_sm_resp and generic_nack of the client
+	responses chan *smpp.PDU
+	done      chan struct{}
+}
+
+// InitSMPP listens for SMPP clients if configured. It is called before the
+// worker starts, so that the hooks delivering received messages and
+// receipts are in place.
+func InitSMPP(store database.Store, conf config.Config) error {
+	if conf.SMPP.Listen == "" {
+		return nil
+	}
+	db = store
+	initDestinations(conf)
+	listener, err := net.Listen("tcp", conf.SMPP.Listen)
+	if err != nil {
+		return fmt.Errorf("InitSMPP: %s", err.Error())
+	}
+	log.Println("SMPP listening on: ", conf.SMPP.Listen)
+	smppConf = conf.SMPP
+	worker.OnInbound(deliverInbound)
+	worker.OnStatus(deliverReceipt)
+	go serveSMPP(listener)
+	return nil
+}
+
+func serveSMPP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Printf("serveSMPP: %s", err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		go handleSMPP(conn)
+	}
+}
+
+func handleSMPP(conn net.Conn) {
+	log.Printf("handleSMPP: connection from %s", conn.RemoteAddr())
+	s := &smppSession{conn: smpp.NewConn(conn), wakeup: make(chan struct{}, 1),
+		responses: make(chan *smpp.PDU, 1), done: make(chan struct{})}
+	defer s.close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(smppConf.IdleTimeout) * time.Second))
+		p, err := s.conn.ReadPDU()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("handleSMPP: %s %s", conn.RemoteAddr(), err.Error())
+			}
+			return
+		}
+		if !s.handle(p) {
+			return
+		}
+	}
+}
+
+func (s *smppSession) close() {
+	smppSessions.Lock()
+	defer smppSessions.Unlock()
+	sessions := smppSessions.bySystemID[s.account.SystemID]
+	for i, session := range sessions {
+		if session == s {
+			smppSessions.bySystemID[s.account.SystemID] = append(sessions[:i:i], sessions[i+1:]...)
+			break
+		}
+	}
+	s.conn.Close()
+	close(s.done)
+}
+
+func (s *smppSession) transmits() bool {
+	return s.bound == smpp.BindTransmitter || s.bound == smpp.BindTransceiver
+}
+
+func (s *smppSession) receives() bool {
+	return s.bound == smpp.BindReceiver || s.bound == smpp.BindTransceiver
+}
+
+// wakeReceivers signals the sessions of systemID bound to receive.
+func wakeReceivers(systemID string) {
+	smppSessions.Lock()
+	defer smppSessions.Unlock()
+	for _, s := range smppSessions.bySystemID[systemID] {
+		if !s.receives() {
+			continue
+		}
+		select {
+		case s.wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// handle answers a request and returns false when the session ends.
+func (s *smppSession) handle(p *smpp.PDU) bool {
+	var err error
+	switch p.CommandID {
+	case smpp.BindTransmitter, smpp.BindReceiver, smpp.BindTransceiver:
+		err = s.bind(p)
+	case smpp.SubmitSM:
+		err = s.submit(p)
+	case smpp.EnquireLink:
+		err = s.conn.Respond(p, smpp.StatusOK, nil)
+	case smpp.Unbind:
+		s.conn.Respond(p, smpp.StatusOK, nil)
+		return false
+	case smpp.DeliverSMResp, smpp.GenericNack:
+		select {
+		case s.responses <- p:
+		default:
+		}
+	case smpp.EnquireLinkResp:
+		if p.Status != smpp.StatusOK {
+			log.Printf("handle: %s %s rejected %s", s.account.SystemID, s.conn.RemoteAddr(), p)
+		}
+	default:
+		if !p.IsResponse() {
+			err = s.conn.WritePDU(&smpp.PDU{CommandID: smpp.GenericNack, Status: smpp.StatusInvalidCmdID,
+				Sequence: p.Sequence})
+		}
+	}
+	if err != nil {
+		log.Printf("handle: %s %s", s.conn.RemoteAddr(), err.Error())
+		return false
+	}
+	return true
+}
+
+func (s *smppSession) bind(p *smpp.PDU) error {
+	if s.bound != 0 {
+		return s.conn.Respond(p, smpp.StatusAlreadyBound, nil)
+	}
+	b, err := smpp.DecodeBind(p.Body)
+	if err != nil {
+		log.Printf("bind: %s", err.Error())
+		return s.conn.Respond(p, smpp.StatusBindFailed, nil)
+	}
+	for _, account := range smppConf.Accounts {
+		if account.SystemID == b.SystemID &&
+			subtle.ConstantTimeCompare([]byte(account.Password), []byte(b.Password)) == 1 {
+			s.account = account
+			s.bound = p.CommandID
+			smppSessions.Lock()
+			smppSessions.bySystemID[account.SystemID] = append(smppSessions.bySystemID[account.SystemID], s)
+			smppSessions.Unlock()
+			log.Printf("bind: %s bound from %s", b.SystemID, s.conn.RemoteAddr())
+			err = s.conn.Respond(p, smpp.StatusOK, smpp.EncodeCString(smppConf.SystemID))
+			if err == nil && s.receives() {
+				go s.deliverer()
+			}
+			return err
+		}
+	}
+	log.Printf("bind: invalid credentials of %#v from %s", b.SystemID, s.conn.RemoteAddr())
+	return s.conn.Respond(p, smpp.StatusBindFailed, nil)
+}
+
+// smppCallback records the receipts requested for a message submitted over
+// SMPP
+type smppCallback struct {
+	RegisteredDelivery byte `json:"registered_delivery"`
+}
+
+// submit queues a submit_sm like sendSMSHandler does and answers with the
+// uuid of the message as message_id.
+func (s *smppSession) submit(p *smpp.PDU) error {
+	if !s.transmits() {
+		return s.conn.Respond(p, smpp.StatusInvalidBindSts, nil)
+	}
+	m, err := smpp.DecodeShortMessage(p.Body)
+	if err != nil {
+		log.Printf("submit: %s", err.Error())
+		return s.conn.Respond(p, smpp.StatusInvalidCmdLen, nil)
+	}
+	if m.ESMClass&smpp.ESMClassUDHI != 0 {
+		// concatenated parts are not joined
+		return s.conn.Respond(p, smpp.StatusInvalidESM, nil)
+	}
+	text, err := smpp.DecodeText(m.DataCoding, m.Message)
+	if err != nil {
+		log.Printf("submit: %s", err.Error())
+		return s.conn.Respond(p, smpp.StatusSubmitFailed, nil)
+	}
+	if text == "" {
+		return s.conn.Respond(p, smpp.StatusInvalidMsgLen, nil)
+	}
+	mobile := m.Dest
+	if m.DestTON == smpp.TONInternational && !strings.HasPrefix(mobile, "+") {
+		mobile = "+" + mobile
+	}
+	mobile = common.NormalizeNumber(mobile)
+	client := s.account.SystemID
+	err = checkDestination(client, mobile)
+	if err != nil {
+		log.Printf("submit: %s %s", client, err.Error())
+		countRejected(client)
+		return s.conn.Respond(p, smpp.StatusInvalidDstAddr, nil)
+	}
+	optedOut, err := suppressed(mobile)
+	if err != nil {
+		log.Println(err)
+		return s.conn.Respond(p, smpp.StatusSysErr, nil)
+	}
+	if optedOut {
+		log.Printf("submit: %s has opted out", mobile)
+		return s.conn.Respond(p, smpp.StatusInvalidDstAddr, nil)
+	}
+	sms := &common.SMS{
+		UUID:     uuid.NewV1().String(),
+		Mobile:   mobile,
+		Body:     text,
+		Status:   "pending",
+		Client:   client,
+		Priority: common.PriorityNormal}
+	if m.PriorityFlag >= 2 {
+		sms.Priority = common.PriorityHigh
+	}
+	if m.RegisteredDelivery&0x03 != 0 {
+		sms.Callback, _ = json.Marshal(smppCallback{RegisteredDelivery: m.RegisteredDelivery & 0x03})
+	}
+	err = db.InsertMessage(sms)
+	if err != nil {
+		log.Println(err)
+		return s.conn.Respond(p, smpp.StatusSysErr, nil)
+	}
+	return s.conn.Respond(p, smpp.StatusOK, smpp.EncodeCString(sms.UUID))
+}
+
+// smppAddress returns the address and type of number of a normalized one.
+func smppAddress(number string) (string, byte) {
+	if strings.HasPrefix(number, "+") {
+		return number[1:], smpp.TONInternational
+	}
+	return number, 0
+}
+
+// deliverInbound passes a received message to the accounts receiving them.
+func deliverInbound(msg common.Inbound) {
+	for _, account := range smppConf.Accounts {
+		if !account.Inbound {
+			continue
+		}
+		m := &smpp.ShortMessage{}
+		m.Source, m.SourceTON = smppAddress(msg.Sender)
+		m.DataCoding, m.Message = smpp.EncodeText(msg.Body)
+		queueDelivery(account.SystemID, msg.UUID, m.Encode())
+	}
+}
+
+// receiptStates maps final events to the stat and message_state of receipts
+var receiptStates = map[string]struct {
+	stat  string
+	state byte
+}{
+	common.EventDelivered:   {"DELIVRD", smpp.StateDelivered},
+	common.EventUndelivered: {"UNDELIV", smpp.StateUndeliverable},
+	common.EventError:       {"UNDELIV", smpp.StateUndeliverable},
+	common.EventSuppressed:  {"REJECTD", smpp.StateRejected},
+}
+
+// deliverReceipt sends a delivery receipt of a message submitted with
+// registered_delivery once its status is final.
+func deliverReceipt(sms common.SMS, event common.Event) {
+	state, ok := receiptStates[event.Event]
+	if !ok || !common.IsFinal(sms, event.Event) {
+		return
+	}
+	var callback smppCallback
+	json.Unmarshal(sms.Callback, &callback)
+	// 1 asks for any final receipt, 2 for failures only
+	if callback.RegisteredDelivery == 0 || (callback.RegisteredDelivery == 2 && state.state == smpp.StateDelivered) {
+		return
+	}
+	receipt := &smpp.Receipt{
+		ID:        sms.UUID,
+		Submitted: sms.CreatedAt,
+		Done:      event.Time,
+		Stat:      state.stat,
+		Text:      sms.Body}
+	m := &smpp.ShortMessage{
+		ESMClass: smpp.ESMClassReceipt,
+		TLVs: map[uint16][]byte{
+			smpp.TagReceiptedMessageID: smpp.EncodeCString(sms.UUID),
+			smpp.TagMessageState:       {state.state},
+		}}
+	m.Source, m.SourceTON = smppAddress(sms.Mobile)
+	m.DataCoding, m.Message = smpp.EncodeText(receipt.String())
+	queueDelivery(sms.Client, sms.UUID, m.Encode())
+}
+
+// queueDelivery stores a deliver_sm until a receiver of systemID
+// acknowledges it, the hooks of the worker must not wait for the client.
+func queueDelivery(systemID string, uuid string, body []byte) {
+	err := db.InsertSMPPDelivery(&database.SMPPDelivery{SystemID: systemID, UUID: uuid, Body: body})
+	if err != nil {
+		log.Printf("queueDelivery: %s for %s %s", uuid, systemID, err.Error())
+		return
+	}
+	wakeReceivers(systemID)
+}
+
+// deliverer sends the queued deliveries of a receiving session until it
+// closes. They are sent one at a time and deleted once acknowledged.
+func (s *smppSession) deliverer() {
+	ticker := time.NewTicker(smppRetryDelay)
+	defer ticker.Stop()
+	for s.deliverPending() {
+		select {
+		case <-s.wakeup:
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// deliverPending sends deliveries until there are none left or one fails,
+// and returns false when the session should end.
+func (s *smppSession) deliverPending() bool {
+	for {
+		d, ok := s.claimDelivery()
+		if !ok {
+			return true
+		}
+		err := s.deliver(d)
+		if _, rejected := err.(*smpp.StatusError); rejected {
+			d.Attempts++
+			if d.Attempts < common.MaxAttempts {
+				log.Printf("deliverPending: %s attempt %d of %s failed. %s", d.SystemID, d.Attempts, d.UUID,
+					err.Error())
+				err = db.UpdateSMPPDeliveryAttempts(d.ID, d.Attempts)
+				if err != nil {
+					log.Printf("deliverPending: %s", err.Error())
+				}
+				releaseDelivery(d)
+				return true
+			}
+			log.Printf("deliverPending: %s dropped %s. %s", d.SystemID, d.UUID, err.Error())
+		} else if err != nil {
+			log.Printf("deliverPending: %s %s %s", d.SystemID, s.conn.RemoteAddr(), err.Error())
+			releaseDelivery(d)
+			s.conn.Close()
+			return false
+		}
+		err = db.DeleteSMPPDelivery(d.ID)
+		releaseDelivery(d)
+		if err != nil {
+			log.Printf("deliverPending: %s", err.Error())
+			return true
+		}
+	}
+}
+
+// claimDelivery returns the oldest delivery of the session not being sent by
+// another one. The claim is held until releaseDelivery, which follows the
+// delete of a delivered one, so a session never reads a delivered one as
+// unclaimed.
+func (s *smppSession) claimDelivery() (database.SMPPDelivery, bool) {
+	smppClaims.Lock()
+	defer smppClaims.Unlock()
+	deliveries, err := db.GetSMPPDeliveries(s.account.SystemID, len(smppClaims.byID)+1)
+	if err != nil {
+		log.Printf("claimDelivery: %s", err.Error())
+		return database.SMPPDelivery{}, false
+	}
+	for _, d := range deliveries {
+		if !smppClaims.byID[d.ID] {
+			smppClaims.byID[d.ID] = true
+			return d, true
+		}
+	}
+	return database.SMPPDelivery{}, false
+}
+
+func releaseDelivery(d database.SMPPDelivery) {
+	smppClaims.Lock()
+	delete(smppClaims.byID, d.ID)
+	smppClaims.Unlock()
+}
+
+// deliver sends a deliver_sm and waits for the client to answer it.
+func (s *smppSession) deliver(d database.SMPPDelivery) error {
+	sequence, err := s.conn.Request(smpp.DeliverSM, d.Body)
+	if err != nil {
+		return err
+	}
+	timer := time.NewTimer(smppResponseTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case p := <-s.responses:
+			if p.Sequence != sequence {
+				// a late answer to a timed out request
+				continue
+			}
+			if p.Status != smpp.StatusOK {
+				return &smpp.StatusError{CommandID: smpp.DeliverSM, Status: p.Status}
+			}
+			return nil
+		case <-timer.C:
+			return fmt.Errorf("no response to deliver_sm within %s", smppResponseTimeout)
+		case <-s.done:
+			return smpp.ErrNotBound
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+	"github.com/alexgear/sms/smpp"
+)
+
+// smppRequest sends a request and returns its response.
+func smppRequest(t *testing.T, c *smpp.Conn, commandID uint32, body []byte) *smpp.PDU {
+	sequence, err := c.Request(commandID, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := readPDU(t, c)
+	if p.CommandID != commandID|smpp.GenericNack || p.Sequence != sequence {
+		t.Fatalf("Expected the response to %d, got %s", sequence, p)
+	}
+	return p
+}
+
+func readPDU(t *testing.T, c *smpp.Conn) *smpp.PDU {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := c.ReadPDU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSMPP(t *testing.T) {
+	_, cleanup := initTestServer(t)
+	defer cleanup()
+	smppConf = config.SMPPConfig{SystemID: "sms", IdleTimeout: 60,
+		Accounts: []config.SMPPAccount{{SystemID: "billing", Password: "secret", Inbound: true}}}
+	globalDestinations = config.DestinationConfig{Deny: []string{"+380900"}}
+	defer func() { globalDestinations = config.DestinationConfig{} }()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	smppRetryDelay = 100 * time.Millisecond
+	defer func() { smppRetryDelay = 10 * time.Second }()
+	go serveSMPP(listener)
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := smpp.NewConn(conn)
+	defer c.Close()
+
+	bind := &smpp.Bind{SystemID: "billing", Password: "wrong", InterfaceVersion: 0x34}
+	if p := smppRequest(t, c, smpp.BindTransceiver, bind.Encode()); p.Status != smpp.StatusBindFailed {
+		t.Fatalf("Expected a wrong password to fail, got %s", p)
+	}
+	m := &smpp.ShortMessage{Dest: "380631234567", DestTON: smpp.TONInternational, RegisteredDelivery: 1}
+	m.DataCoding, m.Message = smpp.EncodeText("привіт")
+	if p := smppRequest(t, c, smpp.SubmitSM, m.Encode()); p.Status != smpp.StatusInvalidBindSts {
+		t.Fatalf("Expected submit_sm to require a bind, got %s", p)
+	}
+	deliverInbound(common.Inbound{UUID: "early", Sender: "+380501112233", Body: "early"})
+	bind.Password = "secret"
+	p := smppRequest(t, c, smpp.BindTransceiver, bind.Encode())
+	if systemID, _ := smpp.DecodeCString(p.Body); p.Status != smpp.StatusOK || systemID != "sms" {
+		t.Fatalf("Expected to bind, got %s %q", p, systemID)
+	}
+
+	// deliveries wait for a receiver, rejected ones are retried
+	p = readPDU(t, c)
+	if early, err := smpp.DecodeShortMessage(p.Body); err != nil || string(early.Message) != "early" {
+		t.Fatalf("Expected the message received before the bind, got %s", p)
+	}
+	c.Respond(p, smpp.StatusSysErr, nil)
+	p = readPDU(t, c)
+	if early, err := smpp.DecodeShortMessage(p.Body); err != nil || string(early.Message) != "early" {
+		t.Fatalf("Expected the rejected message again, got %s", p)
+	}
+	c.Respond(p, smpp.StatusOK, smpp.EncodeCString(""))
+
+	p = smppRequest(t, c, smpp.SubmitSM, m.Encode())
+	messageID, _ := smpp.DecodeCString(p.Body)
+	if p.Status != smpp.StatusOK {
+		t.Fatalf("Expected submit_sm to succeed, got %s", p)
+	}
+	sms, err := db.GetMessageByUuid(messageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the requested receipt is not part of the metadata of the client
+	if sms.Mobile != "+380631234567" || sms.Body != "привіт" || sms.Client != "billing" || sms.Status != "pending" ||
+		string(sms.Metadata) != "{}" {
+		t.Fatalf("Expected the message to be queued, got %#v", sms)
+	}
+	denied := &smpp.ShortMessage{Dest: "380900123456", DestTON: smpp.TONInternational, Message: []byte("test")}
+	if p := smppRequest(t, c, smpp.SubmitSM, denied.Encode()); p.Status != smpp.StatusInvalidDstAddr {
+		t.Fatalf("Expected a denied destination to be rejected, got %s", p)
+	}
+
+	deliverInbound(common.Inbound{UUID: "inbound", Sender: "+380501112233", Body: "hello"})
+	p = readPDU(t, c)
+	inbound, err := smpp.DecodeShortMessage(p.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.CommandID != smpp.DeliverSM || inbound.Source != "380501112233" || string(inbound.Message) != "hello" {
+		t.Fatalf("Expected the received message, got %s %#v", p, inbound)
+	}
+	c.Respond(p, smpp.StatusOK, smpp.EncodeCString(""))
+
+	// retried errors are not final
+	deliverReceipt(sms, common.Event{Event: common.EventError, Time: time.Now()})
+	deliverReceipt(sms, common.Event{Event: common.EventDelivered, Time: time.Now()})
+	p = readPDU(t, c)
+	receipt, err := smpp.DecodeShortMessage(p.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := smpp.DecodeCString(receipt.TLVs[smpp.TagReceiptedMessageID])
+	text, _ := smpp.DecodeText(receipt.DataCoding, receipt.Message)
+	if receipt.ESMClass != smpp.ESMClassReceipt || id != messageID || !strings.Contains(text, "stat:DELIVRD") ||
+		!strings.HasPrefix(text, "id:"+messageID) {
+		t.Fatalf("Expected a delivery receipt, got %#v %q", receipt, text)
+	}
+	c.Respond(p, smpp.StatusOK, smpp.EncodeCString(""))
+
+	if p := smppRequest(t, c, smpp.EnquireLink, nil); p.Status != smpp.StatusOK {
+		t.Fatalf("Expected enquire_link to succeed, got %s", p)
+	}
+	if p := smppRequest(t, c, smpp.Unbind, nil); p.Status != smpp.StatusOK {
+		t.Fatalf("Expected unbind to succeed, got %s", p)
+	}
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/database"
+	"github.com/gorilla/mux"
+)
+
+type SuppressionsResponse struct {
+	Suppressions []common.Suppression `json:"suppressions"`
+}
+
+// suppressed reports whether number opted out of receiving messages.
+func suppressed(number string) (bool, error) {
+	_, err := db.GetSuppression(number)
+	if err == database.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rejectSuppressed answers 403 and returns true if number opted out.
+func rejectSuppressed(w http.ResponseWriter, number string) bool {
+	optedOut, err := suppressed(number)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	if optedOut {
+		http.Error(w, fmt.Sprintf("Number %s has opted out", number), http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+func listSuppressionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	suppressions, err := db.ListSuppressions()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := SuppressionsResponse{Suppressions: suppressions}
+	if response.Suppressions == nil {
+		response.Suppressions = []common.Suppression{}
+	}
+	writeJSON(w, response)
+	return
+}
+
+func getSuppressionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	number := common.NormalizeNumber(mux.Vars(r)["number"])
+	suppression, err := db.GetSuppression(number)
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Number %s is not suppressed", number), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, suppression)
+	return
+}
+
+// createSuppressionHandler suppresses number, given as a form or a JSON
+// object with an optional detail.
+func createSuppressionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	suppression := &common.Suppression{}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "application/json" {
+		err := json.NewDecoder(r.Body).Decode(suppression)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid JSON: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	} else {
+		suppression.Number = r.FormValue("number")
+		suppression.Detail = r.FormValue("detail")
+	}
+	if suppression.Number == "" {
+		http.Error(w, "number is required", http.StatusBadRequest)
+		return
+	}
+	suppression.Number = common.NormalizeNumber(suppression.Number)
+	suppression.Source = "api"
+	if name := client(r); name != "" && suppression.Detail == "" {
+		suppression.Detail = "added by " + name
+	}
+	err := db.InsertSuppression(suppression)
+	if err == database.ErrExists {
+		http.Error(w, fmt.Sprintf("Number %s is already suppressed", suppression.Number), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, suppression)
+	return
+}
+
+func deleteSuppressionHandler(w http.ResponseWriter, r *http.Request) {
+	number := common.NormalizeNumber(mux.Vars(r)["number"])
+	err := db.DeleteSuppression(number)
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Number %s is not suppressed", number), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
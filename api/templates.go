@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/database"
+	"github.com/gorilla/mux"
+)
+
+type TemplatesResponse struct {
+	Templates []common.Template `json:"templates"`
+}
+
+// decodeTemplate reads a template from a JSON body. The default locale may
+// be omitted for a template with a single variant.
+func decodeTemplate(w http.ResponseWriter, r *http.Request) (*common.Template, bool) {
+	t := &common.Template{}
+	err := json.NewDecoder(r.Body).Decode(t)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %s", err.Error()), http.StatusBadRequest)
+		return nil, false
+	}
+	if t.DefaultLocale == "" && len(t.Variants) == 1 {
+		for locale := range t.Variants {
+			t.DefaultLocale = locale
+		}
+	}
+	if id, ok := mux.Vars(r)["id"]; ok {
+		t.ID = id
+	}
+	err = t.Validate()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid template: %s", err.Error()), http.StatusBadRequest)
+		return nil, false
+	}
+	return t, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	toWrite, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(toWrite)
+}
+
+func listTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	templates, err := db.ListTemplates()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := TemplatesResponse{Templates: templates}
+	if response.Templates == nil {
+		response.Templates = []common.Template{}
+	}
+	toWrite, err := json.Marshal(response)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(toWrite)
+	return
+}
+
+func createTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	t, ok := decodeTemplate(w, r)
+	if !ok {
+		return
+	}
+	err := db.InsertTemplate(t)
+	if err == database.ErrExists {
+		http.Error(w, fmt.Sprintf("Template %s already exists", t.ID), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, t)
+	return
+}
+
+func getTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	id := mux.Vars(r)["id"]
+	t, err := db.GetTemplate(id)
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Template %s not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, &t)
+	return
+}
+
+// updateTemplateHandler replaces the default locale and all variants.
+func updateTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	t, ok := decodeTemplate(w, r)
+	if !ok {
+		return
+	}
+	err := db.UpdateTemplate(t)
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Template %s not found", t.ID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, t)
+	return
+}
+
+func deleteTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	err := db.DeleteTemplate(id)
+	if err == database.ErrNotFound {
+		http.Error(w, fmt.Sprintf("Template %s not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
@@ -0,0 +1,392 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+	"github.com/alexgear/sms/database"
+	"github.com/alexgear/sms/worker"
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+)
+
+var twilioConf config.TwilioConfig
+
+// twilioAPIVersion is the only version of the REST API emulated
+const twilioAPIVersion = "2010-04-01"
+
+// twilioMaxBody is the longest body Twilio accepts, in characters
+const twilioMaxBody = 1600
+
+// twilioTime is the format of dates in Twilio's JSON
+const twilioTime = "Mon, 02 Jan 2006 15:04:05 -0700"
+
+// Twilio error codes
+const (
+	twilioAuthFailed       = 20003
+	twilioNotFound         = 20404
+	twilioInvalidParameter = 21200
+	twilioInvalidTo        = 21211
+	twilioPermission       = 21408
+	twilioBodyRequired     = 21602
+	twilioToRequired       = 21604
+	twilioUnsubscribed     = 21610
+	twilioBodyTooLong      = 21617
+	twilioUnreachable      = 30003
+	twilioUnknownError     = 30008
+)
+
+var twilioErrorMessages = map[int]string{
+	twilioUnsubscribed: "Attempt to send to unsubscribed recipient",
+	twilioUnreachable:  "Unreachable destination handset",
+	twilioUnknownError: "Unknown error",
+}
+
+// twilioMessage is the Message resource of Twilio's REST API.
+type twilioMessage struct {
+	AccountSID          string            `json:"account_sid"`
+	APIVersion          string            `json:"api_version"`
+	Body                string            `json:"body"`
+	DateCreated         string            `json:"date_created"`
+	DateSent            *string           `json:"date_sent"`
+	DateUpdated         string            `json:"date_updated"`
+	Direction           string            `json:"direction"`
+	ErrorCode           *int              `json:"error_code"`
+	ErrorMessage        *string           `json:"error_message"`
+	From                string            `json:"from"`
+	MessagingServiceSID *string           `json:"messaging_service_sid"`
+	NumMedia            string            `json:"num_media"`
+	NumSegments         string            `json:"num_segments"`
+	Price               *string           `json:"price"`
+	PriceUnit           string            `json:"price_unit"`
+	SID                 string            `json:"sid"`
+	Status              string            `json:"status"`
+	SubresourceURIs     map[string]string `json:"subresource_uris"`
+	To                  string            `json:"to"`
+	URI                 string            `json:"uri"`
+}
+
+// twilioError is the body of failed requests.
+type twilioError struct {
+	Code     int    `json:"code"`
+	Message  string `json:"message"`
+	MoreInfo string `json:"more_info"`
+	Status   int    `json:"status"`
+}
+
+// twilioCallback records the parameters of a message sent through the
+// Twilio API which are not stored otherwise
+type twilioCallback struct {
+	From           string `json:"from,omitempty"`
+	StatusCallback string `json:"status_callback,omitempty"`
+}
+
+// InitTwilio enables the Twilio API if configured. It is called before the
+// worker starts, so that the hook calling status callbacks is in place.
+func InitTwilio(conf config.TwilioConfig) {
+	twilioConf = conf
+	if conf.Enabled {
+		worker.OnStatus(twilioStatusCallback)
+	}
+}
+
+// twilioSID returns the message SID of a uuid, SM and its 32 hex digits.
+func twilioSID(id string) string {
+	return "SM" + strings.Replace(id, "-", "", -1)
+}
+
+// twilioUUID returns the uuid of a message SID, false if it is invalid.
+func twilioUUID(sid string) (string, bool) {
+	digits := strings.TrimPrefix(sid, "SM")
+	if len(digits) != 32 || len(sid) != 34 {
+		return "", false
+	}
+	_, err := hex.DecodeString(digits)
+	if err != nil {
+		return "", false
+	}
+	return strings.ToLower(digits[:8] + "-" + digits[8:12] + "-" + digits[12:16] + "-" + digits[16:20] + "-" +
+		digits[20:]), true
+}
+
+// twilioStatus returns the Twilio status of a message and its error code, 0
+// if there is none.
+func twilioStatus(sms common.SMS) (string, int) {
+	switch sms.Status {
+	case "sent":
+		return "sent", 0
+	case common.EventDelivered:
+		return "delivered", 0
+	case common.EventUndelivered:
+		return "undelivered", twilioUnreachable
+	case common.EventSuppressed:
+		return "failed", twilioUnsubscribed
+	case common.EventError:
+		if !common.IsFinal(sms, sms.Status) {
+			return "queued", 0
+		}
+		return "failed", twilioUnknownError
+	}
+	return "queued", 0
+}
+
+func newTwilioMessage(sms common.SMS) twilioMessage {
+	var callback twilioCallback
+	json.Unmarshal(sms.Callback, &callback)
+	sid := twilioSID(sms.UUID)
+	uri := fmt.Sprintf("/%s/Accounts/%s/Messages/%s", twilioAPIVersion, sms.Client, sid)
+	m := twilioMessage{
+		AccountSID:      sms.Client,
+		APIVersion:      twilioAPIVersion,
+		Body:            sms.Body,
+		DateCreated:     sms.CreatedAt.UTC().Format(twilioTime),
+		DateUpdated:     sms.CreatedAt.UTC().Format(twilioTime),
+		Direction:       "outbound-api",
+		From:            callback.From,
+		NumMedia:        "0",
+		NumSegments:     strconv.Itoa(common.Segments(sms.Body)),
+		PriceUnit:       "USD",
+		SID:             sid,
+		SubresourceURIs: map[string]string{"media": uri + "/Media.json"},
+		To:              sms.Mobile,
+		URI:             uri + ".json"}
+	if sms.UpdatedAt != nil {
+		m.DateUpdated = sms.UpdatedAt.UTC().Format(twilioTime)
+	}
+	var code int
+	m.Status, code = twilioStatus(sms)
+	if m.Status != "queued" && m.Status != "failed" {
+		m.DateSent = &m.DateUpdated
+	}
+	if code != 0 {
+		message := twilioErrorMessages[code]
+		m.ErrorCode, m.ErrorMessage = &code, &message
+	}
+	return m
+}
+
+func writeTwilioJSON(w http.ResponseWriter, status int, v interface{}) {
+	toWrite, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(toWrite)
+}
+
+func twilioFail(w http.ResponseWriter, status int, code int, message string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Twilio API"`)
+	}
+	writeTwilioJSON(w, status, twilioError{
+		Code:     code,
+		Message:  message,
+		MoreInfo: fmt.Sprintf("https://www.twilio.com/docs/errors/%d", code),
+		Status:   status})
+}
+
+// twilioAuthenticate checks the basic auth of r against the account of the
+// path and returns the account, false after answering 401.
+func twilioAuthenticate(w http.ResponseWriter, r *http.Request) (config.TwilioAccount, bool) {
+	sid, token, _ := r.BasicAuth()
+	if sid == mux.Vars(r)["sid"] {
+		for _, account := range twilioConf.Accounts {
+			if account.AccountSID == sid &&
+				subtle.ConstantTimeCompare([]byte(account.AuthToken), []byte(token)) == 1 {
+				return account, true
+			}
+		}
+	}
+	log.Printf("twilioAuthenticate: invalid credentials of %#v", sid)
+	twilioFail(w, http.StatusUnauthorized, twilioAuthFailed, "Authenticate")
+	return config.TwilioAccount{}, false
+}
+
+// twilioCreateMessageHandler queues a message like Twilio's Create a Message.
+func twilioCreateMessageHandler(w http.ResponseWriter, r *http.Request) {
+	account, ok := twilioAuthenticate(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		twilioFail(w, http.StatusBadRequest, twilioInvalidParameter, err.Error())
+		return
+	}
+	to, body := r.PostFormValue("To"), r.PostFormValue("Body")
+	if to == "" {
+		twilioFail(w, http.StatusBadRequest, twilioToRequired, "A 'To' phone number is required.")
+		return
+	}
+	if body == "" {
+		twilioFail(w, http.StatusBadRequest, twilioBodyRequired, "Message body is required.")
+		return
+	}
+	if utf8.RuneCountInString(body) > twilioMaxBody {
+		twilioFail(w, http.StatusBadRequest, twilioBodyTooLong,
+			fmt.Sprintf("The concatenated message body exceeds the %d character limit.", twilioMaxBody))
+		return
+	}
+	callback := r.PostFormValue("StatusCallback")
+	if callback != "" {
+		u, err := url.Parse(callback)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			twilioFail(w, http.StatusBadRequest, twilioInvalidParameter,
+				fmt.Sprintf("The StatusCallback URL %s is not a valid URL.", callback))
+			return
+		}
+	}
+	mobile := common.NormalizeNumber(to)
+	if !strings.HasPrefix(mobile, "+") {
+		twilioFail(w, http.StatusBadRequest, twilioInvalidTo,
+			fmt.Sprintf("The 'To' number %s is not a valid phone number.", to))
+		return
+	}
+	client := account.AccountSID
+	err = checkDestination(client, mobile)
+	if err != nil {
+		log.Printf("twilioCreateMessageHandler: %s %s", client, err.Error())
+		countRejected(client)
+		twilioFail(w, http.StatusBadRequest, twilioPermission, fmt.Sprintf(
+			"Permission to send an SMS has not been enabled for the region indicated by the 'To' number: %s.", to))
+		return
+	}
+	optedOut, err := suppressed(mobile)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if optedOut {
+		twilioFail(w, http.StatusBadRequest, twilioUnsubscribed, twilioErrorMessages[twilioUnsubscribed])
+		return
+	}
+	sms := &common.SMS{
+		UUID:     uuid.NewV1().String(),
+		Mobile:   mobile,
+		Body:     body,
+		Status:   "pending",
+		Client:   client,
+		Priority: common.PriorityNormal}
+	state := twilioCallback{From: r.PostFormValue("From"), StatusCallback: callback}
+	if state != (twilioCallback{}) {
+		sms.Callback, _ = json.Marshal(state)
+	}
+	err = db.InsertMessage(sms)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("twilioCreateMessageHandler: %s queued %s", client, sms.UUID)
+	writeTwilioJSON(w, http.StatusCreated, newTwilioMessage(*sms))
+}
+
+// twilioGetMessageHandler returns a message of the account like Twilio's
+// Fetch a Message.
+func twilioGetMessageHandler(w http.ResponseWriter, r *http.Request) {
+	account, ok := twilioAuthenticate(w, r)
+	if !ok {
+		return
+	}
+	sid := mux.Vars(r)["message"]
+	notFound := fmt.Sprintf("The requested resource /%s/Accounts/%s/Messages/%s.json was not found",
+		twilioAPIVersion, account.AccountSID, sid)
+	id, ok := twilioUUID(sid)
+	if !ok {
+		twilioFail(w, http.StatusNotFound, twilioNotFound, notFound)
+		return
+	}
+	sms, err := db.GetMessageByUuid(id)
+	if err == database.ErrNotFound || (err == nil && sms.Client != account.AccountSID) {
+		twilioFail(w, http.StatusNotFound, twilioNotFound, notFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTwilioJSON(w, http.StatusOK, newTwilioMessage(sms))
+}
+
+// twilioSignature returns the X-Twilio-Signature of a request to rawURL
+// with form, signed with token.
+func twilioSignature(token string, rawURL string, form url.Values) string {
+	var names []string
+	for name := range form {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	data := rawURL
+	for _, name := range names {
+		data += name + form.Get(name)
+	}
+	mac := hmac.New(sha1.New, []byte(token))
+	mac.Write([]byte(data))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// twilioStatusCallback posts the new status of a message to its
+// StatusCallback, signed like Twilio does.
+func twilioStatusCallback(sms common.SMS, event common.Event) {
+	var callback twilioCallback
+	json.Unmarshal(sms.Callback, &callback)
+	if callback.StatusCallback == "" {
+		return
+	}
+	status, code := twilioStatus(sms)
+	if status == "queued" {
+		// a failed attempt which is retried
+		return
+	}
+	var token string
+	for _, account := range twilioConf.Accounts {
+		if account.AccountSID == sms.Client {
+			token = account.AuthToken
+		}
+	}
+	if token == "" {
+		log.Printf("twilioStatusCallback: unknown account %s of %s", sms.Client, sms.UUID)
+		return
+	}
+	sid := twilioSID(sms.UUID)
+	form := url.Values{
+		"AccountSid":    {sms.Client},
+		"ApiVersion":    {twilioAPIVersion},
+		"From":          {callback.From},
+		"MessageSid":    {sid},
+		"MessageStatus": {status},
+		"SmsSid":        {sid},
+		"SmsStatus":     {status},
+		"To":            {sms.Mobile}}
+	if code != 0 {
+		form.Set("ErrorCode", strconv.Itoa(code))
+	}
+	req, err := http.NewRequest("POST", callback.StatusCallback, strings.NewReader(form.Encode()))
+	if err != nil {
+		log.Printf("twilioStatusCallback: %s %s", sms.UUID, err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Twilio-Signature", twilioSignature(token, callback.StatusCallback, form))
+	if !queueCallback(req) {
+		log.Printf("twilioStatusCallback: dropped %s of %s, the callbacks are too slow", status, sms.UUID)
+	}
+}
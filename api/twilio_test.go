@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+)
+
+const testAccountSID = "AC00000000000000000000000000000001"
+
+func twilioRequest(t *testing.T, method string, rawURL string, token string, form url.Values) (*http.Response, map[string]interface{}) {
+	req, err := http.NewRequest(method, rawURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(testAccountSID, token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestTwilio(t *testing.T) {
+	twilioConf = config.TwilioConfig{Enabled: true,
+		Accounts: []config.TwilioAccount{{AccountSID: testAccountSID, AuthToken: "secret"}}}
+	defer func() { twilioConf = config.TwilioConfig{} }()
+	server, cleanup := initTestServer(t)
+	defer cleanup()
+	messages := server.URL + "/2010-04-01/Accounts/" + testAccountSID + "/Messages"
+
+	resp, body := twilioRequest(t, "POST", messages+".json", "wrong",
+		url.Values{"To": {"+380631234567"}, "Body": {"test"}})
+	if resp.StatusCode != http.StatusUnauthorized || body["code"] != float64(20003) {
+		t.Fatalf("Expected 401 with code 20003, got %d %v", resp.StatusCode, body)
+	}
+	resp, body = twilioRequest(t, "POST", messages+".json", "secret", url.Values{"Body": {"test"}})
+	if resp.StatusCode != http.StatusBadRequest || body["code"] != float64(21604) {
+		t.Fatalf("Expected 400 with code 21604, got %d %v", resp.StatusCode, body)
+	}
+	resp, body = twilioRequest(t, "POST", messages+".json", "secret", url.Values{"To": {"+380631234567"},
+		"From": {"+15005550006"}, "Body": {"test"}, "StatusCallback": {"http://example.com/status"}})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d %v", resp.StatusCode, body)
+	}
+	sid, _ := body["sid"].(string)
+	if !strings.HasPrefix(sid, "SM") || len(sid) != 34 || body["status"] != "queued" ||
+		body["to"] != "+380631234567" || body["from"] != "+15005550006" || body["account_sid"] != testAccountSID ||
+		body["error_code"] != nil || body["uri"] != "/2010-04-01/Accounts/"+testAccountSID+"/Messages/"+sid+".json" {
+		t.Fatalf("Unexpected message %v", body)
+	}
+
+	id, _ := twilioUUID(sid)
+	sms, err := db.GetMessageByUuid(id)
+	if err != nil || sms.Client != testAccountSID || string(sms.Metadata) != "{}" {
+		t.Fatalf("Expected the message of the account, got %#v %v", sms, err)
+	}
+	resp, body = twilioRequest(t, "GET", messages+"/"+sid+".json", "secret", nil)
+	if body["from"] != "+15005550006" {
+		t.Fatalf("Expected From to be kept, got %v", body)
+	}
+	sms.Status = common.EventSuppressed
+	db.UpdateMessageStatus(sms)
+	resp, body = twilioRequest(t, "GET", messages+"/"+sid+".json", "secret", nil)
+	if resp.StatusCode != http.StatusOK || body["sid"] != sid || body["status"] != "failed" ||
+		body["error_code"] != float64(21610) {
+		t.Fatalf("Expected the failed message, got %d %v", resp.StatusCode, body)
+	}
+	resp, body = twilioRequest(t, "GET", messages+"/SM00000000000000000000000000000000.json", "secret", nil)
+	if resp.StatusCode != http.StatusNotFound || body["code"] != float64(20404) {
+		t.Fatalf("Expected 404 with code 20404, got %d %v", resp.StatusCode, body)
+	}
+}
+
+func TestTwilioStatusCallback(t *testing.T) {
+	twilioConf = config.TwilioConfig{Enabled: true,
+		Accounts: []config.TwilioAccount{{AccountSID: testAccountSID, AuthToken: "secret"}}}
+	defer func() { twilioConf = config.TwilioConfig{} }()
+	callbacks := make(chan *http.Request, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		callbacks <- r
+	}))
+	defer receiver.Close()
+
+	callback := receiver.URL + "/status?id=1"
+	encoded, _ := json.Marshal(twilioCallback{From: "+15005550006", StatusCallback: callback})
+	sms := common.SMS{UUID: "80000000-0000-0000-0000-000000000000", Mobile: "+380631234567",
+		Client: testAccountSID, Callback: encoded, Status: "error", Retries: 1}
+	// retried
+	twilioStatusCallback(sms, common.Event{Event: common.EventError})
+	sms.Status = common.EventDelivered
+	twilioStatusCallback(sms, common.Event{Event: common.EventDelivered})
+	select {
+	case r := <-callbacks:
+		if r.PostForm.Get("MessageStatus") != "delivered" ||
+			r.PostForm.Get("MessageSid") != "SM80000000000000000000000000000000" ||
+			r.PostForm.Get("From") != "+15005550006" {
+			t.Fatalf("Unexpected callback %v", r.PostForm)
+		}
+		if r.Header.Get("X-Twilio-Signature") != twilioSignature("secret", callback, r.PostForm) {
+			t.Fatalf("Invalid signature %s", r.Header.Get("X-Twilio-Signature"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a status callback")
+	}
+}
+
+// TestTwilioSignature checks the example of Twilio's webhook security docs.
+func TestTwilioSignature(t *testing.T) {
+	form := url.Values{"CallSid": {"CA1234567890ABCDE"}, "Caller": {"+14158675309"}, "Digits": {"1234"},
+		"From": {"+14158675309"}, "To": {"+18005551212"}}
+	signature := twilioSignature("12345", "https://mycompany.com/myapp.php?foo=1&bar=2", form)
+	if signature != "RSOYDt4T1cUTdK1PDd93/VVr8B8=" {
+		t.Fatalf("Unexpected signature %s", signature)
+	}
+}
@@ -1,9 +1,177 @@
 package common
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type SMS struct {
-	UUID    string `json:"uuid"`
-	Mobile  string `json:"mobile"`
-	Body    string `json:"body"`
-	Status  string `json:"status"`
-	Retries int    `json:"retries"`
+	UUID      string `json:"uuid"`
+	Mobile    string `json:"mobile"`
+	Body      string `json:"body"`
+	Status    string `json:"status"`
+	Retries   int    `json:"retries"`
+	Client    string `json:"client"`
+	Reference string `json:"reference"`
+	// ClientRef and Metadata are set by the client to correlate messages
+	// with its own records, Metadata is a JSON object
+	ClientRef string          `json:"client_ref"`
+	Metadata  json.RawMessage `json:"metadata"`
+	Priority  int             `json:"priority"`
+	DueAt     time.Time       `json:"due_at"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt *time.Time      `json:"updated_at"`
+
+	// QuietHours override the configured ones, QuietHoursOff disables them,
+	// TimeZone overrides the one derived from Mobile
+	QuietHours string `json:"quiet_hours"`
+	TimeZone   string `json:"time_zone"`
+
+	// Callback is the JSON encoded delivery report request of the API the
+	// message was submitted through, it is not returned to clients
+	Callback json.RawMessage `json:"-"`
+	// IgnoreSuppression sends the message even if the number opted out, like
+	// the confirmation of the opt-out
+	IgnoreSuppression bool `json:"-"`
+}
+
+// Priorities of messages, lower ones are sent first. The zero value is
+// normal.
+const (
+	PriorityHigh = iota - 1
+	PriorityNormal
+	PriorityBulk
+)
+
+// PriorityNames are the priorities used in the API
+var PriorityNames = map[int]string{
+	PriorityHigh:   "high",
+	PriorityNormal: "normal",
+	PriorityBulk:   "bulk",
+}
+
+// ParsePriority returns the priority named name, normal if it is empty.
+func ParsePriority(name string) (int, bool) {
+	if name == "" {
+		return PriorityNormal, true
+	}
+	for priority, n := range PriorityNames {
+		if n == name {
+			return priority, true
+		}
+	}
+	return 0, false
+}
+
+// Inbound is a message received by the modem.
+type Inbound struct {
+	UUID       string     `json:"uuid"`
+	Sender     string     `json:"sender"`
+	Body       string     `json:"body"`
+	ReceivedAt time.Time  `json:"received_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ReadAt     *time.Time `json:"read_at"`
+	Tags       []string   `json:"tags"`
+}
+
+// Conversation summarizes the messages exchanged with a number.
+type Conversation struct {
+	Number       string    `json:"number"`
+	LastActivity time.Time `json:"last_activity"`
+	Unread       int       `json:"unread"`
+}
+
+type Balance struct {
+	Amount   float64   `json:"amount"`
+	Currency string    `json:"currency"`
+	Raw      string    `json:"raw"`
+	Time     time.Time `json:"time"`
+}
+
+type SpendEstimate struct {
+	CostPerMessage float64  `json:"cost_per_message"`
+	MessagesPerDay float64  `json:"messages_per_day"`
+	DaysLeft       *float64 `json:"days_left"`
+}
+
+// ThrottleState shows how many messages the modem sent within each limited
+// window. A zero limit is unlimited.
+type ThrottleState struct {
+	PerMinute  int       `json:"per_minute"`
+	PerHour    int       `json:"per_hour"`
+	PerDay     int       `json:"per_day"`
+	LastMinute int       `json:"last_minute"`
+	LastHour   int       `json:"last_hour"`
+	LastDay    int       `json:"last_day"`
+	NextSendAt time.Time `json:"next_send_at"`
+	Throttled  bool      `json:"throttled"`
+}
+
+const (
+	EventQueued    = "queued"
+	EventClaimed   = "claimed"
+	EventAttempt   = "attempt"
+	EventError     = "error"
+	EventSent      = "sent"
+	EventDelivered = "delivered"
+	// EventUndelivered is a status report of a failed delivery
+	EventUndelivered = "undelivered"
+	// EventSuppressed is a message not sent because the recipient opted out
+	EventSuppressed = "suppressed"
+	// EventDeferred is a message postponed until the quiet hours end
+	EventDeferred = "deferred"
+)
+
+// Event is a step in the life of a message.
+type Event struct {
+	Event     string    `json:"event"`
+	Attempt   int       `json:"attempt,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	Code      string    `json:"code,omitempty"`
+	Reference string    `json:"reference,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// MaxAttempts is the number of times a message is tried before its error
+// is final.
+const MaxAttempts = 3
+
+// IsFinal reports whether event ends the life of sms. Errors are final
+// once the message has run out of attempts.
+func IsFinal(sms SMS, event string) bool {
+	switch event {
+	case EventDelivered, EventUndelivered, EventSuppressed:
+		return true
+	case EventError:
+		return sms.Retries >= MaxAttempts
+	}
+	return false
+}
+
+// Contact is a recipient whose attributes can be used in templates.
+type Contact struct {
+	UUID       string            `json:"uuid"`
+	Name       string            `json:"name"`
+	Number     string            `json:"number"`
+	Locale     string            `json:"locale"`
+	Attributes map[string]string `json:"attributes"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+// Group is a named list of contacts messages can be sent to.
+type Group struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Size      int       `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Suppression is a number messages must not be sent to.
+type Suppression struct {
+	Number string `json:"number"`
+	// Source is "keyword" for an opt-out reply or "api"
+	Source    string    `json:"source"`
+	Detail    string    `json:"detail"`
+	CreatedAt time.Time `json:"created_at"`
 }
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"regexp"
+	"strings"
+)
+
+// DefaultCountryCode is prepended to national numbers, e.g. "380".
+var DefaultCountryCode string
+
+var phoneNumber = regexp.MustCompile(`^\+?\d+$`)
+
+// NormalizeNumber converts a phone number to E.164 (+380631234567) so that
+// the same recipient is stored the same way however it was written.
+// Alphanumeric senders and short codes are returned as is.
+func NormalizeNumber(number string) string {
+	number = strings.TrimSpace(number)
+	digits := strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "").Replace(number)
+	if !phoneNumber.MatchString(digits) {
+		return number
+	}
+	if strings.HasPrefix(digits, "+") {
+		return digits
+	}
+	if strings.HasPrefix(digits, "00") {
+		return "+" + digits[2:]
+	}
+	if len(digits) <= 6 || DefaultCountryCode == "" {
+		return digits
+	}
+	if strings.HasPrefix(digits, DefaultCountryCode) && len(digits) > 10 {
+		return "+" + digits
+	}
+	// drop the trunk prefix of a national number
+	return "+" + DefaultCountryCode + strings.TrimPrefix(digits, "0")
+}
@@ -0,0 +1,23 @@
+package common
+
+import "testing"
+
+func TestNormalizeNumber(t *testing.T) {
+	DefaultCountryCode = "380"
+	defer func() { DefaultCountryCode = "" }()
+	numbers := map[string]string{
+		"+380631234567":       "+380631234567",
+		"+38 (063) 123-45-67": "+380631234567",
+		"00380631234567":      "+380631234567",
+		"380631234567":        "+380631234567",
+		"0631234567":          "+380631234567",
+		"063 123 45 67":       "+380631234567",
+		"111":                 "111",
+		"life:)":              "life:)",
+	}
+	for number, expected := range numbers {
+		if normalized := NormalizeNumber(number); normalized != expected {
+			t.Errorf("Expected %#v for %#v, got %#v", expected, number, normalized)
+		}
+	}
+}
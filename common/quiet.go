@@ -0,0 +1,115 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// QuietHoursOff disables quiet hours for a message
+const QuietHoursOff = "off"
+
+// QuietHours is a daily period, such as 21:00-08:00, during which non-urgent
+// messages are not sent. It may span midnight.
+type QuietHours struct {
+	// Start and End since midnight, equal ones mean no quiet hours
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseQuietHours parses "HH:MM-HH:MM".
+func ParseQuietHours(s string) (QuietHours, error) {
+	var q QuietHours
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return q, fmt.Errorf("quiet hours must be HH:MM-HH:MM")
+	}
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return q, fmt.Errorf("quiet hours must be HH:MM-HH:MM")
+		}
+		offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if i == 0 {
+			q.Start = offset
+		} else {
+			q.End = offset
+		}
+	}
+	return q, nil
+}
+
+// Next returns the end of the quiet hours t falls in, t itself if it does
+// not. The hours are taken in the location of t.
+func (q QuietHours) Next(t time.Time) time.Time {
+	if q.Start == q.End {
+		return t
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	switch {
+	case q.Start < q.End && offset >= q.Start && offset < q.End:
+		return midnight.Add(q.End)
+	case q.Start > q.End && offset < q.End:
+		return midnight.Add(q.End)
+	case q.Start > q.End && offset >= q.Start:
+		next := midnight.AddDate(0, 0, 1)
+		return next.Add(q.End)
+	}
+	return t
+}
+
+// TimeZones maps international prefixes of countries with a single time zone
+// to it.
+var TimeZones = map[string]string{
+	"+30":  "Europe/Athens",
+	"+31":  "Europe/Amsterdam",
+	"+32":  "Europe/Brussels",
+	"+33":  "Europe/Paris",
+	"+34":  "Europe/Madrid",
+	"+36":  "Europe/Budapest",
+	"+39":  "Europe/Rome",
+	"+40":  "Europe/Bucharest",
+	"+41":  "Europe/Zurich",
+	"+43":  "Europe/Vienna",
+	"+44":  "Europe/London",
+	"+45":  "Europe/Copenhagen",
+	"+46":  "Europe/Stockholm",
+	"+47":  "Europe/Oslo",
+	"+48":  "Europe/Warsaw",
+	"+49":  "Europe/Berlin",
+	"+81":  "Asia/Tokyo",
+	"+82":  "Asia/Seoul",
+	"+86":  "Asia/Shanghai",
+	"+90":  "Europe/Istanbul",
+	"+91":  "Asia/Kolkata",
+	"+358": "Europe/Helsinki",
+	"+359": "Europe/Sofia",
+	"+370": "Europe/Vilnius",
+	"+371": "Europe/Riga",
+	"+372": "Europe/Tallinn",
+	"+373": "Europe/Chisinau",
+	"+375": "Europe/Minsk",
+	"+380": "Europe/Kyiv",
+	"+420": "Europe/Prague",
+	"+421": "Europe/Bratislava",
+	"+972": "Asia/Jerusalem",
+	"+995": "Asia/Tbilisi",
+}
+
+// TimeZone returns the time zone of the longest prefix of number in zones,
+// falling back to TimeZones, empty if none matches.
+func TimeZone(number string, zones map[string]string) string {
+	for _, m := range []map[string]string{zones, TimeZones} {
+		var zone, prefix string
+		for p, z := range m {
+			if strings.HasPrefix(number, p) && len(p) > len(prefix) {
+				zone, prefix = z, p
+			}
+		}
+		if zone != "" {
+			return zone
+		}
+	}
+	return ""
+}
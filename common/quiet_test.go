@@ -0,0 +1,61 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuietHours(t *testing.T) {
+	kyiv, err := time.LoadLocation("Europe/Kyiv")
+	if err != nil {
+		t.Skip(err)
+	}
+	night, err := ParseQuietHours("21:00-08:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day, err := ParseQuietHours("12:00 - 13:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(hour, min int) time.Time { return time.Date(2026, 10, 19, hour, min, 0, 0, kyiv) }
+	tests := []struct {
+		q    QuietHours
+		t    time.Time
+		next time.Time
+	}{
+		{night, at(12, 0), at(12, 0)},
+		{night, at(21, 0), time.Date(2026, 10, 20, 8, 0, 0, 0, kyiv)},
+		{night, at(3, 15), at(8, 0)},
+		{night, at(8, 0), at(8, 0)},
+		{day, at(12, 45), at(13, 30)},
+		{day, at(22, 0), at(22, 0)},
+		{QuietHours{}, at(3, 0), at(3, 0)},
+	}
+	for _, test := range tests {
+		if next := test.q.Next(test.t); !next.Equal(test.next) {
+			t.Errorf("Expected %v in %#v to be deferred to %v, got %v", test.t, test.q, test.next, next)
+		}
+	}
+	for _, s := range []string{"", "21:00", "25:00-08:00", "9-17"} {
+		if _, err := ParseQuietHours(s); err == nil {
+			t.Errorf("Expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestTimeZone(t *testing.T) {
+	zones := map[string]string{"+1": "America/New_York", "+1415": "America/Los_Angeles", "+380": "Europe/Uzhgorod"}
+	tests := map[string]string{
+		"+14155550100":  "America/Los_Angeles",
+		"+12125550100":  "America/New_York",
+		"+380631234567": "Europe/Uzhgorod",
+		"+48601234567":  "Europe/Warsaw",
+		"+79161234567":  "",
+	}
+	for number, zone := range tests {
+		if z := TimeZone(number, zones); z != zone {
+			t.Errorf("Expected %s in %s, got %q", number, zone, z)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package common
+
+import (
+	"strings"
+	"unicode/utf16"
+)
+
+// gsmBasic and gsmExtension are the GSM 03.38 alphabet, extension characters
+// take two septets.
+const gsmBasic = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+const gsmExtension = "^{}\\[~]|€\f"
+
+// Segments returns the number of SMS a text is split into: 160 GSM 7-bit
+// characters fit in one message and 153 per part of a longer one, or 70 and
+// 67 UCS-2 characters if the text is not GSM encodable.
+func Segments(text string) int {
+	if text == "" {
+		return 1
+	}
+	septets := 0
+	for _, r := range text {
+		if strings.ContainsRune(gsmBasic, r) {
+			septets++
+		} else if strings.ContainsRune(gsmExtension, r) {
+			septets += 2
+		} else {
+			return segments(len(utf16.Encode([]rune(text))), 70, 67)
+		}
+	}
+	return segments(septets, 160, 153)
+}
+
+func segments(length int, single int, part int) int {
+	if length <= single {
+		return 1
+	}
+	return (length + part - 1) / part
+}
@@ -0,0 +1,29 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSegments(t *testing.T) {
+	texts := map[string]int{
+		"":                             1,
+		"hello":                        1,
+		strings.Repeat("a", 160):       1,
+		strings.Repeat("a", 161):       2,
+		strings.Repeat("a", 306):       2,
+		strings.Repeat("a", 307):       3,
+		strings.Repeat("€", 80):        1,
+		strings.Repeat("€", 81):        2,
+		strings.Repeat("ї", 70):        1,
+		strings.Repeat("ї", 71):        2,
+		strings.Repeat("ї", 134):       2,
+		"Ваш код 1234":                 1,
+		strings.Repeat("a", 159) + "ї": 3,
+	}
+	for text, expected := range texts {
+		if segments := Segments(text); segments != expected {
+			t.Errorf("Expected %d segments for %d characters, got %d", expected, len([]rune(text)), segments)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Template is a message text with {{name}} placeholders in several locales.
+type Template struct {
+	ID            string            `json:"id"`
+	DefaultLocale string            `json:"default_locale"`
+	Variants      map[string]string `json:"variants"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
+
+var placeholder = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.]+)\s*\}\}`)
+
+// identifier of templates and groups
+var identifier = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Validate checks the id and that the default locale has a variant.
+func (t *Template) Validate() error {
+	if !identifier.MatchString(t.ID) {
+		return fmt.Errorf("id must consist of letters, digits, _, . and -")
+	}
+	if len(t.Variants) == 0 {
+		return fmt.Errorf("at least one variant is required")
+	}
+	if _, ok := t.Variants[t.DefaultLocale]; !ok {
+		return fmt.Errorf("no variant for default locale %#v", t.DefaultLocale)
+	}
+	for locale, body := range t.Variants {
+		if strings.TrimSpace(body) == "" {
+			return fmt.Errorf("variant %#v is empty", locale)
+		}
+	}
+	return nil
+}
+
+// Variant picks the body for locale, falling back from "uk-UA" to "uk" and
+// then to the default locale.
+func (t *Template) Variant(locale string) string {
+	if body, ok := t.Variants[locale]; ok {
+		return body
+	}
+	if i := strings.IndexAny(locale, "-_"); i > 0 {
+		if body, ok := t.Variants[locale[:i]]; ok {
+			return body
+		}
+	}
+	return t.Variants[t.DefaultLocale]
+}
+
+// Render substitutes vars into the variant for locale. Every placeholder
+// must have a value.
+func (t *Template) Render(locale string, vars map[string]string) (string, error) {
+	var missing []string
+	text := placeholder.ReplaceAllStringFunc(t.Variant(locale), func(match string) string {
+		name := placeholder.FindStringSubmatch(match)[1]
+		value, ok := vars[name]
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing variables: %s", strings.Join(missing, ", "))
+	}
+	return text, nil
+}
+
+var attributeName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// Validate checks that the contact has a number and that attribute names
+// can be used as placeholders.
+func (c *Contact) Validate() error {
+	if c.Number == "" {
+		return fmt.Errorf("number is required")
+	}
+	for name := range c.Attributes {
+		if !attributeName.MatchString(name) {
+			return fmt.Errorf("attribute %#v must consist of letters, digits and _", name)
+		}
+	}
+	return nil
+}
+
+// Vars returns the template variables of a contact: contact.name,
+// contact.number, contact.locale and contact.<attribute>.
+func (c *Contact) Vars() map[string]string {
+	vars := map[string]string{
+		"contact.name":   c.Name,
+		"contact.number": c.Number,
+		"contact.locale": c.Locale,
+	}
+	for name, value := range c.Attributes {
+		vars["contact."+name] = value
+	}
+	return vars
+}
+
+// Validate checks the id of the group.
+func (g *Group) Validate() error {
+	if !identifier.MatchString(g.ID) {
+		return fmt.Errorf("id must consist of letters, digits, _, . and -")
+	}
+	return nil
+}
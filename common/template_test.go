@@ -0,0 +1,35 @@
+package common
+
+import "testing"
+
+func TestTemplateRender(t *testing.T) {
+	template := Template{
+		ID:            "otp",
+		DefaultLocale: "en",
+		Variants: map[string]string{
+			"en": "Your code is {{code}}",
+			"uk": "Ваш код {{ code }}, {{name}}",
+		},
+	}
+	vars := map[string]string{"code": "1234", "name": "Olena"}
+	rendered := map[string]string{
+		"":      "Your code is 1234",
+		"en":    "Your code is 1234",
+		"uk":    "Ваш код 1234, Olena",
+		"uk-UA": "Ваш код 1234, Olena",
+		"de":    "Your code is 1234",
+	}
+	for locale, expected := range rendered {
+		text, err := template.Render(locale, vars)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text != expected {
+			t.Errorf("Expected %#v for %#v, got %#v", expected, locale, text)
+		}
+	}
+	_, err := template.Render("uk", map[string]string{"code": "1234"})
+	if err == nil || err.Error() != "missing variables: name" {
+		t.Fatalf("Expected missing variable name, got %#v", err)
+	}
+}
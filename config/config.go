@@ -2,25 +2,722 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/alexgear/sms/common"
 )
 
-type config struct {
+type Config struct {
+	// Database is a path to an sqlite file or a postgres:// DSN
+	Database   string
 	ComPort    string
 	BaudRate   int
 	ServerHost string
 	ServerPort int
+	// DefaultCountryCode turns national numbers into international ones
+	DefaultCountryCode string
+	// MaxSegments rejects rendered templates longer than this many SMS,
+	// 0 is unlimited
+	MaxSegments int
+	// IdempotencyWindow in seconds during which a repeated Idempotency-Key
+	// returns the original message
+	IdempotencyWindow int
+	// StatusWebhook receives a POST when the status of a message changes
+	StatusWebhook string
+	// Clients allowed to use the API, the API is open when there are none
+	Clients []ClientConfig
+	Balance BalanceConfig
+	Inbound InboundConfig
+	OptOut  OptOutConfig
+	Queue   QueueConfig
+	// Rules answer or route received messages
+	Rules []RuleConfig
+
+	// Destinations restricts the numbers every client can send to
+	Destinations DestinationConfig
+	// Throttle limits how fast the modem sends
+	Throttle ThrottleConfig
+	// QuietHours defers non-urgent messages sent at night
+	QuietHours QuietHoursConfig
+	// SMPP accepts messages from SMPP clients
+	SMPP SMPPConfig
+	// Transports are upstream SMSCs messages may be sent through besides
+	// the modem, chosen by Routes
+	Transports []TransportConfig
+	Routes     []RouteConfig
+	// Kannel accepts messages on Kannel's sendsms URL
+	Kannel KannelConfig
+	// Twilio accepts messages on Twilio's Messages REST API
+	Twilio TwilioConfig
+	// Email accepts mail to <number>@Domain over SMTP and sends it as SMS
+	Email EmailConfig
+	// Forward mails received messages through an SMTP relay
+	Forward ForwardConfig
+}
+
+// EmailConfig runs an SMTP server for systems which can only send email.
+type EmailConfig struct {
+	// Listen address such as ":2525", empty disables the server
+	Listen string
+	// Domain of the recipients, mail to <number>@Domain is sent to number
+	Domain string
+	// Users may authenticate with AUTH, their messages belong to the client
+	// named Username. Mail from the IPs or CIDRs of Allow is accepted
+	// without AUTH and belongs to Client.
+	Users  []EmailUser
+	Allow  []string
+	Client string
+	// Senders are the addresses accepted in MAIL FROM, any if empty
+	Senders []string
+	// Text of the SMS is the "subject", the "body" or "both"
+	Text string
+	// CutAt are regexps of lines which end the text, such as a signature
+	// delimiter or the header of a quoted reply
+	CutAt []string
+	// StripQuoted drops lines starting with ">"
+	StripQuoted bool
+	// MaxLength of the text in characters, longer texts are cut, 0 is
+	// unlimited
+	MaxLength int
+	// MaxSize of a mail in bytes
+	MaxSize int
+}
+
+// EmailUser may authenticate to the SMTP server.
+type EmailUser struct {
+	Username string
+	Password string
+}
+
+// ForwardConfig mails received messages, such as to a team inbox.
+type ForwardConfig struct {
+	// Relay is the host:port of an SMTP server, empty disables forwarding.
+	// Username and Password authenticate with AUTH PLAIN if set.
+	Relay    string
+	Username string
+	Password string
+	// From is the sender address of the mails
+	From string
+	// To receives the messages of senders no route matches
+	To []string
+	// Subject and Body are templates with the placeholders {{sender}},
+	// {{received_at}}, {{text}} and {{uuid}}
+	Subject string
+	Body    string
+	// Routes send the messages of the first matching sender to its To
+	Routes []ForwardRoute
+	// Replies to a mail from its recipients are sent as SMS to the sender
+	// of the message. The mails are answered to reply+<uuid>@Email.Domain,
+	// which the SMTP server of Email has to receive.
+	Replies bool
+}
+
+// ForwardRoute sends the messages of senders matching the Sender regexp to
+// To, none drops them.
+type ForwardRoute struct {
+	Sender string
+	To     []string
+}
+
+// TwilioConfig emulates the Messages resource of Twilio's REST API for
+// applications using a Twilio SDK.
+type TwilioConfig struct {
+	Enabled  bool
+	Accounts []TwilioAccount
+}
+
+// TwilioAccount authenticates with its AccountSID and AuthToken, which also
+// signs its status callbacks. Its messages belong to the client named
+// AccountSID.
+type TwilioAccount struct {
+	AccountSID string
+	AuthToken  string
+}
+
+// KannelConfig serves /cgi-bin/sendsms for tools which can only send through
+// Kannel.
+type KannelConfig struct {
+	Enabled bool
+	Users   []KannelUser
+}
+
+// KannelUser may send with its Username and Password. Its messages belong to
+// the client named Username.
+type KannelUser struct {
+	Username string
+	Password string
+}
+
+// ModemTransport is the name of the modem in routes
+const ModemTransport = "modem"
+
+// TransportConfig is an SMSC the gateway binds to as an SMPP transceiver.
+type TransportConfig struct {
+	Name string
+	// Address of the SMSC as host:port
+	Address    string
+	SystemID   string
+	Password   string
+	SystemType string
+	// Source address of sent messages, empty for the default of the SMSC
+	Source string
+	// Window is the number of submit_sm awaiting a response
+	Window int
+	// EnquireLink interval and Timeout of responses in seconds
+	EnquireLink int
+	Timeout     int
+}
+
+// RouteConfig sends matching messages through the first of Transports that
+// is up, failing over to the next one if sending fails. Messages matching
+// no route are sent by the modem.
+type RouteConfig struct {
+	Name string
+	// Prefixes of the number and Clients sending the message, any if empty
+	Prefixes   []string
+	Clients    []string
+	Transports []string
+}
+
+// SMPPConfig runs an SMPP 3.4 server for clients that cannot use the HTTP
+// API.
+type SMPPConfig struct {
+	// Listen address such as ":2775", empty disables the server
+	Listen string
+	// SystemID of the gateway returned by binds
+	SystemID string
+	// IdleTimeout in seconds after which a session without any request is
+	// closed
+	IdleTimeout int
+	Accounts    []SMPPAccount
+}
+
+// SMPPAccount may bind to the SMPP server. Its messages belong to the client
+// named SystemID.
+type SMPPAccount struct {
+	SystemID string
+	Password string
+	// Inbound receives the messages received by the modem
+	Inbound bool
+}
+
+// QuietHoursConfig defers messages until the quiet hours end in the time zone
+// of the recipient.
+type QuietHoursConfig struct {
+	// Hours such as "21:00-08:00", empty for none
+	Hours string
+	// TimeZones maps international prefixes to time zones, in addition to
+	// the built-in ones of countries with a single time zone
+	TimeZones map[string]string
+	// TimeZone of numbers without a known prefix, the local one if empty
+	TimeZone string
+	// BypassHigh sends high priority messages during the quiet hours too
+	BypassHigh bool
+}
+
+// ThrottleConfig limits sends of the modem so that the operator does not
+// block the SIM as a spammer. Zero disables a limit.
+type ThrottleConfig struct {
+	PerMinute int
+	PerHour   int
+	PerDay    int
+	// MinGap in seconds between two sends, plus up to Jitter random seconds
+	MinGap int
+	Jitter int
+}
+
+// RuleConfig matches received messages by sender and body. Rules are
+// evaluated from the highest Priority down and the first match wins unless
+// it sets Continue.
+type RuleConfig struct {
+	Name     string
+	Priority int
+	// Sender is a regexp matched against the normalized number, any sender
+	// if empty
+	Sender string
+	// Keywords match the whole body in any case, Body is a regexp whose
+	// named groups are available to templates as match.<name>. Any body
+	// matches if both are empty.
+	Keywords []string
+	Body     string
+	// Action is "reply" with Template, "forward" to ForwardTo with Template
+	// or the original text, "webhook" posting the message to URL or "tag"
+	// to store the message with Tags only
+	Action    string
+	Template  string
+	Locale    string
+	ForwardTo string
+	URL       string
+	Tags      []string
+	// Cooldown in seconds during which the rule does not act again for the
+	// same sender, prevents reply loops with other automated senders
+	Cooldown int
+	Continue bool
+}
+
+// OptOutConfig lists the replies which add the sender to the suppression
+// list or remove it. Keywords are matched against the whole message,
+// ignoring case and surrounding punctuation.
+type OptOutConfig struct {
+	StopKeywords  []string
+	StartKeywords []string
+	// StopReply and StartReply confirm the change, empty sends nothing
+	StopReply  string
+	StartReply string
+}
+
+// QueueConfig controls the order messages are sent in.
+type QueueConfig struct {
+	// HighReserve is the percentage of each batch of claimed messages kept
+	// for high priority messages, so that they are not stuck behind bulk ones
+	HighReserve int
+	// ScanInterval in seconds between scans for due messages. Messages
+	// queued by this instance are sent right away, the scan picks up those
+	// of other instances, retries and expired claims.
+	ScanInterval int
+	// RetryDelay in seconds before the first retry of a failed message,
+	// doubled for every further attempt
+	RetryDelay int
+}
+
+// InboundConfig controls reading of messages received by the modem.
+type InboundConfig struct {
+	// PollInterval in seconds between reads of the modem storage
+	PollInterval int
+}
+
+type ClientConfig struct {
+	Name string
+	Key  string
+	// Destinations of the client, checked in addition to the global ones
+	Destinations DestinationConfig
+}
+
+// DestinationConfig restricts the numbers messages are sent to by
+// international prefixes, e.g. "+380". A number must not start with any Deny
+// prefix and, if Allow is not empty, must start with one of Allow.
+type DestinationConfig struct {
+	Allow []string
+	Deny  []string
+}
+
+// BalanceConfig describes how to query and parse the balance of the SIM.
+type BalanceConfig struct {
+	// USSD code sent to the operator, e.g. "*111#"
+	USSD string
+	// Pattern is a regexp with a named group "amount" and an optional
+	// named group "currency", e.g. `Balans (?P<amount>\d+[.,]\d+)(?P<currency>hrn)`
+	Pattern string
+	// Currency is reported when Pattern has no "currency" group
+	Currency string
+	// SMSNumber and SMSText query the balance by SMS instead of USSD
+	SMSNumber  string
+	SMSText    string
+	SMSTimeout int
+	// PollInterval in seconds, 0 disables background polling
+	PollInterval int
+	LowThreshold float64
+	AlertMobiles []string
 }
 
 var err error
 
-func New(configPath string) (config, error) {
-	var conf config
+func New(configPath string) (Config, error) {
+	var conf Config
+	conf.Database = "db.sqlite"
+	conf.IdempotencyWindow = 24 * 60 * 60
+	conf.Inbound.PollInterval = 30
+	conf.Queue.ScanInterval = 60
+	conf.Queue.RetryDelay = 30
+	conf.QuietHours.BypassHigh = true
+	conf.SMPP.SystemID = "sms"
+	conf.SMPP.IdleTimeout = 120
+	conf.Email.Client = "email"
+	conf.Email.Text = "both"
+	conf.Email.StripQuoted = true
+	conf.Email.MaxSize = 1024 * 1024
+	conf.Forward.Subject = "SMS from {{sender}}"
+	conf.Forward.Body = "{{text}}\n\n-- \nFrom {{sender}} at {{received_at}}"
+	conf.Balance = BalanceConfig{
+		USSD:       "*111#",
+		Pattern:    `(?P<amount>\d+[.,]\d+)`,
+		SMSTimeout: 60,
+	}
 	_, err = toml.DecodeFile(configPath, &conf)
 	if err != nil {
 		return conf, fmt.Errorf("New: %s", err.Error())
 	}
+	// set after decoding, toml fails to decode a longer list into a slice
+	if conf.OptOut.StopKeywords == nil {
+		conf.OptOut.StopKeywords = []string{"STOP", "STOPALL", "UNSUBSCRIBE", "CANCEL", "END", "QUIT", "СТОП"}
+	}
+	if conf.OptOut.StartKeywords == nil {
+		conf.OptOut.StartKeywords = []string{"START", "UNSTOP", "СТАРТ"}
+	}
+	if conf.Email.CutAt == nil {
+		conf.Email.CutAt = []string{`^-- ?$`, `^On .* wrote:$`, `^-----Original Message-----`, `^Sent from my `}
+	}
+	if conf.IdempotencyWindow < 1 {
+		return conf, fmt.Errorf("New: IdempotencyWindow must be positive")
+	}
+	if conf.MaxSegments < 0 {
+		return conf, fmt.Errorf("New: MaxSegments must not be negative")
+	}
+	if conf.Queue.HighReserve < 0 || conf.Queue.HighReserve > 90 {
+		return conf, fmt.Errorf("New: Queue.HighReserve must be 0 to 90")
+	}
+	if conf.Queue.ScanInterval < 1 {
+		return conf, fmt.Errorf("New: Queue.ScanInterval must be positive")
+	}
+	if conf.Queue.RetryDelay < 0 {
+		return conf, fmt.Errorf("New: Queue.RetryDelay must not be negative")
+	}
+	t := conf.Throttle
+	if t.PerMinute < 0 || t.PerHour < 0 || t.PerDay < 0 || t.MinGap < 0 || t.Jitter < 0 {
+		return conf, fmt.Errorf("New: Throttle limits must not be negative")
+	}
+	err = conf.QuietHours.validate()
+	if err != nil {
+		return conf, fmt.Errorf("New: %s", err.Error())
+	}
+	err = conf.SMPP.validate()
+	if err != nil {
+		return conf, fmt.Errorf("New: SMPP: %s", err.Error())
+	}
+	err = conf.Kannel.validate()
+	if err != nil {
+		return conf, fmt.Errorf("New: Kannel: %s", err.Error())
+	}
+	err = conf.Twilio.validate()
+	if err != nil {
+		return conf, fmt.Errorf("New: Twilio: %s", err.Error())
+	}
+	err = conf.Email.validate()
+	if err != nil {
+		return conf, fmt.Errorf("New: Email: %s", err.Error())
+	}
+	err = conf.Forward.validate()
+	if err != nil {
+		return conf, fmt.Errorf("New: Forward: %s", err.Error())
+	}
+	if conf.Forward.Relay != "" && conf.Forward.Replies && conf.Email.Listen == "" {
+		return conf, fmt.Errorf("New: Forward: Replies need the SMTP server of Email")
+	}
+	transports := map[string]bool{ModemTransport: true}
+	for i := range conf.Transports {
+		t := &conf.Transports[i]
+		if t.Window == 0 {
+			t.Window = 10
+		}
+		if t.EnquireLink == 0 {
+			t.EnquireLink = 30
+		}
+		if t.Timeout == 0 {
+			t.Timeout = 10
+		}
+		err = t.validate()
+		if err != nil {
+			return conf, fmt.Errorf("New: Transports: %s", err.Error())
+		}
+		if transports[t.Name] {
+			return conf, fmt.Errorf("New: Transports: duplicate name %s", t.Name)
+		}
+		transports[t.Name] = true
+	}
+	for _, r := range conf.Routes {
+		err = r.validate(transports)
+		if err != nil {
+			return conf, fmt.Errorf("New: Routes: %s", err.Error())
+		}
+	}
+	if conf.Inbound.PollInterval < 1 {
+		return conf, fmt.Errorf("New: Inbound.PollInterval must be positive")
+	}
+	err = conf.Balance.validate()
+	if err != nil {
+		return conf, fmt.Errorf("New: %s", err.Error())
+	}
+	err = conf.Destinations.validate()
+	if err != nil {
+		return conf, fmt.Errorf("New: Destinations: %s", err.Error())
+	}
+	names := make(map[string]bool)
+	for _, rule := range conf.Rules {
+		err = rule.validate()
+		if err != nil {
+			return conf, fmt.Errorf("New: Rules: %s", err.Error())
+		}
+		if names[rule.Name] {
+			return conf, fmt.Errorf("New: Rules: duplicate Name %s", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	keys := make(map[string]bool)
+	for _, client := range conf.Clients {
+		if client.Name == "" || client.Key == "" {
+			return conf, fmt.Errorf("New: Clients: Name and Key are required")
+		}
+		if keys[client.Key] {
+			return conf, fmt.Errorf("New: Clients: duplicate Key of %s", client.Name)
+		}
+		keys[client.Key] = true
+		err = client.Destinations.validate()
+		if err != nil {
+			return conf, fmt.Errorf("New: Clients: %s: Destinations: %s", client.Name, err.Error())
+		}
+	}
 
 	return conf, nil
 }
+
+func (b BalanceConfig) validate() error {
+	pattern, err := regexp.Compile(b.Pattern)
+	if err != nil {
+		return fmt.Errorf("Balance.Pattern: %s", err.Error())
+	}
+	for _, name := range pattern.SubexpNames() {
+		if name == "amount" {
+			return nil
+		}
+	}
+	return fmt.Errorf("Balance.Pattern: missing named group \"amount\" in %s", b.Pattern)
+}
+
+func (r RuleConfig) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("Name is required")
+	}
+	for _, pattern := range []string{r.Sender, r.Body} {
+		_, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: %s", r.Name, err.Error())
+		}
+	}
+	switch r.Action {
+	case "reply":
+		if r.Template == "" {
+			return fmt.Errorf("%s: Template is required to reply", r.Name)
+		}
+	case "forward":
+		if r.ForwardTo == "" {
+			return fmt.Errorf("%s: ForwardTo is required to forward", r.Name)
+		}
+	case "webhook":
+		if r.URL == "" {
+			return fmt.Errorf("%s: URL is required for a webhook", r.Name)
+		}
+	case "tag":
+		if len(r.Tags) == 0 {
+			return fmt.Errorf("%s: Tags are required to tag", r.Name)
+		}
+	default:
+		return fmt.Errorf("%s: unknown Action %#v", r.Name, r.Action)
+	}
+	for _, tag := range r.Tags {
+		if tag == "" || strings.Contains(tag, ",") {
+			return fmt.Errorf("%s: tags must be non-empty and without commas", r.Name)
+		}
+	}
+	if r.Cooldown < 0 {
+		return fmt.Errorf("%s: Cooldown must not be negative", r.Name)
+	}
+	return nil
+}
+
+var prefix = regexp.MustCompile(`^\+\d+$`)
+
+func (d DestinationConfig) validate() error {
+	for _, p := range append(append([]string{}, d.Allow...), d.Deny...) {
+		if !prefix.MatchString(p) {
+			return fmt.Errorf("invalid prefix %#v, expected + and digits", p)
+		}
+	}
+	return nil
+}
+
+func (c QuietHoursConfig) validate() error {
+	if c.Hours != "" {
+		_, err := common.ParseQuietHours(c.Hours)
+		if err != nil {
+			return fmt.Errorf("QuietHours.Hours: %s", err.Error())
+		}
+	}
+	zones := []string{c.TimeZone}
+	for p, zone := range c.TimeZones {
+		if !prefix.MatchString(p) {
+			return fmt.Errorf("QuietHours.TimeZones: invalid prefix %#v, expected + and digits", p)
+		}
+		zones = append(zones, zone)
+	}
+	for _, zone := range zones {
+		_, err := time.LoadLocation(zone)
+		if err != nil {
+			return fmt.Errorf("QuietHours: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+func (c SMPPConfig) validate() error {
+	if c.Listen == "" {
+		return nil
+	}
+	if c.IdleTimeout < 1 {
+		return fmt.Errorf("IdleTimeout must be positive")
+	}
+	if len(c.Accounts) == 0 {
+		return fmt.Errorf("no Accounts")
+	}
+	seen := make(map[string]bool)
+	for _, a := range c.Accounts {
+		// limits of the bind fields without the terminating null
+		if a.SystemID == "" || len(a.SystemID) > 15 || len(a.Password) > 8 {
+			return fmt.Errorf("%#v: SystemID must have 1 to 15 and Password up to 8 characters", a.SystemID)
+		}
+		if seen[a.SystemID] {
+			return fmt.Errorf("duplicate account %s", a.SystemID)
+		}
+		seen[a.SystemID] = true
+	}
+	return nil
+}
+
+func (c KannelConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Users) == 0 {
+		return fmt.Errorf("no Users")
+	}
+	seen := make(map[string]bool)
+	for _, u := range c.Users {
+		if u.Username == "" || u.Password == "" {
+			return fmt.Errorf("Username and Password are required")
+		}
+		if seen[u.Username] {
+			return fmt.Errorf("duplicate user %s", u.Username)
+		}
+		seen[u.Username] = true
+	}
+	return nil
+}
+
+func (c TwilioConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Accounts) == 0 {
+		return fmt.Errorf("no Accounts")
+	}
+	seen := make(map[string]bool)
+	for _, a := range c.Accounts {
+		if a.AccountSID == "" || a.AuthToken == "" {
+			return fmt.Errorf("AccountSID and AuthToken are required")
+		}
+		if seen[a.AccountSID] {
+			return fmt.Errorf("duplicate account %s", a.AccountSID)
+		}
+		seen[a.AccountSID] = true
+	}
+	return nil
+}
+
+func (c EmailConfig) validate() error {
+	if c.Listen == "" {
+		return nil
+	}
+	if c.Domain == "" {
+		return fmt.Errorf("Domain is required")
+	}
+	if len(c.Users) == 0 && len(c.Allow) == 0 {
+		return fmt.Errorf("no Users or Allow")
+	}
+	for _, u := range c.Users {
+		if u.Username == "" || u.Password == "" {
+			return fmt.Errorf("Username and Password are required")
+		}
+	}
+	for _, a := range c.Allow {
+		_, _, err := net.ParseCIDR(a)
+		if err != nil && net.ParseIP(a) == nil {
+			return fmt.Errorf("Allow: invalid IP or CIDR %#v", a)
+		}
+	}
+	if c.Text != "subject" && c.Text != "body" && c.Text != "both" {
+		return fmt.Errorf("Text must be subject, body or both")
+	}
+	for _, pattern := range c.CutAt {
+		_, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("CutAt: %s", err.Error())
+		}
+	}
+	if c.MaxLength < 0 || c.MaxSize < 1 {
+		return fmt.Errorf("MaxLength must not be negative and MaxSize must be positive")
+	}
+	return nil
+}
+
+func (c ForwardConfig) validate() error {
+	if c.Relay == "" {
+		return nil
+	}
+	_, _, err := net.SplitHostPort(c.Relay)
+	if err != nil {
+		return fmt.Errorf("Relay: %s", err.Error())
+	}
+	_, err = mail.ParseAddress(c.From)
+	if err != nil {
+		return fmt.Errorf("From: %s", err.Error())
+	}
+	if len(c.To) == 0 && len(c.Routes) == 0 {
+		return fmt.Errorf("no To or Routes")
+	}
+	vars := map[string]string{"sender": "", "received_at": "", "text": "", "uuid": ""}
+	for name, text := range map[string]string{"Subject": c.Subject, "Body": c.Body} {
+		t := common.Template{Variants: map[string]string{"": text}}
+		_, err = t.Render("", vars)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	for _, r := range c.Routes {
+		_, err = regexp.Compile(r.Sender)
+		if err != nil {
+			return fmt.Errorf("Routes: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+func (t TransportConfig) validate() error {
+	if t.Name == "" || t.Address == "" || t.SystemID == "" {
+		return fmt.Errorf("Name, Address and SystemID are required")
+	}
+	if t.Window < 1 || t.EnquireLink < 1 || t.Timeout < 1 {
+		return fmt.Errorf("%s: Window, EnquireLink and Timeout must be positive", t.Name)
+	}
+	return nil
+}
+
+func (r RouteConfig) validate(transports map[string]bool) error {
+	if len(r.Transports) == 0 {
+		return fmt.Errorf("%s: no Transports", r.Name)
+	}
+	for _, name := range r.Transports {
+		if !transports[name] {
+			return fmt.Errorf("%s: unknown transport %s", r.Name, name)
+		}
+	}
+	for _, p := range r.Prefixes {
+		if !prefix.MatchString(p) {
+			return fmt.Errorf("%s: invalid prefix %#v, expected + and digits", r.Name, p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,376 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alexgear/sms/common"
+)
+
+const contactColumns = "contacts.uuid, contacts.name, contacts.number, contacts.locale, contacts.attributes," +
+	" contacts.created_at, contacts.updated_at"
+
+const groupColumns = "id, name, created_at," +
+	" (SELECT COUNT(*) FROM contact_group_members WHERE group_id = contact_groups.id)"
+
+func init() {
+	queries["insertContact"] = "INSERT INTO contacts(uuid, name, number, locale, attributes, created_at, updated_at)" +
+		" VALUES(?, ?, ?, ?, ?, ?, ?)"
+	queries["updateContact"] = "UPDATE contacts SET name = ?, number = ?, locale = ?, attributes = ?, updated_at = ?" +
+		" WHERE uuid = ?"
+	queries["deleteContact"] = "DELETE FROM contacts WHERE uuid = ?"
+	queries["deleteContactMemberships"] = "DELETE FROM contact_group_members WHERE contact_uuid = ?"
+	queries["getContact"] = "SELECT " + contactColumns + " FROM contacts WHERE uuid = ?"
+	queries["getContactByNumber"] = "SELECT " + contactColumns + " FROM contacts WHERE number = ?"
+	queries["listContacts"] = "SELECT " + contactColumns + " FROM contacts ORDER BY name, number"
+	queries["listGroupContacts"] = "SELECT " + contactColumns + " FROM contacts" +
+		" JOIN contact_group_members ON contact_uuid = contacts.uuid WHERE group_id = ? ORDER BY name, number"
+	queries["insertGroup"] = "INSERT INTO contact_groups(id, name, created_at) VALUES(?, ?, ?)"
+	queries["updateGroup"] = "UPDATE contact_groups SET name = ? WHERE id = ?"
+	queries["deleteGroup"] = "DELETE FROM contact_groups WHERE id = ?"
+	queries["deleteGroupMembers"] = "DELETE FROM contact_group_members WHERE group_id = ?"
+	queries["getGroup"] = "SELECT " + groupColumns + " FROM contact_groups WHERE id = ?"
+	queries["listGroups"] = "SELECT " + groupColumns + " FROM contact_groups ORDER BY id"
+	queries["insertGroupMember"] = "INSERT INTO contact_group_members(group_id, contact_uuid) VALUES(?, ?)" +
+		" ON CONFLICT DO NOTHING"
+	queries["deleteGroupMember"] = "DELETE FROM contact_group_members WHERE group_id = ? AND contact_uuid = ?"
+}
+
+func scanContact(row scanner) (common.Contact, error) {
+	var c common.Contact
+	var attributes string
+	err := row.Scan(&c.UUID, &c.Name, &c.Number, &c.Locale, &attributes, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal([]byte(attributes), &c.Attributes)
+	return c, err
+}
+
+func encodeAttributes(c *common.Contact) string {
+	if c.Attributes == nil {
+		c.Attributes = make(map[string]string)
+	}
+	attributes, _ := json.Marshal(c.Attributes)
+	return string(attributes)
+}
+
+// numberTaken reports whether number belongs to a contact other than uuid.
+func (s *sqlStore) numberTaken(tx *sql.Tx, number string, uuid string) (bool, error) {
+	other, err := scanContact(tx.Stmt(s.stmts["getContactByNumber"]).QueryRow(number))
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return other.UUID != uuid, nil
+}
+
+// InsertContact returns ErrExists if a contact with the same number exists.
+func (s *sqlStore) InsertContact(c *common.Contact) error {
+	log.Printf("InsertContact: %#v", c)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("InsertContact: %s", err.Error())
+	}
+	err = s.insertContact(tx, c)
+	if err == ErrExists {
+		tx.Rollback()
+		return err
+	} else if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("InsertContact: %s", err.Error())
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) insertContact(tx *sql.Tx, c *common.Contact) error {
+	taken, err := s.numberTaken(tx, c.Number, c.UUID)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrExists
+	}
+	c.CreatedAt = time.Now().UTC()
+	c.UpdatedAt = c.CreatedAt
+	_, err = tx.Stmt(s.stmts["insertContact"]).Exec(c.UUID, c.Name, c.Number, c.Locale, encodeAttributes(c),
+		c.CreatedAt, c.UpdatedAt)
+	return err
+}
+
+// UpdateContact returns ErrNotFound for an unknown uuid and ErrExists if
+// another contact has the number.
+func (s *sqlStore) UpdateContact(c *common.Contact) error {
+	log.Printf("UpdateContact: %#v", c)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("UpdateContact: %s", err.Error())
+	}
+	err = s.updateContact(tx, c)
+	if err == ErrExists || err == ErrNotFound {
+		tx.Rollback()
+		return err
+	} else if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("UpdateContact: %s", err.Error())
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) updateContact(tx *sql.Tx, c *common.Contact) error {
+	taken, err := s.numberTaken(tx, c.Number, c.UUID)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrExists
+	}
+	c.UpdatedAt = time.Now().UTC()
+	result, err := tx.Stmt(s.stmts["updateContact"]).Exec(c.Name, c.Number, c.Locale, encodeAttributes(c),
+		c.UpdatedAt, c.UUID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return tx.Stmt(s.stmts["getContact"]).QueryRow(c.UUID).Scan(new(string), new(string), new(string),
+		new(string), new(string), &c.CreatedAt, new(time.Time))
+}
+
+// ImportContacts inserts contacts or updates the ones with the same number
+// in a single transaction and adds all of them to group unless it is empty.
+func (s *sqlStore) ImportContacts(contacts []*common.Contact, group string) (int, int, error) {
+	log.Printf("ImportContacts: %d contacts to %#v", len(contacts), group)
+	inserted, updated := 0, 0
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("ImportContacts: %s", err.Error())
+	}
+	if group != "" {
+		err = tx.Stmt(s.stmts["getGroup"]).QueryRow(group).Scan(new(string), new(string), new(time.Time), new(int))
+		if err == sql.ErrNoRows {
+			tx.Rollback()
+			return 0, 0, ErrNotFound
+		} else if err != nil {
+			tx.Rollback()
+			return 0, 0, fmt.Errorf("ImportContacts: %s", err.Error())
+		}
+	}
+	for _, c := range contacts {
+		existing, err := scanContact(tx.Stmt(s.stmts["getContactByNumber"]).QueryRow(c.Number))
+		if err == sql.ErrNoRows {
+			err = s.insertContact(tx, c)
+			inserted++
+		} else if err == nil {
+			c.UUID = existing.UUID
+			err = s.updateContact(tx, c)
+			updated++
+		}
+		if err == nil && group != "" {
+			_, err = tx.Stmt(s.stmts["insertGroupMember"]).Exec(group, c.UUID)
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, 0, fmt.Errorf("ImportContacts: %s. %s", c.Number, err.Error())
+		}
+	}
+	return inserted, updated, tx.Commit()
+}
+
+// DeleteContact also removes the contact from its groups, returns
+// ErrNotFound for an unknown uuid.
+func (s *sqlStore) DeleteContact(uuid string) error {
+	log.Printf("DeleteContact: %#v", uuid)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("DeleteContact: %s", err.Error())
+	}
+	_, err = tx.Stmt(s.stmts["deleteContactMemberships"]).Exec(uuid)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("DeleteContact: %s", err.Error())
+	}
+	result, err := tx.Stmt(s.stmts["deleteContact"]).Exec(uuid)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("DeleteContact: %s", err.Error())
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+// GetContact returns ErrNotFound for an unknown uuid.
+func (s *sqlStore) GetContact(uuid string) (common.Contact, error) {
+	c, err := scanContact(s.stmts["getContact"].QueryRow(uuid))
+	if err == sql.ErrNoRows {
+		return c, ErrNotFound
+	} else if err != nil {
+		return c, fmt.Errorf("GetContact: %s", err.Error())
+	}
+	return c, nil
+}
+
+// ListContacts returns the members of group or all contacts if group is
+// empty, ordered by name.
+func (s *sqlStore) ListContacts(group string) ([]common.Contact, error) {
+	var contacts []common.Contact
+	var rows *sql.Rows
+	var err error
+	if group == "" {
+		rows, err = s.stmts["listContacts"].Query()
+	} else {
+		rows, err = s.stmts["listGroupContacts"].Query(group)
+	}
+	if err != nil {
+		return contacts, fmt.Errorf("ListContacts: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c, err := scanContact(rows)
+		if err != nil {
+			return contacts, fmt.Errorf("ListContacts: %s", err.Error())
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, rows.Err()
+}
+
+// InsertGroup returns ErrExists if a group with the same id exists.
+func (s *sqlStore) InsertGroup(g *common.Group) error {
+	log.Printf("InsertGroup: %#v", g)
+	_, err := s.GetGroup(g.ID)
+	if err == nil {
+		return ErrExists
+	} else if err != ErrNotFound {
+		return fmt.Errorf("InsertGroup: %s", err.Error())
+	}
+	g.CreatedAt = time.Now().UTC()
+	_, err = s.stmts["insertGroup"].Exec(g.ID, g.Name, g.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("InsertGroup: %s", err.Error())
+	}
+	return nil
+}
+
+// UpdateGroup renames a group, returns ErrNotFound for an unknown id.
+func (s *sqlStore) UpdateGroup(g *common.Group) error {
+	log.Printf("UpdateGroup: %#v", g)
+	result, err := s.stmts["updateGroup"].Exec(g.Name, g.ID)
+	if err != nil {
+		return fmt.Errorf("UpdateGroup: %s", err.Error())
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	*g, err = s.GetGroup(g.ID)
+	return err
+}
+
+// DeleteGroup keeps the contacts of the group, returns ErrNotFound for an
+// unknown id.
+func (s *sqlStore) DeleteGroup(id string) error {
+	log.Printf("DeleteGroup: %#v", id)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("DeleteGroup: %s", err.Error())
+	}
+	_, err = tx.Stmt(s.stmts["deleteGroupMembers"]).Exec(id)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("DeleteGroup: %s", err.Error())
+	}
+	result, err := tx.Stmt(s.stmts["deleteGroup"]).Exec(id)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("DeleteGroup: %s", err.Error())
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+func scanGroup(row scanner) (common.Group, error) {
+	var g common.Group
+	err := row.Scan(&g.ID, &g.Name, &g.CreatedAt, &g.Size)
+	return g, err
+}
+
+// GetGroup returns ErrNotFound for an unknown id.
+func (s *sqlStore) GetGroup(id string) (common.Group, error) {
+	g, err := scanGroup(s.stmts["getGroup"].QueryRow(id))
+	if err == sql.ErrNoRows {
+		return g, ErrNotFound
+	} else if err != nil {
+		return g, fmt.Errorf("GetGroup: %s", err.Error())
+	}
+	return g, nil
+}
+
+func (s *sqlStore) ListGroups() ([]common.Group, error) {
+	var groups []common.Group
+	rows, err := s.stmts["listGroups"].Query()
+	if err != nil {
+		return groups, fmt.Errorf("ListGroups: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		g, err := scanGroup(rows)
+		if err != nil {
+			return groups, fmt.Errorf("ListGroups: %s", err.Error())
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// AddGroupMembers adds contacts to a group, contacts already in it are
+// skipped. Returns ErrNotFound if the group or any of the contacts is unknown.
+func (s *sqlStore) AddGroupMembers(id string, uuids []string) error {
+	log.Printf("AddGroupMembers: %#v %#v", id, uuids)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("AddGroupMembers: %s", err.Error())
+	}
+	_, err = scanGroup(tx.Stmt(s.stmts["getGroup"]).QueryRow(id))
+	for _, uuid := range uuids {
+		if err == nil {
+			_, err = scanContact(tx.Stmt(s.stmts["getContact"]).QueryRow(uuid))
+		}
+		if err == nil {
+			_, err = tx.Stmt(s.stmts["insertGroupMember"]).Exec(id, uuid)
+		}
+	}
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return ErrNotFound
+	} else if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("AddGroupMembers: %s", err.Error())
+	}
+	return tx.Commit()
+}
+
+// RemoveGroupMember returns ErrNotFound if the contact is not in the group.
+func (s *sqlStore) RemoveGroupMember(id string, uuid string) error {
+	log.Printf("RemoveGroupMember: %#v %#v", id, uuid)
+	result, err := s.stmts["deleteGroupMember"].Exec(id, uuid)
+	if err != nil {
+		return fmt.Errorf("RemoveGroupMember: %s", err.Error())
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
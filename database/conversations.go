@@ -0,0 +1,202 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/alexgear/sms/common"
+)
+
+const inboundColumns = "uuid, sender, message, received_at, created_at, read_at, tags"
+
+func init() {
+	queries["insertInbound"] = "INSERT INTO inbound(uuid, sender, message, received_at, created_at)" +
+		" VALUES(?, ?, ?, ?, ?)"
+	queries["listConversations"] = "SELECT number, MAX(at), SUM(unread) FROM (" +
+		"SELECT mobile AS number, created_at AS at, 0 AS unread FROM messages" +
+		" UNION ALL SELECT sender, created_at, CASE WHEN read_at IS NULL THEN 1 ELSE 0 END FROM inbound" +
+		") AS activity GROUP BY number ORDER BY MAX(at) DESC LIMIT ?"
+	queries["getOutboundByNumber"] = "SELECT " + messageColumns + " FROM messages" +
+		" WHERE mobile = ? ORDER BY created_at DESC LIMIT ?"
+	queries["getInboundByNumber"] = "SELECT " + inboundColumns + " FROM inbound" +
+		" WHERE sender = ? ORDER BY created_at DESC LIMIT ?"
+	queries["getInbound"] = "SELECT " + inboundColumns + " FROM inbound WHERE uuid = ?"
+	queries["markInboundRead"] = "UPDATE inbound SET read_at = ? WHERE sender = ? AND read_at IS NULL"
+	queries["getInboundTags"] = "SELECT tags FROM inbound WHERE uuid = ?"
+	queries["updateInboundTags"] = "UPDATE inbound SET tags = ? WHERE uuid = ?"
+}
+
+func (s *sqlStore) InsertInbound(msg *common.Inbound) error {
+	log.Printf("InsertInbound: %#v", msg)
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now().UTC()
+	}
+	_, err := s.stmts["insertInbound"].Exec(msg.UUID, msg.Sender, msg.Body, msg.ReceivedAt.UTC(), msg.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("InsertInbound: %s", err.Error())
+	}
+	return nil
+}
+
+// ListConversations returns the numbers messages were exchanged with, most
+// recently active first.
+func (s *sqlStore) ListConversations(limit int) ([]common.Conversation, error) {
+	var conversations []common.Conversation
+	rows, err := s.stmts["listConversations"].Query(limit)
+	if err != nil {
+		return conversations, fmt.Errorf("ListConversations: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c common.Conversation
+		var last anyTime
+		err = rows.Scan(&c.Number, &last, &c.Unread)
+		if err != nil {
+			return conversations, fmt.Errorf("ListConversations: %s", err.Error())
+		}
+		c.LastActivity = last.Time
+		conversations = append(conversations, c)
+	}
+	return conversations, rows.Err()
+}
+
+// GetConversation returns up to limit of the latest outbound and inbound
+// messages exchanged with number, each newest first.
+func (s *sqlStore) GetConversation(number string, limit int) ([]common.SMS, []common.Inbound, error) {
+	outbound, err := s.queryMessages("getOutboundByNumber", number, limit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("GetConversation: %s", err.Error())
+	}
+	var inbound []common.Inbound
+	rows, err := s.stmts["getInboundByNumber"].Query(number, limit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("GetConversation: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := scanInbound(rows)
+		if err != nil {
+			return nil, nil, fmt.Errorf("GetConversation: %s", err.Error())
+		}
+		inbound = append(inbound, msg)
+	}
+	return outbound, inbound, rows.Err()
+}
+
+// GetInbound returns a received message, ErrNotFound for an unknown uuid.
+func (s *sqlStore) GetInbound(uuid string) (common.Inbound, error) {
+	msg, err := scanInbound(s.stmts["getInbound"].QueryRow(uuid))
+	if err == sql.ErrNoRows {
+		return msg, ErrNotFound
+	} else if err != nil {
+		return msg, fmt.Errorf("GetInbound: %s", err.Error())
+	}
+	return msg, nil
+}
+
+func scanInbound(row scanner) (common.Inbound, error) {
+	var msg common.Inbound
+	var tags string
+	err := row.Scan(&msg.UUID, &msg.Sender, &msg.Body, &msg.ReceivedAt, &msg.CreatedAt, &msg.ReadAt, &tags)
+	if err != nil {
+		return msg, err
+	}
+	msg.Tags = splitTags(tags)
+	return msg, nil
+}
+
+func (s *sqlStore) MarkInboundRead(number string) error {
+	_, err := s.stmts["markInboundRead"].Exec(time.Now().UTC(), number)
+	if err != nil {
+		return fmt.Errorf("MarkInboundRead: %s", err.Error())
+	}
+	return nil
+}
+
+// TagInbound adds tags to a received message, returns ErrNotFound for an
+// unknown uuid.
+func (s *sqlStore) TagInbound(uuid string, tags []string) error {
+	log.Printf("TagInbound: %#v %#v", uuid, tags)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("TagInbound: %s", err.Error())
+	}
+	var current string
+	err = tx.Stmt(s.stmts["getInboundTags"]).QueryRow(uuid).Scan(&current)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return ErrNotFound
+	} else if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("TagInbound: %s", err.Error())
+	}
+	merged := splitTags(current)
+	for _, tag := range tags {
+		found := false
+		for _, existing := range merged {
+			found = found || existing == tag
+		}
+		if !found {
+			merged = append(merged, tag)
+		}
+	}
+	_, err = tx.Stmt(s.stmts["updateInboundTags"]).Exec(strings.Join(merged, ","), uuid)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("TagInbound: %s", err.Error())
+	}
+	return tx.Commit()
+}
+
+// splitTags parses the comma separated tags column.
+func splitTags(tags string) []string {
+	if tags == "" {
+		return []string{}
+	}
+	return strings.Split(tags, ",")
+}
+
+// anyTime scans timestamps which sqlite returns as text when the column type
+// is lost, e.g. in aggregates.
+type anyTime struct {
+	Time time.Time
+}
+
+func (t *anyTime) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case time.Time:
+		t.Time = v
+		return nil
+	case []byte:
+		return t.parse(string(v))
+	case string:
+		return t.parse(v)
+	case nil:
+		t.Time = time.Time{}
+		return nil
+	}
+	return fmt.Errorf("anyTime: cannot scan %T", src)
+}
+
+var timestampFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+func (t *anyTime) parse(s string) error {
+	for _, format := range timestampFormats {
+		parsed, err := time.ParseInLocation(format, s, time.UTC)
+		if err == nil {
+			t.Time = parsed
+			return nil
+		}
+	}
+	return fmt.Errorf("anyTime: cannot parse %#v", s)
+}
@@ -2,115 +2,370 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"strconv"
+	"time"
 
 	"github.com/alexgear/sms/common"
-	_ "github.com/mattn/go-sqlite3"
 )
 
-var db *sql.DB
 var err error
 
-func InitDB(dbname string) (*sql.DB, error) {
-	_, err = os.Stat(dbname)
-	if os.IsNotExist(err) {
-		log.Printf("InitDB: database does not exist %s", dbname)
-	}
-	db, err = sql.Open("sqlite3", dbname)
+// ErrNotFound is returned when a requested row does not exist.
+var ErrNotFound = errors.New("not found")
+
+const messageColumns = "uuid, message, mobile, status, retries, client, reference, client_ref, metadata," +
+	" priority, due_at, quiet_hours, time_zone, created_at, updated_at, callback, ignore_suppression"
+
+// pendingStatuses are retried until they run out of retries
+var pendingStatuses = "status IN ('pending', 'error') AND retries < " + strconv.Itoa(common.MaxAttempts)
+
+// queries are prepared once by InitDB and referenced by name. Placeholders
+// are written as ? and rebound for the dialect.
+var queries = map[string]string{
+	"insertMessage": "INSERT INTO messages(uuid, message, mobile, status, client, client_ref, metadata, priority," +
+		" due_at, quiet_hours, time_zone, created_at, callback, ignore_suppression)" +
+		" VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+	"updateMessageStatus": "UPDATE messages SET status = ?, retries = ?, reference = ?, due_at = ?, updated_at = ?," +
+		" claimed_by = NULL, claimed_at = NULL WHERE uuid = ?",
+	"getMessageByUuid": "SELECT " + messageColumns + " FROM messages WHERE uuid = ?",
+	"getPendingMessages": "SELECT " + messageColumns + " FROM messages" +
+		" WHERE " + pendingStatuses + " ORDER BY priority, id",
+	"getClaimedMessages": "SELECT " + messageColumns + " FROM messages" +
+		" WHERE claimed_by = ? ORDER BY priority, id",
+	"getNextDue": "SELECT due_at FROM messages" +
+		" WHERE " + pendingStatuses + " AND (claimed_by IS NULL OR claimed_at < ?) ORDER BY due_at LIMIT 1",
+	// a message is counted at the time it was sent, not of its last update
+	"countSentMessages": "SELECT COUNT(*) FROM message_events" +
+		" WHERE event = 'sent' AND created_at >= ? AND created_at < ?",
+	// references of SMPP transports are prefixed with their name
+	"getModemSendTimes": "SELECT updated_at FROM messages" +
+		" WHERE status IN ('sent', 'delivered', 'undelivered') AND reference NOT LIKE '%:%' AND updated_at >= ?" +
+		" ORDER BY updated_at",
+	"insertEvent": "INSERT INTO message_events(uuid, event, attempt, detail, code, reference, created_at)" +
+		" VALUES(?, ?, ?, ?, ?, ?, ?)",
+	"insertClaimedEvents": "INSERT INTO message_events(uuid, event, detail, created_at)" +
+		" SELECT uuid, 'claimed', ?, ? FROM messages WHERE claimed_by = ?",
+	"getEvents": "SELECT event, attempt, detail, code, reference, created_at FROM message_events" +
+		" WHERE uuid = ? ORDER BY id",
+	"getSentByReference": "SELECT uuid FROM messages" +
+		" WHERE reference = ? AND status = 'sent' AND updated_at >= ? ORDER BY id DESC LIMIT 1",
+	"updateStatus":  "UPDATE messages SET status = ?, updated_at = ? WHERE uuid = ?",
+	"insertBalance": "INSERT INTO balances(amount, currency, raw, created_at) VALUES(?, ?, ?, ?)",
+	"getBalances": "SELECT amount, currency, raw, created_at FROM balances" +
+		" WHERE created_at >= ? AND created_at < ? ORDER BY created_at",
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// messageFields returns scan destinations matching messageColumns.
+func messageFields(sms *common.SMS) []interface{} {
+	return []interface{}{&sms.UUID, &sms.Body, &sms.Mobile, &sms.Status, &sms.Retries,
+		&sms.Client, &sms.Reference, &sms.ClientRef, (*[]byte)(&sms.Metadata), &sms.Priority,
+		&sms.DueAt, &sms.QuietHours, &sms.TimeZone, &sms.CreatedAt, &sms.UpdatedAt, (*[]byte)(&sms.Callback),
+		&sms.IgnoreSuppression}
+}
+
+func scanMessage(row scanner) (common.SMS, error) {
+	var sms common.SMS
+	err := row.Scan(messageFields(&sms)...)
+	return sms, err
+}
+
+func (s *sqlStore) queryMessages(name string, args ...interface{}) ([]common.SMS, error) {
+	var messages []common.SMS
+	rows, err := s.stmts[name].Query(args...)
 	if err != nil {
-		return nil, fmt.Errorf("InitDB: Error creating database. %s", err.Error())
+		return messages, err
 	}
-	err = syncDB()
-	if err != nil {
-		return nil, fmt.Errorf("InitDB: Error syncing database. %s", err.Error())
+	defer rows.Close()
+
+	for rows.Next() {
+		sms, err := scanMessage(rows)
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, sms)
 	}
-	return db, nil
+	return messages, rows.Err()
+}
+
+func (s *sqlStore) InsertMessage(sms *common.SMS) error {
+	return s.InsertMessages([]*common.SMS{sms})
 }
 
-func syncDB() error {
-	query := `CREATE TABLE IF NOT EXISTS messages (` +
-		`id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,` +
-		`uuid char(32) UNIQUE NOT NULL,` +
-		`message char(160) NOT NULL,` +
-		`mobile char(15) NOT NULL,` +
-		`status char(15) NOT NULL,` +
-		`retries INTEGER DEFAULT 0,` +
-		`created_at TIMESTAMP default CURRENT_TIMESTAMP,` +
-		`updated_at TIMESTAMP);`
-	_, err = db.Exec(query, nil)
+// InsertMessages inserts all of messages or, on error, none.
+func (s *sqlStore) InsertMessages(messages []*common.SMS) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return fmt.Errorf("syncDB: %s", err.Error())
+		return fmt.Errorf("InsertMessages: Failed to begin transaction. %s", err.Error())
 	}
+	for _, sms := range messages {
+		log.Printf("InsertMessage: %#v", sms)
+		if sms.CreatedAt.IsZero() {
+			sms.CreatedAt = time.Now().UTC()
+		}
+		err = s.insertMessage(tx, sms)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("InsertMessages: Failed to execute transaction. %s", err.Error())
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("InsertMessages: %s", err.Error())
+	}
+	s.wake()
 	return nil
 }
 
-func InsertMessage(sms *common.SMS) error {
-	log.Printf("InsertMessage: %#v", sms)
-	stmt, err := db.Prepare("INSERT INTO messages(uuid, message, mobile, status) VALUES(?, ?, ?, ?)")
-	defer stmt.Close()
-	if err != nil {
-		return fmt.Errorf("InsertMessage: Failed to prepare transaction. %s", err.Error())
+// insertMessage inserts the message and its queued event in tx.
+func (s *sqlStore) insertMessage(tx *sql.Tx, sms *common.SMS) error {
+	if len(sms.Metadata) == 0 {
+		sms.Metadata = json.RawMessage("{}")
+	}
+	if sms.DueAt.IsZero() {
+		sms.DueAt = sms.CreatedAt
 	}
-	_, err = stmt.Exec(sms.UUID, sms.Body, sms.Mobile, sms.Status)
+	_, err := tx.Stmt(s.stmts["insertMessage"]).Exec(sms.UUID, sms.Body, sms.Mobile, sms.Status, sms.Client,
+		sms.ClientRef, string(sms.Metadata), sms.Priority, sms.DueAt.UTC(), sms.QuietHours, sms.TimeZone, sms.CreatedAt.UTC(),
+		string(sms.Callback), sms.IgnoreSuppression)
 	if err != nil {
-		return fmt.Errorf("InsertMessage: Failed to execute transaction. %s", err.Error())
+		return err
 	}
-	return nil
+	return s.insertEvent(tx.Stmt(s.stmts["insertEvent"]), sms.UUID, common.Event{Event: common.EventQueued, Time: sms.CreatedAt})
 }
 
-//TODO: locks for driver.Stmt (stmt) and driver.Conn (db)
-func UpdateMessageStatus(sms common.SMS) error {
+// UpdateMessageStatus also releases the claim on the message. A pending
+// message is due again at sms.DueAt, right away if it is zero.
+func (s *sqlStore) UpdateMessageStatus(sms common.SMS) error {
 	log.Printf("Updating msg status %#v", sms)
-	stmt, err := db.Prepare("UPDATE messages SET status=?, retries=?, updated_at=DATETIME('now') WHERE uuid=?")
-	defer stmt.Close()
+	now := time.Now().UTC()
+	if sms.DueAt.IsZero() {
+		sms.DueAt = now
+	}
+	_, err := s.stmts["updateMessageStatus"].Exec(sms.Status, sms.Retries, sms.Reference, sms.DueAt.UTC(), now, sms.UUID)
 	if err != nil {
 		return fmt.Errorf("UpdateMessageStatus: %s", err.Error())
 	}
-	_, err = stmt.Exec(sms.Status, sms.Retries, sms.UUID)
+	return nil
+}
+
+// GetMessageByUuid returns ErrNotFound for an unknown uuid.
+func (s *sqlStore) GetMessageByUuid(uuid string) (common.SMS, error) {
+	log.Printf("GetMessageByUuid: %#v", uuid)
+	sms, err := scanMessage(s.stmts["getMessageByUuid"].QueryRow(uuid))
+	if err == sql.ErrNoRows {
+		return sms, ErrNotFound
+	} else if err != nil {
+		return sms, fmt.Errorf("GetMessageByUuid: %s", err.Error())
+	}
+	return sms, nil
+}
+
+func (s *sqlStore) GetPendingMessages() ([]common.SMS, error) {
+	log.Println("GetPendingMessages")
+	messages, err := s.queryMessages("getPendingMessages")
 	if err != nil {
-		return fmt.Errorf("UpdateMessageStatus: %s", err.Error())
+		return messages, fmt.Errorf("GetPendingMessages: %s", err.Error())
+	}
+	return messages, nil
+}
+
+func (s *sqlStore) ClaimPendingMessages(owner string, limit int, maxPriority int) ([]common.SMS, error) {
+	now := time.Now().UTC()
+	// unique per call, so that only rows claimed right now are returned
+	token := owner + "/" + strconv.FormatInt(now.UnixNano(), 36)
+	// the claim and its events are recorded together
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("ClaimPendingMessages: %s", err.Error())
+	}
+	_, err = tx.Stmt(s.stmts["claimMessages"]).Exec(token, now, now, now.Add(-claimTimeout), maxPriority, limit)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("ClaimPendingMessages: %s", err.Error())
+	}
+	_, err = tx.Stmt(s.stmts["insertClaimedEvents"]).Exec(owner, now, token)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("ClaimPendingMessages: %s", err.Error())
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("ClaimPendingMessages: %s", err.Error())
+	}
+	messages, err := s.queryMessages("getClaimedMessages", token)
+	if err != nil {
+		return messages, fmt.Errorf("ClaimPendingMessages: %s", err.Error())
+	}
+	return messages, nil
+}
+
+// NextDue returns when the next unclaimed pending message is due, zero if
+// there is none.
+func (s *sqlStore) NextDue() (time.Time, error) {
+	var due time.Time
+	err := s.stmts["getNextDue"].QueryRow(time.Now().UTC().Add(-claimTimeout)).Scan(&due)
+	if err == sql.ErrNoRows {
+		return due, nil
+	} else if err != nil {
+		return due, fmt.Errorf("NextDue: %s", err.Error())
+	}
+	return due, nil
+}
+
+// Wakeup is signalled after a message is queued.
+func (s *sqlStore) Wakeup() <-chan struct{} {
+	return s.wakeup
+}
+
+// wake signals Wakeup without blocking, pending signals are coalesced.
+func (s *sqlStore) wake() {
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (s *sqlStore) InsertBalance(balance *common.Balance) error {
+	log.Printf("InsertBalance: %#v", balance)
+	_, err := s.stmts["insertBalance"].Exec(balance.Amount, balance.Currency, balance.Raw, balance.Time.UTC())
+	if err != nil {
+		return fmt.Errorf("InsertBalance: Failed to execute transaction. %s", err.Error())
 	}
 	return nil
 }
 
-func GetMessageByUuid(uuid string) (common.SMS, error) {
-	log.Println("GetMessageById:", uuid)
-	var sms common.SMS
-	query := fmt.Sprintf("SELECT uuid, message, mobile, status, retries FROM"+
-		" messages WHERE uuid == \"%s\"", uuid)
+// GetBalances returns balance readings taken in [from, to) ordered by time.
+func (s *sqlStore) GetBalances(from time.Time, to time.Time) ([]common.Balance, error) {
+	log.Println("GetBalances:", from, to)
+	var balances []common.Balance
+	rows, err := s.stmts["getBalances"].Query(from.UTC(), to.UTC())
+	if err != nil {
+		return balances, fmt.Errorf("GetBalances: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		balance := common.Balance{}
+		err = rows.Scan(&balance.Amount, &balance.Currency, &balance.Raw, &balance.Time)
+		if err != nil {
+			return balances, fmt.Errorf("GetBalances: %s", err.Error())
+		}
+		balances = append(balances, balance)
+	}
+	return balances, rows.Err()
+}
 
-	rows, err := db.Query(query)
+// CountSentMessages returns the number of messages sent in [from, to).
+func (s *sqlStore) CountSentMessages(from time.Time, to time.Time) (int, error) {
+	var count int
+	err := s.stmts["countSentMessages"].QueryRow(from.UTC(), to.UTC()).Scan(&count)
 	if err != nil {
-		return sms, fmt.Errorf("GetMessageByUuid: %s", err.Error())
+		return 0, fmt.Errorf("CountSentMessages: %s", err.Error())
+	}
+	return count, nil
+}
+
+// GetModemSendTimes returns the times of messages sent by the modem since
+// from, oldest first.
+func (s *sqlStore) GetModemSendTimes(from time.Time) ([]time.Time, error) {
+	var times []time.Time
+	rows, err := s.stmts["getModemSendTimes"].Query(from.UTC())
+	if err != nil {
+		return times, fmt.Errorf("GetModemSendTimes: %s", err.Error())
 	}
 	defer rows.Close()
-	if rows.Next() {
-		rows.Scan(&sms.UUID, &sms.Body, &sms.Mobile, &sms.Status, &sms.Retries)
-	} else {
-		return sms, fmt.Errorf("GetMessageByUuid: Failed to get message %s", uuid)
+
+	for rows.Next() {
+		var t time.Time
+		err = rows.Scan(&t)
+		if err != nil {
+			return times, fmt.Errorf("GetModemSendTimes: %s", err.Error())
+		}
+		times = append(times, t)
 	}
-	return sms, nil
+	return times, rows.Err()
 }
 
-func GetPendingMessages() ([]common.SMS, error) {
-	log.Println("GetPendingMessages")
-	var messages []common.SMS
-	query := "SELECT uuid, message, mobile, status, retries FROM" +
-		" messages WHERE status != \"sent\" AND retries < 3"
+type execer interface {
+	Exec(args ...interface{}) (sql.Result, error)
+}
 
-	rows, err := db.Query(query)
+func (s *sqlStore) insertEvent(stmt execer, uuid string, event common.Event) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	_, err := stmt.Exec(uuid, event.Event, event.Attempt, event.Detail, event.Code, event.Reference, event.Time.UTC())
+	return err
+}
+
+func (s *sqlStore) InsertEvent(uuid string, event common.Event) error {
+	log.Printf("InsertEvent: %s %#v", uuid, event)
+	err := s.insertEvent(s.stmts["insertEvent"], uuid, event)
 	if err != nil {
-		return messages, fmt.Errorf("GetPendingMessages: %s", err.Error())
+		return fmt.Errorf("InsertEvent: %s", err.Error())
+	}
+	return nil
+}
+
+// GetEvents returns the events of a message in the order they happened.
+func (s *sqlStore) GetEvents(uuid string) ([]common.Event, error) {
+	var events []common.Event
+	rows, err := s.stmts["getEvents"].Query(uuid)
+	if err != nil {
+		return events, fmt.Errorf("GetEvents: %s", err.Error())
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		sms := common.SMS{}
-		rows.Scan(&sms.UUID, &sms.Body, &sms.Mobile, &sms.Status, &sms.Retries)
-		messages = append(messages, sms)
+		var event common.Event
+		err = rows.Scan(&event.Event, &event.Attempt, &event.Detail, &event.Code, &event.Reference, &event.Time)
+		if err != nil {
+			return events, fmt.Errorf("GetEvents: %s", err.Error())
+		}
+		events = append(events, event)
 	}
-	//rows.Close()
-	return messages, nil
+	return events, rows.Err()
+}
+
+// MarkDelivered applies a status report to the last message sent with
+// reference. References wrap around, so only messages sent within
+// referenceLifetime are considered. Returns ErrNotFound if there is none.
+func (s *sqlStore) MarkDelivered(reference string, delivered bool, detail string) (string, error) {
+	var uuid string
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("MarkDelivered: %s", err.Error())
+	}
+	now := time.Now().UTC()
+	err = tx.Stmt(s.stmts["getSentByReference"]).QueryRow(reference, now.Add(-referenceLifetime)).Scan(&uuid)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return "", ErrNotFound
+	} else if err != nil {
+		tx.Rollback()
+		return "", fmt.Errorf("MarkDelivered: %s", err.Error())
+	}
+	event := common.Event{Event: common.EventDelivered, Detail: detail, Reference: reference, Time: now}
+	if !delivered {
+		event.Event = common.EventUndelivered
+	}
+	_, err = tx.Stmt(s.stmts["updateStatus"]).Exec(event.Event, now, uuid)
+	if err != nil {
+		tx.Rollback()
+		return "", fmt.Errorf("MarkDelivered: %s", err.Error())
+	}
+	err = s.insertEvent(tx.Stmt(s.stmts["insertEvent"]), uuid, event)
+	if err != nil {
+		tx.Rollback()
+		return "", fmt.Errorf("MarkDelivered: %s", err.Error())
+	}
+	return uuid, tx.Commit()
 }
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alexgear/sms/common"
+)
+
+func init() {
+	queries["deleteExpiredKeys"] = "DELETE FROM idempotency_keys WHERE created_at < ?"
+	queries["getKey"] = "SELECT uuid FROM idempotency_keys WHERE client = ? AND idempotency_key = ?"
+	queries["insertKey"] = "INSERT INTO idempotency_keys(client, idempotency_key, uuid, created_at) VALUES(?, ?, ?, ?)"
+}
+
+// InsertMessageOnce forgets keys older than window before looking key up.
+func (s *sqlStore) InsertMessageOnce(sms *common.SMS, key string, window time.Duration) (bool, error) {
+	log.Printf("InsertMessageOnce: %#v %#v", key, sms)
+	if sms.CreatedAt.IsZero() {
+		sms.CreatedAt = time.Now().UTC()
+	}
+	created, err := s.insertMessageOnce(sms, key, window)
+	if err != nil {
+		// a concurrent request may have inserted the key, look it up again
+		existing, lookupErr := s.messageByKey(nil, sms.Client, key)
+		if lookupErr == nil {
+			*sms = existing
+			return false, nil
+		}
+		return false, fmt.Errorf("InsertMessageOnce: %s", err.Error())
+	}
+	if created {
+		s.wake()
+	}
+	return created, nil
+}
+
+func (s *sqlStore) insertMessageOnce(sms *common.SMS, key string, window time.Duration) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Stmt(s.stmts["deleteExpiredKeys"]).Exec(sms.CreatedAt.Add(-window).UTC())
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	existing, err := s.messageByKey(tx, sms.Client, key)
+	if err == nil {
+		tx.Rollback()
+		*sms = existing
+		return false, nil
+	} else if err != sql.ErrNoRows {
+		tx.Rollback()
+		return false, err
+	}
+	_, err = tx.Stmt(s.stmts["insertKey"]).Exec(sms.Client, key, sms.UUID, sms.CreatedAt.UTC())
+	if err == nil {
+		err = s.insertMessage(tx, sms)
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// messageByKey returns sql.ErrNoRows if the key is unknown. tx may be nil.
+func (s *sqlStore) messageByKey(tx *sql.Tx, client string, key string) (common.SMS, error) {
+	getKey, getMessage := s.stmts["getKey"], s.stmts["getMessageByUuid"]
+	if tx != nil {
+		getKey, getMessage = tx.Stmt(getKey), tx.Stmt(getMessage)
+	}
+	var uuid string
+	err := getKey.QueryRow(client, key).Scan(&uuid)
+	if err != nil {
+		return common.SMS{}, err
+	}
+	return scanMessage(getMessage.QueryRow(uuid))
+}
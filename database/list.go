@@ -0,0 +1,135 @@
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexgear/sms/common"
+)
+
+// MessageFilter selects messages for ListMessages, zero values match all.
+type MessageFilter struct {
+	Mobile string
+	Status string
+	Since  time.Time
+	Until  time.Time
+	// Body is a substring of the message text
+	Body      string
+	Client    string
+	ClientRef string
+	// Cursor is the next cursor returned by the previous page
+	Cursor string
+	Limit  int
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListMessages returns messages newest first and the cursor of the next page,
+// which is empty on the last page. The query depends on the filter so unlike
+// the other queries it is not prepared.
+func (s *sqlStore) ListMessages(filter MessageFilter) ([]common.SMS, string, error) {
+	var where []string
+	var args []interface{}
+	if filter.Mobile != "" {
+		where = append(where, "mobile = ?")
+		args = append(args, filter.Mobile)
+	}
+	if filter.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, filter.Until.UTC())
+	}
+	if filter.Body != "" {
+		where = append(where, `message LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(filter.Body)+"%")
+	}
+	if filter.Client != "" {
+		where = append(where, "client = ?")
+		args = append(args, filter.Client)
+	}
+	if filter.ClientRef != "" {
+		where = append(where, "client_ref = ?")
+		args = append(args, filter.ClientRef)
+	}
+	if filter.Cursor != "" {
+		createdAt, id, err := decodeCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		where = append(where, "(created_at < ? OR (created_at = ? AND id < ?))")
+		args = append(args, createdAt, createdAt, id)
+	}
+	query := "SELECT " + messageColumns + ", id FROM messages"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	// one more row than requested tells whether there is a next page
+	query += " ORDER BY created_at DESC, id DESC LIMIT ?"
+	args = append(args, filter.Limit+1)
+
+	rows, err := s.db.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("ListMessages: %s", err.Error())
+	}
+	defer rows.Close()
+	var messages []common.SMS
+	var cursor string
+	var lastID int64
+	for rows.Next() {
+		var sms common.SMS
+		var id int64
+		err = rows.Scan(append(messageFields(&sms), &id)...)
+		if err != nil {
+			return nil, "", fmt.Errorf("ListMessages: %s", err.Error())
+		}
+		if len(messages) == filter.Limit {
+			last := messages[len(messages)-1]
+			cursor = encodeCursor(last.CreatedAt, lastID)
+			break
+		}
+		messages = append(messages, sms)
+		lastID = id
+	}
+	return messages, cursor, rows.Err()
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// A cursor is the creation time and id of the last message on a page.
+func encodeCursor(createdAt time.Time, id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(
+		strconv.FormatInt(createdAt.UnixNano(), 10) + "," + strconv.FormatInt(id, 10)))
+}
+
+func decodeCursor(cursor string) (time.Time, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	parts := strings.Split(string(raw), ",")
+	if len(parts) != 2 {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	return time.Unix(0, nanos).UTC(), id, nil
+}
@@ -0,0 +1,635 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type migration struct {
+	Version     int
+	Description string
+	Up          string
+	Down        string
+}
+
+// Migrations are applied in order, append new ones to the end and never
+// edit a migration which has been released. Both dialects must have the
+// same versions.
+var sqliteMigrations = []migration{
+	{
+		Version:     1,
+		Description: "create messages",
+		Up: `CREATE TABLE IF NOT EXISTS messages (` +
+			`id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,` +
+			`uuid char(32) UNIQUE NOT NULL,` +
+			`message char(160) NOT NULL,` +
+			`mobile char(15) NOT NULL,` +
+			`status char(15) NOT NULL,` +
+			`retries INTEGER DEFAULT 0,` +
+			`created_at TIMESTAMP default CURRENT_TIMESTAMP,` +
+			`updated_at TIMESTAMP);`,
+		Down: `DROP TABLE messages;`,
+	},
+	{
+		Version:     2,
+		Description: "create balances",
+		Up: `CREATE TABLE IF NOT EXISTS balances (` +
+			`id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,` +
+			`amount REAL NOT NULL,` +
+			`currency char(8) NOT NULL,` +
+			`raw TEXT NOT NULL,` +
+			`created_at TIMESTAMP NOT NULL);`,
+		Down: `DROP TABLE balances;`,
+	},
+	{
+		Version:     3,
+		Description: "add message claims",
+		Up: `ALTER TABLE messages ADD COLUMN claimed_by TEXT;` +
+			`ALTER TABLE messages ADD COLUMN claimed_at TIMESTAMP;`,
+		Down: `ALTER TABLE messages DROP COLUMN claimed_by;` +
+			`ALTER TABLE messages DROP COLUMN claimed_at;`,
+	},
+	{
+		Version:     4,
+		Description: "add message client",
+		Up: `ALTER TABLE messages ADD COLUMN client TEXT NOT NULL DEFAULT '';` +
+			`CREATE INDEX messages_created_at ON messages (created_at);`,
+		Down: `DROP INDEX messages_created_at;` +
+			`ALTER TABLE messages DROP COLUMN client;`,
+	},
+	{
+		Version:     5,
+		Description: "create message events",
+		Up: `CREATE TABLE message_events (` +
+			`id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,` +
+			`uuid char(36) NOT NULL,` +
+			`event char(16) NOT NULL,` +
+			`attempt INTEGER NOT NULL DEFAULT 0,` +
+			`detail TEXT NOT NULL DEFAULT '',` +
+			`code char(16) NOT NULL DEFAULT '',` +
+			`reference TEXT NOT NULL DEFAULT '',` +
+			`created_at TIMESTAMP NOT NULL);` +
+			`CREATE INDEX message_events_uuid ON message_events (uuid);` +
+			`ALTER TABLE messages ADD COLUMN reference TEXT NOT NULL DEFAULT '';` +
+			`CREATE INDEX messages_reference ON messages (reference);`,
+		Down: `DROP INDEX messages_reference;` +
+			`ALTER TABLE messages DROP COLUMN reference;` +
+			`DROP TABLE message_events;`,
+	},
+	{
+		Version:     6,
+		Description: "create inbound",
+		Up: `CREATE TABLE inbound (` +
+			`id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,` +
+			`uuid char(36) UNIQUE NOT NULL,` +
+			`sender char(32) NOT NULL,` +
+			`message TEXT NOT NULL,` +
+			`received_at TIMESTAMP NOT NULL,` +
+			`created_at TIMESTAMP NOT NULL,` +
+			`read_at TIMESTAMP);` +
+			`CREATE INDEX inbound_sender ON inbound (sender, created_at);` +
+			`CREATE INDEX messages_mobile ON messages (mobile, created_at);`,
+		Down: `DROP INDEX messages_mobile;` +
+			`DROP TABLE inbound;`,
+	},
+	{
+		Version:     7,
+		Description: "create templates",
+		Up: `CREATE TABLE templates (` +
+			`id char(64) PRIMARY KEY NOT NULL,` +
+			`default_locale char(16) NOT NULL,` +
+			`created_at TIMESTAMP NOT NULL,` +
+			`updated_at TIMESTAMP NOT NULL);` +
+			`CREATE TABLE template_variants (` +
+			`template_id char(64) NOT NULL REFERENCES templates (id) ON DELETE CASCADE,` +
+			`locale char(16) NOT NULL,` +
+			`body TEXT NOT NULL,` +
+			`PRIMARY KEY (template_id, locale));`,
+		Down: `DROP TABLE template_variants;` +
+			`DROP TABLE templates;`,
+	},
+	{
+		Version:     8,
+		Description: "create contacts and groups",
+		Up: `CREATE TABLE contacts (` +
+			`uuid char(36) PRIMARY KEY NOT NULL,` +
+			`name TEXT NOT NULL DEFAULT '',` +
+			`number char(32) UNIQUE NOT NULL,` +
+			`locale char(16) NOT NULL DEFAULT '',` +
+			`attributes TEXT NOT NULL DEFAULT '{}',` +
+			`created_at TIMESTAMP NOT NULL,` +
+			`updated_at TIMESTAMP NOT NULL);` +
+			`CREATE TABLE contact_groups (` +
+			`id char(64) PRIMARY KEY NOT NULL,` +
+			`name TEXT NOT NULL DEFAULT '',` +
+			`created_at TIMESTAMP NOT NULL);` +
+			`CREATE TABLE contact_group_members (` +
+			`group_id char(64) NOT NULL REFERENCES contact_groups (id) ON DELETE CASCADE,` +
+			`contact_uuid char(36) NOT NULL REFERENCES contacts (uuid) ON DELETE CASCADE,` +
+			`PRIMARY KEY (group_id, contact_uuid));` +
+			`CREATE INDEX contact_group_members_contact ON contact_group_members (contact_uuid);`,
+		Down: `DROP TABLE contact_group_members;` +
+			`DROP TABLE contact_groups;` +
+			`DROP TABLE contacts;`,
+	},
+	{
+		Version:     9,
+		Description: "create suppressions",
+		Up: `CREATE TABLE suppressions (` +
+			`number char(32) PRIMARY KEY NOT NULL,` +
+			`source char(16) NOT NULL,` +
+			`detail TEXT NOT NULL DEFAULT '',` +
+			`created_at TIMESTAMP NOT NULL);`,
+		Down: `DROP TABLE suppressions;`,
+	},
+	{
+		Version:     10,
+		Description: "add inbound tags",
+		Up:          `ALTER TABLE inbound ADD COLUMN tags TEXT NOT NULL DEFAULT '';`,
+		Down:        `ALTER TABLE inbound DROP COLUMN tags;`,
+	},
+	{
+		Version:     11,
+		Description: "create idempotency keys",
+		Up: `CREATE TABLE idempotency_keys (` +
+			`client char(64) NOT NULL,` +
+			`idempotency_key char(255) NOT NULL,` +
+			`uuid char(36) NOT NULL,` +
+			`created_at TIMESTAMP NOT NULL,` +
+			`PRIMARY KEY (client, idempotency_key));` +
+			`CREATE INDEX idempotency_keys_created_at ON idempotency_keys (created_at);`,
+		Down: `DROP TABLE idempotency_keys;`,
+	},
+	{
+		Version:     12,
+		Description: "add message client_ref and metadata",
+		Up: `ALTER TABLE messages ADD COLUMN client_ref TEXT NOT NULL DEFAULT '';` +
+			`ALTER TABLE messages ADD COLUMN metadata TEXT NOT NULL DEFAULT '{}';` +
+			`CREATE INDEX messages_client_ref ON messages (client_ref);`,
+		Down: `DROP INDEX messages_client_ref;` +
+			`ALTER TABLE messages DROP COLUMN metadata;` +
+			`ALTER TABLE messages DROP COLUMN client_ref;`,
+	},
+	{
+		Version:     13,
+		Description: "add message priority",
+		Up: `ALTER TABLE messages ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;` +
+			`CREATE INDEX messages_priority ON messages (priority, id);`,
+		Down: `DROP INDEX messages_priority;` +
+			`ALTER TABLE messages DROP COLUMN priority;`,
+	},
+	{
+		Version:     14,
+		Description: "add message due time",
+		Up: `ALTER TABLE messages ADD COLUMN due_at TIMESTAMP;` +
+			`UPDATE messages SET due_at = created_at;` +
+			`CREATE INDEX messages_due_at ON messages (due_at);`,
+		Down: `DROP INDEX messages_due_at;` +
+			`ALTER TABLE messages DROP COLUMN due_at;`,
+	},
+	{
+		Version:     15,
+		Description: "add message quiet hours and time zone",
+		Up: `ALTER TABLE messages ADD COLUMN quiet_hours TEXT DEFAULT '';` +
+			`ALTER TABLE messages ADD COLUMN time_zone TEXT DEFAULT '';`,
+		Down: `ALTER TABLE messages DROP COLUMN time_zone;` +
+			`ALTER TABLE messages DROP COLUMN quiet_hours;`,
+	},
+	{
+		Version:     16,
+		Description: "add message callback",
+		Up:          `ALTER TABLE messages ADD COLUMN callback TEXT NOT NULL DEFAULT '';`,
+		Down:        `ALTER TABLE messages DROP COLUMN callback;`,
+	},
+	{
+		Version:     17,
+		Description: "add message ignore suppression",
+		Up:          `ALTER TABLE messages ADD COLUMN ignore_suppression BOOLEAN NOT NULL DEFAULT 0;`,
+		Down:        `ALTER TABLE messages DROP COLUMN ignore_suppression;`,
+	},
+	{
+		Version:     18,
+		Description: "create smpp deliveries",
+		Up: `CREATE TABLE smpp_deliveries (` +
+			`id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,` +
+			`system_id char(16) NOT NULL,` +
+			`uuid char(36) NOT NULL,` +
+			`body BLOB NOT NULL,` +
+			`attempts INTEGER NOT NULL DEFAULT 0,` +
+			`created_at TIMESTAMP NOT NULL);` +
+			`CREATE INDEX smpp_deliveries_system_id ON smpp_deliveries (system_id, id);`,
+		Down: `DROP TABLE smpp_deliveries;`,
+	},
+}
+
+var postgresMigrations = []migration{
+	{
+		Version:     1,
+		Description: "create messages",
+		Up: `CREATE TABLE IF NOT EXISTS messages (` +
+			`id BIGSERIAL PRIMARY KEY,` +
+			`uuid VARCHAR(36) UNIQUE NOT NULL,` +
+			`message TEXT NOT NULL,` +
+			`mobile VARCHAR(32) NOT NULL,` +
+			`status VARCHAR(16) NOT NULL,` +
+			`retries INTEGER DEFAULT 0,` +
+			`created_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc'),` +
+			`updated_at TIMESTAMP);`,
+		Down: `DROP TABLE messages;`,
+	},
+	{
+		Version:     2,
+		Description: "create balances",
+		Up: `CREATE TABLE IF NOT EXISTS balances (` +
+			`id BIGSERIAL PRIMARY KEY,` +
+			`amount DOUBLE PRECISION NOT NULL,` +
+			`currency VARCHAR(8) NOT NULL,` +
+			`raw TEXT NOT NULL,` +
+			`created_at TIMESTAMP NOT NULL);`,
+		Down: `DROP TABLE balances;`,
+	},
+	{
+		Version:     3,
+		Description: "add message claims",
+		Up: `ALTER TABLE messages ADD COLUMN claimed_by TEXT;` +
+			`ALTER TABLE messages ADD COLUMN claimed_at TIMESTAMP;` +
+			`CREATE INDEX messages_pending ON messages (status, retries);`,
+		Down: `DROP INDEX messages_pending;` +
+			`ALTER TABLE messages DROP COLUMN claimed_by;` +
+			`ALTER TABLE messages DROP COLUMN claimed_at;`,
+	},
+	{
+		Version:     4,
+		Description: "add message client",
+		Up: `ALTER TABLE messages ADD COLUMN client TEXT NOT NULL DEFAULT '';` +
+			`CREATE INDEX messages_created_at ON messages (created_at);`,
+		Down: `DROP INDEX messages_created_at;` +
+			`ALTER TABLE messages DROP COLUMN client;`,
+	},
+	{
+		Version:     5,
+		Description: "create message events",
+		Up: `CREATE TABLE message_events (` +
+			`id BIGSERIAL PRIMARY KEY,` +
+			`uuid VARCHAR(36) NOT NULL,` +
+			`event VARCHAR(16) NOT NULL,` +
+			`attempt INTEGER NOT NULL DEFAULT 0,` +
+			`detail TEXT NOT NULL DEFAULT '',` +
+			`code VARCHAR(16) NOT NULL DEFAULT '',` +
+			`reference TEXT NOT NULL DEFAULT '',` +
+			`created_at TIMESTAMP NOT NULL);` +
+			`CREATE INDEX message_events_uuid ON message_events (uuid);` +
+			`ALTER TABLE messages ADD COLUMN reference TEXT NOT NULL DEFAULT '';` +
+			`CREATE INDEX messages_reference ON messages (reference);`,
+		Down: `DROP INDEX messages_reference;` +
+			`ALTER TABLE messages DROP COLUMN reference;` +
+			`DROP TABLE message_events;`,
+	},
+	{
+		Version:     6,
+		Description: "create inbound",
+		Up: `CREATE TABLE inbound (` +
+			`id BIGSERIAL PRIMARY KEY,` +
+			`uuid VARCHAR(36) UNIQUE NOT NULL,` +
+			`sender VARCHAR(32) NOT NULL,` +
+			`message TEXT NOT NULL,` +
+			`received_at TIMESTAMP NOT NULL,` +
+			`created_at TIMESTAMP NOT NULL,` +
+			`read_at TIMESTAMP);` +
+			`CREATE INDEX inbound_sender ON inbound (sender, created_at);` +
+			`CREATE INDEX messages_mobile ON messages (mobile, created_at);`,
+		Down: `DROP INDEX messages_mobile;` +
+			`DROP TABLE inbound;`,
+	},
+	{
+		Version:     7,
+		Description: "create templates",
+		Up: `CREATE TABLE templates (` +
+			`id VARCHAR(64) PRIMARY KEY NOT NULL,` +
+			`default_locale VARCHAR(16) NOT NULL,` +
+			`created_at TIMESTAMP NOT NULL,` +
+			`updated_at TIMESTAMP NOT NULL);` +
+			`CREATE TABLE template_variants (` +
+			`template_id VARCHAR(64) NOT NULL REFERENCES templates (id) ON DELETE CASCADE,` +
+			`locale VARCHAR(16) NOT NULL,` +
+			`body TEXT NOT NULL,` +
+			`PRIMARY KEY (template_id, locale));`,
+		Down: `DROP TABLE template_variants;` +
+			`DROP TABLE templates;`,
+	},
+	{
+		Version:     8,
+		Description: "create contacts and groups",
+		Up: `CREATE TABLE contacts (` +
+			`uuid VARCHAR(36) PRIMARY KEY NOT NULL,` +
+			`name TEXT NOT NULL DEFAULT '',` +
+			`number VARCHAR(32) UNIQUE NOT NULL,` +
+			`locale VARCHAR(16) NOT NULL DEFAULT '',` +
+			`attributes TEXT NOT NULL DEFAULT '{}',` +
+			`created_at TIMESTAMP NOT NULL,` +
+			`updated_at TIMESTAMP NOT NULL);` +
+			`CREATE TABLE contact_groups (` +
+			`id VARCHAR(64) PRIMARY KEY NOT NULL,` +
+			`name TEXT NOT NULL DEFAULT '',` +
+			`created_at TIMESTAMP NOT NULL);` +
+			`CREATE TABLE contact_group_members (` +
+			`group_id VARCHAR(64) NOT NULL REFERENCES contact_groups (id) ON DELETE CASCADE,` +
+			`contact_uuid VARCHAR(36) NOT NULL REFERENCES contacts (uuid) ON DELETE CASCADE,` +
+			`PRIMARY KEY (group_id, contact_uuid));` +
+			`CREATE INDEX contact_group_members_contact ON contact_group_members (contact_uuid);`,
+		Down: `DROP TABLE contact_group_members;` +
+			`DROP TABLE contact_groups;` +
+			`DROP TABLE contacts;`,
+	},
+	{
+		Version:     9,
+		Description: "create suppressions",
+		Up: `CREATE TABLE suppressions (` +
+			`number VARCHAR(32) PRIMARY KEY NOT NULL,` +
+			`source VARCHAR(16) NOT NULL,` +
+			`detail TEXT NOT NULL DEFAULT '',` +
+			`created_at TIMESTAMP NOT NULL);`,
+		Down: `DROP TABLE suppressions;`,
+	},
+	{
+		Version:     10,
+		Description: "add inbound tags",
+		Up:          `ALTER TABLE inbound ADD COLUMN tags TEXT NOT NULL DEFAULT '';`,
+		Down:        `ALTER TABLE inbound DROP COLUMN tags;`,
+	},
+	{
+		Version:     11,
+		Description: "create idempotency keys",
+		Up: `CREATE TABLE idempotency_keys (` +
+			`client VARCHAR(64) NOT NULL,` +
+			`idempotency_key VARCHAR(255) NOT NULL,` +
+			`uuid VARCHAR(36) NOT NULL,` +
+			`created_at TIMESTAMP NOT NULL,` +
+			`PRIMARY KEY (client, idempotency_key));` +
+			`CREATE INDEX idempotency_keys_created_at ON idempotency_keys (created_at);`,
+		Down: `DROP TABLE idempotency_keys;`,
+	},
+	{
+		Version:     12,
+		Description: "add message client_ref and metadata",
+		Up: `ALTER TABLE messages ADD COLUMN client_ref TEXT NOT NULL DEFAULT '';` +
+			`ALTER TABLE messages ADD COLUMN metadata TEXT NOT NULL DEFAULT '{}';` +
+			`CREATE INDEX messages_client_ref ON messages (client_ref);`,
+		Down: `DROP INDEX messages_client_ref;` +
+			`ALTER TABLE messages DROP COLUMN metadata;` +
+			`ALTER TABLE messages DROP COLUMN client_ref;`,
+	},
+	{
+		Version:     13,
+		Description: "add message priority",
+		Up: `ALTER TABLE messages ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;` +
+			`CREATE INDEX messages_priority ON messages (priority, id);`,
+		Down: `DROP INDEX messages_priority;` +
+			`ALTER TABLE messages DROP COLUMN priority;`,
+	},
+	{
+		Version:     14,
+		Description: "add message due time",
+		Up: `ALTER TABLE messages ADD COLUMN due_at TIMESTAMP;` +
+			`UPDATE messages SET due_at = created_at;` +
+			`CREATE INDEX messages_due_at ON messages (due_at);`,
+		Down: `DROP INDEX messages_due_at;` +
+			`ALTER TABLE messages DROP COLUMN due_at;`,
+	},
+	{
+		Version:     15,
+		Description: "add message quiet hours and time zone",
+		Up: `ALTER TABLE messages ADD COLUMN quiet_hours TEXT DEFAULT '';` +
+			`ALTER TABLE messages ADD COLUMN time_zone TEXT DEFAULT '';`,
+		Down: `ALTER TABLE messages DROP COLUMN time_zone;` +
+			`ALTER TABLE messages DROP COLUMN quiet_hours;`,
+	},
+	{
+		Version:     16,
+		Description: "add message callback",
+		Up:          `ALTER TABLE messages ADD COLUMN callback TEXT NOT NULL DEFAULT '';`,
+		Down:        `ALTER TABLE messages DROP COLUMN callback;`,
+	},
+	{
+		Version:     17,
+		Description: "add message ignore suppression",
+		Up:          `ALTER TABLE messages ADD COLUMN ignore_suppression BOOLEAN NOT NULL DEFAULT FALSE;`,
+		Down:        `ALTER TABLE messages DROP COLUMN ignore_suppression;`,
+	},
+	{
+		Version:     18,
+		Description: "create smpp deliveries",
+		Up: `CREATE TABLE smpp_deliveries (` +
+			`id BIGSERIAL PRIMARY KEY,` +
+			`system_id VARCHAR(16) NOT NULL,` +
+			`uuid VARCHAR(36) NOT NULL,` +
+			`body BYTEA NOT NULL,` +
+			`attempts INTEGER NOT NULL DEFAULT 0,` +
+			`created_at TIMESTAMP NOT NULL);` +
+			`CREATE INDEX smpp_deliveries_system_id ON smpp_deliveries (system_id, id);`,
+		Down: `DROP TABLE smpp_deliveries;`,
+	},
+}
+
+// sqliteDropColumn is the first SQLite release supporting ALTER TABLE DROP
+// COLUMN, older ones cannot revert migrations adding columns.
+const sqliteDropColumn = "3.35.0"
+
+type MigrationStatus struct {
+	Version     int
+	Description string
+	AppliedAt   *time.Time
+}
+
+func (s *sqlStore) initSchemaVersion() error {
+	query := `CREATE TABLE IF NOT EXISTS schema_version (` +
+		`version INTEGER PRIMARY KEY NOT NULL,` +
+		`applied_at TIMESTAMP NOT NULL);`
+	_, err := s.db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("initSchemaVersion: %s", err.Error())
+	}
+	return nil
+}
+
+// SchemaVersion returns the version of the last applied migration, 0 for an
+// empty database.
+func (s *sqlStore) SchemaVersion() (int, error) {
+	var version int
+	err := s.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("SchemaVersion: %s", err.Error())
+	}
+	return version, nil
+}
+
+func (s *sqlStore) GetMigrationStatus() ([]MigrationStatus, error) {
+	applied := make(map[int]time.Time)
+	rows, err := s.db.Query("SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, fmt.Errorf("GetMigrationStatus: %s", err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, fmt.Errorf("GetMigrationStatus: %s", err.Error())
+		}
+		applied[version] = appliedAt
+	}
+	var status []MigrationStatus
+	for _, m := range s.dialect.Migrations {
+		ms := MigrationStatus{Version: m.Version, Description: m.Description}
+		if appliedAt, ok := applied[m.Version]; ok {
+			ms.AppliedAt = &appliedAt
+		}
+		status = append(status, ms)
+	}
+	return status, nil
+}
+
+// MigrateUp applies all pending migrations.
+func (s *sqlStore) MigrateUp() error {
+	migrations := s.dialect.Migrations
+	return s.MigrateTo(migrations[len(migrations)-1].Version)
+}
+
+// MigrateTo applies or reverts migrations until the schema is at version.
+// A backup of an sqlite database file is taken before anything is changed.
+func (s *sqlStore) MigrateTo(version int) error {
+	migrations := s.dialect.Migrations
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current == version {
+		return nil
+	}
+	if version < 0 || version > migrations[len(migrations)-1].Version {
+		return fmt.Errorf("MigrateTo: Unknown version %d", version)
+	}
+	if s.dialect == sqlite && version < current {
+		err = s.checkRevert(current, version)
+		if err != nil {
+			return fmt.Errorf("MigrateTo: %s", err.Error())
+		}
+	}
+	if s.existed {
+		err = s.backup(current)
+		if err != nil {
+			return fmt.Errorf("MigrateTo: Failed to backup database. %s", err.Error())
+		}
+	} else if s.dialect == postgres && current > 0 {
+		log.Printf("MigrateTo: migrating %s from %d to %d, make sure you have a backup", s.dialect.Name, current, version)
+	}
+	for _, m := range migrations {
+		if m.Version > current && m.Version <= version {
+			log.Printf("MigrateTo: applying %d %s", m.Version, m.Description)
+			err = s.runMigration(m.Up, "INSERT INTO schema_version(version, applied_at) VALUES(?, ?)", m.Version, time.Now().UTC())
+			if err != nil {
+				return fmt.Errorf("MigrateTo: Failed to apply %d. %s", m.Version, err.Error())
+			}
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version <= current && m.Version > version {
+			log.Printf("MigrateTo: reverting %d %s", m.Version, m.Description)
+			err = s.runMigration(m.Down, "DELETE FROM schema_version WHERE version = ?", m.Version)
+			if err != nil {
+				return fmt.Errorf("MigrateTo: Failed to revert %d. %s", m.Version, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// checkRevert fails before anything is reverted if the SQLite library is too
+// old to drop the columns of the migrations from current down to version.
+func (s *sqlStore) checkRevert(current int, version int) error {
+	var sqliteVersion string
+	err := s.db.QueryRow("SELECT sqlite_version()").Scan(&sqliteVersion)
+	if err != nil {
+		return err
+	}
+	if !versionBefore(sqliteVersion, sqliteDropColumn) {
+		return nil
+	}
+	for _, m := range s.dialect.Migrations {
+		if m.Version <= current && m.Version > version && strings.Contains(m.Down, "DROP COLUMN") {
+			return fmt.Errorf("SQLite %s cannot revert %d, it needs %s or later. Restore a backup instead",
+				sqliteVersion, m.Version, sqliteDropColumn)
+		}
+	}
+	return nil
+}
+
+// versionBefore reports whether the dotted version a is older than b.
+func versionBefore(a string, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			return x < y
+		}
+	}
+	return len(as) < len(bs)
+}
+
+func (s *sqlStore) runMigration(query string, versionQuery string, args ...interface{}) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(query)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(s.rebind(versionQuery), args...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// backup copies the database file next to itself, e.g.
+// db.sqlite.v2-20151102173406.bak
+func (s *sqlStore) backup(version int) error {
+	src, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	backupPath := fmt.Sprintf("%s.v%d-%s.bak", s.path, version, time.Now().Format("20060102150405"))
+	dst, err := os.OpenFile(backupPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	for i := 1; os.IsExist(err); i++ {
+		backupPath = fmt.Sprintf("%s.v%d-%s-%d.bak", s.path, version, time.Now().Format("20060102150405"), i)
+		dst, err = os.OpenFile(backupPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		return err
+	}
+	err = dst.Sync()
+	if err != nil {
+		return err
+	}
+	log.Printf("backup: database saved to %s", backupPath)
+	// one backup per run is enough
+	s.existed = false
+	return nil
+}
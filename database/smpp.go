@@ -0,0 +1,71 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// SMPPDelivery is a deliver_sm waiting for a receiver of SystemID.
+type SMPPDelivery struct {
+	ID       int64
+	SystemID string
+	// UUID of the message or the received message delivered
+	UUID      string
+	Body      []byte
+	Attempts  int
+	CreatedAt time.Time
+}
+
+func init() {
+	queries["insertSMPPDelivery"] = "INSERT INTO smpp_deliveries(system_id, uuid, body, created_at) VALUES(?, ?, ?, ?)"
+	queries["getSMPPDeliveries"] = "SELECT id, system_id, uuid, body, attempts, created_at FROM smpp_deliveries" +
+		" WHERE system_id = ? ORDER BY id LIMIT ?"
+	queries["updateSMPPDeliveryAttempts"] = "UPDATE smpp_deliveries SET attempts = ? WHERE id = ?"
+	queries["deleteSMPPDelivery"] = "DELETE FROM smpp_deliveries WHERE id = ?"
+}
+
+func (s *sqlStore) InsertSMPPDelivery(d *SMPPDelivery) error {
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now().UTC()
+	}
+	_, err := s.stmts["insertSMPPDelivery"].Exec(d.SystemID, d.UUID, d.Body, d.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("InsertSMPPDelivery: %s", err.Error())
+	}
+	return nil
+}
+
+func (s *sqlStore) GetSMPPDeliveries(systemID string, limit int) ([]SMPPDelivery, error) {
+	var deliveries []SMPPDelivery
+	rows, err := s.stmts["getSMPPDeliveries"].Query(systemID, limit)
+	if err != nil {
+		return deliveries, fmt.Errorf("GetSMPPDeliveries: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d SMPPDelivery
+		err = rows.Scan(&d.ID, &d.SystemID, &d.UUID, &d.Body, &d.Attempts, &d.CreatedAt)
+		if err != nil {
+			return deliveries, fmt.Errorf("GetSMPPDeliveries: %s", err.Error())
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *sqlStore) UpdateSMPPDeliveryAttempts(id int64, attempts int) error {
+	_, err := s.stmts["updateSMPPDeliveryAttempts"].Exec(attempts, id)
+	if err != nil {
+		return fmt.Errorf("UpdateSMPPDeliveryAttempts: %s", err.Error())
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteSMPPDelivery(id int64) error {
+	_, err := s.stmts["deleteSMPPDelivery"].Exec(id)
+	if err != nil {
+		return fmt.Errorf("DeleteSMPPDelivery: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Store is the persistence layer shared by the api and the worker.
+type Store interface {
+	InsertMessage(sms *common.SMS) error
+	// InsertMessages inserts all of messages in one transaction
+	InsertMessages(messages []*common.SMS) error
+	// InsertMessageOnce inserts sms unless its client inserted a message with
+	// the same idempotency key within window, in which case sms is replaced
+	// by that message and false is returned.
+	InsertMessageOnce(sms *common.SMS, key string, window time.Duration) (bool, error)
+	UpdateMessageStatus(sms common.SMS) error
+	GetMessageByUuid(uuid string) (common.SMS, error)
+	GetPendingMessages() ([]common.SMS, error)
+	ListMessages(filter MessageFilter) ([]common.SMS, string, error)
+	// ClaimPendingMessages reserves up to limit pending messages of at most
+	// maxPriority for owner so that other gateway instances sharing the
+	// database skip them, highest priority and oldest first. A claim is
+	// released by UpdateMessageStatus or expires after claimTimeout.
+	ClaimPendingMessages(owner string, limit int, maxPriority int) ([]common.SMS, error)
+	// NextDue returns when the next unclaimed pending message is due, zero
+	// if there is none.
+	NextDue() (time.Time, error)
+	// Wakeup receives a value after messages are queued by this process.
+	// Signals are coalesced, so the receiver should claim until there is
+	// nothing left.
+	Wakeup() <-chan struct{}
+
+	InsertEvent(uuid string, event common.Event) error
+	GetEvents(uuid string) ([]common.Event, error)
+	// MarkDelivered applies a status report and returns the uuid of the message
+	MarkDelivered(reference string, delivered bool, detail string) (string, error)
+
+	InsertInbound(msg *common.Inbound) error
+	ListConversations(limit int) ([]common.Conversation, error)
+	GetConversation(number string, limit int) ([]common.SMS, []common.Inbound, error)
+	GetInbound(uuid string) (common.Inbound, error)
+	MarkInboundRead(number string) error
+	TagInbound(uuid string, tags []string) error
+
+	InsertTemplate(t *common.Template) error
+	UpdateTemplate(t *common.Template) error
+	DeleteTemplate(id string) error
+	GetTemplate(id string) (common.Template, error)
+	ListTemplates() ([]common.Template, error)
+
+	InsertContact(c *common.Contact) error
+	UpdateContact(c *common.Contact) error
+	DeleteContact(uuid string) error
+	GetContact(uuid string) (common.Contact, error)
+	ListContacts(group string) ([]common.Contact, error)
+	// ImportContacts returns the number of inserted and updated contacts
+	ImportContacts(contacts []*common.Contact, group string) (int, int, error)
+	InsertGroup(g *common.Group) error
+	UpdateGroup(g *common.Group) error
+	DeleteGroup(id string) error
+	GetGroup(id string) (common.Group, error)
+	ListGroups() ([]common.Group, error)
+	AddGroupMembers(id string, uuids []string) error
+	RemoveGroupMember(id string, uuid string) error
+
+	InsertSuppression(suppression *common.Suppression) error
+	DeleteSuppression(number string) error
+	GetSuppression(number string) (common.Suppression, error)
+	ListSuppressions() ([]common.Suppression, error)
+
+	InsertBalance(balance *common.Balance) error
+	GetBalances(from time.Time, to time.Time) ([]common.Balance, error)
+	CountSentMessages(from time.Time, to time.Time) (int, error)
+	GetModemSendTimes(from time.Time) ([]time.Time, error)
+
+	// InsertSMPPDelivery keeps a deliver_sm until a receiver of its
+	// system_id acknowledges it.
+	InsertSMPPDelivery(d *SMPPDelivery) error
+	// GetSMPPDeliveries returns up to limit pending deliveries of systemID,
+	// oldest first.
+	GetSMPPDeliveries(systemID string, limit int) ([]SMPPDelivery, error)
+	UpdateSMPPDeliveryAttempts(id int64, attempts int) error
+	DeleteSMPPDelivery(id int64) error
+
+	SchemaVersion() (int, error)
+	GetMigrationStatus() ([]MigrationStatus, error)
+	MigrateUp() error
+	MigrateTo(version int) error
+	Close() error
+}
+
+// claimTimeout after which a claim of a crashed instance is given up
+const claimTimeout = 10 * time.Minute
+
+// referenceLifetime is how long a status report may take to arrive
+const referenceLifetime = 72 * time.Hour
+
+type dialect struct {
+	Name       string
+	Driver     string
+	Migrations []migration
+	// ClaimQuery marks pending messages with claimed_by=$1, claimed_at=$2
+	// for at most $6 rows due at $3 whose claim is older than $4 and
+	// priority is at most $5.
+	ClaimQuery string
+}
+
+var sqlite = &dialect{
+	Name:       "sqlite3",
+	Driver:     "sqlite3",
+	Migrations: sqliteMigrations,
+	ClaimQuery: "UPDATE messages SET claimed_by = ?, claimed_at = ? WHERE id IN (" +
+		"SELECT id FROM messages WHERE " + pendingCondition +
+		" AND priority <= ? ORDER BY priority, id LIMIT ?)",
+}
+
+var postgres = &dialect{
+	Name:       "postgres",
+	Driver:     "postgres",
+	Migrations: postgresMigrations,
+	ClaimQuery: "UPDATE messages SET claimed_by = ?, claimed_at = ? WHERE id IN (" +
+		"SELECT id FROM messages WHERE " + pendingCondition +
+		" AND priority <= ? ORDER BY priority, id LIMIT ? FOR UPDATE SKIP LOCKED)",
+}
+
+var pendingCondition = pendingStatuses +
+	" AND due_at <= ? AND (claimed_by IS NULL OR claimed_at < ?)"
+
+type sqlStore struct {
+	db      *sql.DB
+	dialect *dialect
+	stmts   map[string]*sql.Stmt
+	wakeup  chan struct{}
+	// path and existed of an sqlite database file, used for backups
+	path    string
+	existed bool
+}
+
+// parseDSN maps "postgres://..." to PostgreSQL and "sqlite3://path" or a
+// plain path to SQLite.
+func parseDSN(dsn string) (*dialect, string) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return postgres, dsn
+	}
+	for _, prefix := range []string{"sqlite3://", "sqlite://"} {
+		if strings.HasPrefix(dsn, prefix) {
+			return sqlite, strings.TrimPrefix(dsn, prefix)
+		}
+	}
+	return sqlite, dsn
+}
+
+// Open connects to the database without migrating it.
+func Open(dsn string) (Store, error) {
+	d, source := parseDSN(dsn)
+	s := &sqlStore{dialect: d, wakeup: make(chan struct{}, 1)}
+	if d == sqlite {
+		info, err := os.Stat(source)
+		if os.IsNotExist(err) {
+			log.Printf("Open: database does not exist %s", source)
+		}
+		s.path = source
+		s.existed = err == nil && info.Size() > 0
+	}
+	s.db, err = sql.Open(d.Driver, source)
+	if err != nil {
+		return nil, fmt.Errorf("Open: Error creating database. %s", err.Error())
+	}
+	if d == sqlite {
+		// sqlite allows a single writer, serialize access instead of
+		// failing with "database is locked"
+		s.db.SetMaxOpenConns(1)
+	}
+	err = s.initSchemaVersion()
+	if err != nil {
+		s.db.Close()
+		return nil, fmt.Errorf("Open: %s", err.Error())
+	}
+	return s, nil
+}
+
+func InitDB(dsn string) (Store, error) {
+	s, err := Open(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("InitDB: %s", err.Error())
+	}
+	err = s.MigrateUp()
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("InitDB: Error migrating database. %s", err.Error())
+	}
+	err = s.(*sqlStore).prepare()
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("InitDB: %s", err.Error())
+	}
+	return s, nil
+}
+
+func (s *sqlStore) prepare() error {
+	s.stmts = make(map[string]*sql.Stmt)
+	for name, query := range queries {
+		stmt, err := s.db.Prepare(s.rebind(query))
+		if err != nil {
+			return fmt.Errorf("prepare: Failed to prepare %s. %s", name, err.Error())
+		}
+		s.stmts[name] = stmt
+	}
+	stmt, err := s.db.Prepare(s.rebind(s.dialect.ClaimQuery))
+	if err != nil {
+		return fmt.Errorf("prepare: Failed to prepare claimMessages. %s", err.Error())
+	}
+	s.stmts["claimMessages"] = stmt
+	return nil
+}
+
+func (s *sqlStore) Close() error {
+	for _, stmt := range s.stmts {
+		stmt.Close()
+	}
+	return s.db.Close()
+}
+
+// rebind rewrites ? placeholders to $1, $2, ... for PostgreSQL.
+func (s *sqlStore) rebind(query string) string {
+	if s.dialect != postgres {
+		return query
+	}
+	var buf []byte
+	n := 0
+	quoted := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if c == '\'' {
+			quoted = !quoted
+		}
+		if c == '?' && !quoted {
+			n++
+			buf = append(buf, '$')
+			buf = strconv.AppendInt(buf, int64(n), 10)
+			continue
+		}
+		buf = append(buf, c)
+	}
+	return string(buf)
+}
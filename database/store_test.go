@@ -0,0 +1,780 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alexgear/sms/common"
+)
+
+// Every Store implementation must pass the same suite. The sqlite store is
+// tested against a temporary file, postgres against the database given in
+// SMS_TEST_POSTGRES_DSN which is wiped by the test.
+func TestStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsns := map[string]string{"sqlite3": filepath.Join(dir, "db.sqlite")}
+	if dsn := os.Getenv("SMS_TEST_POSTGRES_DSN"); dsn != "" {
+		dsns["postgres"] = dsn
+	}
+	for name, dsn := range dsns {
+		t.Run(name, func(t *testing.T) {
+			for _, test := range conformanceTests {
+				s := newTestStore(t, dsn)
+				t.Run(test.name, func(t *testing.T) { test.run(t, s) })
+				s.Close()
+			}
+		})
+	}
+}
+
+// newTestStore returns a store on an emptied and freshly migrated database.
+func newTestStore(t *testing.T, dsn string) Store {
+	s, err := Open(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.MigrateTo(0)
+	s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = InitDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+var conformanceTests = []struct {
+	name string
+	run  func(t *testing.T, s Store)
+}{
+	{"Migrations", testMigrations},
+	{"Messages", testMessages},
+	{"Claims", testClaims},
+	{"Priorities", testPriorities},
+	{"DueTimes", testDueTimes},
+	{"Balances", testBalances},
+	{"NotFound", testNotFound},
+	{"ListMessages", testListMessages},
+	{"Events", testEvents},
+	{"Conversations", testConversations},
+	{"Templates", testTemplates},
+	{"Contacts", testContacts},
+	{"Suppressions", testSuppressions},
+	{"Idempotency", testIdempotency},
+	{"SMPPDeliveries", testSMPPDeliveries},
+}
+
+func insertMessages(t *testing.T, s Store, n int) []*common.SMS {
+	var messages []*common.SMS
+	for i := 0; i < n; i++ {
+		sms := &common.SMS{
+			UUID:   fmt.Sprintf("00000000-0000-0000-0000-%012d", i),
+			Mobile: "+380631234567",
+			Body:   fmt.Sprintf("test %d", i),
+			Status: "pending"}
+		if i == 1 {
+			sms.QuietHours = "22:00-07:00"
+			sms.TimeZone = "Europe/Kyiv"
+			sms.Callback = json.RawMessage(`{"registered_delivery":1}`)
+		}
+		err := s.InsertMessage(sms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, sms)
+	}
+	return messages
+}
+
+func testMigrations(t *testing.T, s Store) {
+	status, err := s.GetMigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ms := range status {
+		if ms.AppliedAt == nil {
+			t.Fatalf("Expected migration %d to be applied", ms.Version)
+		}
+	}
+	latest := status[len(status)-1].Version
+	err = s.MigrateTo(latest - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := s.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != latest-1 {
+		t.Fatalf("Expected version %d, got %d", latest-1, version)
+	}
+	err = s.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVersionBefore(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		before bool
+	}{
+		{"3.8.10", "3.35.0", true},
+		{"3.34.1", "3.35.0", true},
+		{"3.35.0", "3.35.0", false},
+		{"3.45.1", "3.35.0", false},
+		{"3.35", "3.35.0", true},
+	}
+	for _, test := range tests {
+		if versionBefore(test.a, test.b) != test.before {
+			t.Errorf("Expected versionBefore(%s, %s) to be %v", test.a, test.b, test.before)
+		}
+	}
+}
+
+func testMessages(t *testing.T, s Store) {
+	messages := insertMessages(t, s, 2)
+	sms, err := s.GetMessageByUuid(messages[0].UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := messages[0]
+	if sms.UUID != expected.UUID || sms.Body != expected.Body || sms.Mobile != expected.Mobile ||
+		sms.Status != expected.Status || sms.UpdatedAt != nil || sms.QuietHours != "" || sms.TimeZone != "" ||
+		!sms.CreatedAt.Truncate(time.Millisecond).Equal(expected.CreatedAt.Truncate(time.Millisecond)) {
+		t.Fatalf("Expected %#v, got %#v", *expected, sms)
+	}
+	sms.Status = "sent"
+	sms.Retries = 1
+	err = s.UpdateMessageStatus(sms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.InsertEvent(sms.UUID, common.Event{Event: common.EventSent, Attempt: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := s.GetPendingMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].UUID != messages[1].UUID ||
+		pending[0].QuietHours != "22:00-07:00" || pending[0].TimeZone != "Europe/Kyiv" ||
+		string(pending[0].Callback) != `{"registered_delivery":1}` {
+		t.Fatalf("Expected only %s pending, got %#v", messages[1].UUID, pending)
+	}
+	count, err := s.CountSentMessages(time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("Expected 1 sent message, got %d", count)
+	}
+	times, err := s.GetModemSendTimes(time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 1 || times[0].Before(time.Now().Add(-time.Minute)) {
+		t.Fatalf("Expected the time of 1 sent message, got %v", times)
+	}
+	// a batch with an existing uuid inserts none of its messages
+	batch := []*common.SMS{
+		{UUID: "00000000-0000-0000-0000-100000000000", Mobile: "+380631234567", Body: "batch", Status: "pending"},
+		{UUID: messages[0].UUID, Mobile: "+380631234567", Body: "batch", Status: "pending"},
+	}
+	if s.InsertMessages(batch) == nil {
+		t.Fatal("Expected an error for a duplicate uuid")
+	}
+	if _, err = s.GetMessageByUuid(batch[0].UUID); err != ErrNotFound {
+		t.Fatalf("Expected the batch to be rolled back, got %v", err)
+	}
+}
+
+func testClaims(t *testing.T, s Store) {
+	insertMessages(t, s, 3)
+	first, err := s.ClaimPendingMessages("a", 2, common.PriorityBulk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.ClaimPendingMessages("b", 2, common.PriorityBulk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 || len(second) != 1 || second[0].UUID == first[0].UUID || second[0].UUID == first[1].UUID {
+		t.Fatalf("Expected disjoint claims, got %#v and %#v", first, second)
+	}
+	// a failed attempt releases the claim
+	first[0].Status = "error"
+	first[0].Retries++
+	err = s.UpdateMessageStatus(first[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := s.ClaimPendingMessages("b", 2, common.PriorityBulk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(third) != 1 || third[0].UUID != first[0].UUID || third[0].Retries != 1 {
+		t.Fatalf("Expected %s to be claimed again, got %#v", first[0].UUID, third)
+	}
+}
+
+func testDueTimes(t *testing.T, s Store) {
+	due, err := s.NextDue()
+	if err != nil || !due.IsZero() {
+		t.Fatalf("Expected nothing due, got %v %v", due, err)
+	}
+	select {
+	case <-s.Wakeup():
+		t.Fatal("Expected no wakeup before a message is queued")
+	default:
+	}
+	messages := insertMessages(t, s, 2)
+	select {
+	case <-s.Wakeup():
+	default:
+		t.Fatal("Expected a wakeup after messages were queued")
+	}
+	claimed, err := s.ClaimPendingMessages("a", 1, common.PriorityBulk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a failed attempt is retried later
+	later := time.Now().Add(time.Hour).Truncate(time.Second)
+	claimed[0].Status = "error"
+	claimed[0].Retries++
+	claimed[0].DueAt = later
+	err = s.UpdateMessageStatus(claimed[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	due, err = s.NextDue()
+	if err != nil || !due.Truncate(time.Millisecond).Equal(messages[1].DueAt.Truncate(time.Millisecond)) {
+		t.Fatalf("Expected %v to be due, got %v %v", messages[1].DueAt, due, err)
+	}
+	claimed, err = s.ClaimPendingMessages("a", 10, common.PriorityBulk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 || claimed[0].UUID != messages[1].UUID {
+		t.Fatalf("Expected only %s to be due, got %#v", messages[1].UUID, claimed)
+	}
+	// claimed messages are not waited for
+	due, err = s.NextDue()
+	if err != nil || !due.Equal(later) {
+		t.Fatalf("Expected %v to be due, got %v %v", later, due, err)
+	}
+}
+
+func testPriorities(t *testing.T, s Store) {
+	for i, priority := range []int{common.PriorityBulk, common.PriorityNormal, common.PriorityHigh, common.PriorityNormal} {
+		sms := &common.SMS{
+			UUID:     fmt.Sprintf("00000000-0000-0000-0000-%012d", i),
+			Mobile:   "+380631234567",
+			Body:     "test",
+			Status:   "pending",
+			Priority: priority}
+		err := s.InsertMessage(sms)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	high, err := s.ClaimPendingMessages("a", 10, common.PriorityHigh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(high) != 1 || high[0].Priority != common.PriorityHigh {
+		t.Fatalf("Expected only the high priority message, got %#v", high)
+	}
+	rest, err := s.ClaimPendingMessages("a", 10, common.PriorityBulk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, sms := range rest {
+		order = append(order, sms.UUID[len(sms.UUID)-1:])
+	}
+	// by priority, then by age
+	if fmt.Sprint(order) != "[1 3 0]" {
+		t.Fatalf("Expected messages 1, 3 and 0, got %v", order)
+	}
+}
+
+func testBalances(t *testing.T, s Store) {
+	now := time.Now().Truncate(time.Second)
+	for i, amount := range []float64{10.5, 9.25, 20} {
+		balance := &common.Balance{Amount: amount, Currency: "UAH", Raw: "raw", Time: now.Add(time.Duration(i-3) * time.Hour)}
+		err := s.InsertBalance(balance)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	balances, err := s.GetBalances(now.Add(-150*time.Minute), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(balances) != 2 || balances[0].Amount != 9.25 || balances[1].Amount != 20 {
+		t.Fatalf("Expected the last two readings, got %#v", balances)
+	}
+	if !balances[1].Time.Equal(now.Add(-time.Hour)) {
+		t.Fatalf("Expected %s, got %s", now.Add(-time.Hour), balances[1].Time)
+	}
+}
+
+func testNotFound(t *testing.T, s Store) {
+	insertMessages(t, s, 1)
+	for _, uuid := range []string{"unknown", `" OR ""="`, "' OR '1'='1"} {
+		_, err := s.GetMessageByUuid(uuid)
+		if err != ErrNotFound {
+			t.Fatalf("Expected ErrNotFound for %#v, got %#v", uuid, err)
+		}
+	}
+}
+
+func testListMessages(t *testing.T, s Store) {
+	messages := insertMessages(t, s, 5)
+	var listed []common.SMS
+	filter := MessageFilter{Mobile: "+380631234567", Limit: 2}
+	for page := 0; ; page++ {
+		result, cursor, err := s.ListMessages(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed = append(listed, result...)
+		if cursor == "" {
+			break
+		}
+		if page > 3 {
+			t.Fatal("Expected 3 pages")
+		}
+		filter.Cursor = cursor
+	}
+	if len(listed) != 5 {
+		t.Fatalf("Expected 5 messages, got %d", len(listed))
+	}
+	for i, sms := range listed {
+		// newest first
+		if sms.UUID != messages[4-i].UUID {
+			t.Fatalf("Expected %s at %d, got %s", messages[4-i].UUID, i, sms.UUID)
+		}
+	}
+	listed, _, err := s.ListMessages(MessageFilter{Body: "test 3", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].UUID != messages[3].UUID {
+		t.Fatalf("Expected %s, got %#v", messages[3].UUID, listed)
+	}
+	tagged := &common.SMS{
+		UUID:      "00000000-0000-0000-0000-100000000000",
+		Mobile:    "+380501234567",
+		Body:      "tagged",
+		Status:    "pending",
+		ClientRef: "order-42",
+		Metadata:  []byte(`{"order": 42}`)}
+	err = s.InsertMessage(tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed, _, err = s.ListMessages(MessageFilter{ClientRef: "order-42", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].UUID != tagged.UUID || string(listed[0].Metadata) != `{"order": 42}` {
+		t.Fatalf("Expected %#v, got %#v", tagged, listed)
+	}
+	listed, _, err = s.ListMessages(MessageFilter{Body: "%", Status: "pending", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 0 {
+		t.Fatalf("Expected %% to match literally, got %#v", listed)
+	}
+	_, _, err = s.ListMessages(MessageFilter{Cursor: "garbage", Limit: 10})
+	if err != ErrInvalidCursor {
+		t.Fatalf("Expected ErrInvalidCursor, got %#v", err)
+	}
+}
+
+func testEvents(t *testing.T, s Store) {
+	messages := insertMessages(t, s, 1)
+	claimed, err := s.ClaimPendingMessages("a", 1, common.PriorityBulk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sms := claimed[0]
+	sms.Status = "sent"
+	sms.Retries = 1
+	sms.Reference = "12"
+	err = s.UpdateMessageStatus(sms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.InsertEvent(sms.UUID, common.Event{Event: common.EventSent, Attempt: 1, Reference: "12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid, err := s.MarkDelivered("12", true, "status 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuid != messages[0].UUID {
+		t.Fatalf("Expected %s, got %s", messages[0].UUID, uuid)
+	}
+	_, err = s.MarkDelivered("12", true, "status 0")
+	if err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for a delivered message, got %#v", err)
+	}
+	events, err := s.GetEvents(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, event := range events {
+		names = append(names, event.Event)
+	}
+	expected := []string{"queued", "claimed", "sent", "delivered"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Fatalf("Expected %v, got %v", expected, names)
+	}
+	sms, err = s.GetMessageByUuid(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sms.Status != "delivered" || sms.Reference != "12" {
+		t.Fatalf("Expected delivered message with reference 12, got %#v", sms)
+	}
+}
+
+func testConversations(t *testing.T, s Store) {
+	insertMessages(t, s, 2)
+	for i, sender := range []string{"+380631234567", "+380501234567", "+380631234567"} {
+		msg := &common.Inbound{
+			UUID:       fmt.Sprintf("10000000-0000-0000-0000-%012d", i),
+			Sender:     sender,
+			Body:       "reply",
+			ReceivedAt: time.Now(),
+		}
+		err := s.InsertInbound(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	conversations, err := s.ListConversations(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conversations) != 2 || conversations[0].Number != "+380631234567" || conversations[0].Unread != 2 ||
+		conversations[1].Number != "+380501234567" || conversations[1].Unread != 1 {
+		t.Fatalf("Unexpected conversations %#v", conversations)
+	}
+	if time.Since(conversations[0].LastActivity) > time.Minute {
+		t.Fatalf("Unexpected last activity %s", conversations[0].LastActivity)
+	}
+	outbound, inbound, err := s.GetConversation("+380631234567", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outbound) != 2 || len(inbound) != 2 {
+		t.Fatalf("Expected 2 outbound and 2 inbound messages, got %#v %#v", outbound, inbound)
+	}
+	for _, tags := range [][]string{{"support"}, {"support", "urgent"}} {
+		err = s.TagInbound(inbound[0].UUID, tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, inbound, err = s.GetConversation("+380631234567", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(inbound[0].Tags) != "[support urgent]" {
+		t.Fatalf("Expected tags support and urgent, got %#v", inbound[0].Tags)
+	}
+	msg, err := s.GetInbound(inbound[0].UUID)
+	if err != nil || msg.Sender != "+380631234567" || msg.Body != "reply" || fmt.Sprint(msg.Tags) != "[support urgent]" {
+		t.Fatalf("Unexpected inbound message %#v %v", msg, err)
+	}
+	if _, err = s.GetInbound("unknown"); err != ErrNotFound {
+		t.Fatal("Expected ErrNotFound for an unknown message")
+	}
+	if s.TagInbound("unknown", []string{"support"}) != ErrNotFound {
+		t.Fatal("Expected ErrNotFound for an unknown message")
+	}
+	err = s.MarkInboundRead("+380631234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversations, err = s.ListConversations(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conversations[0].Unread != 0 {
+		t.Fatalf("Expected conversation to be read, got %#v", conversations[0])
+	}
+}
+
+func testTemplates(t *testing.T, s Store) {
+	template := &common.Template{
+		ID:            "otp",
+		DefaultLocale: "en",
+		Variants:      map[string]string{"en": "Your code is {{code}}", "uk": "Ваш код {{code}}"},
+	}
+	err := s.InsertTemplate(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.InsertTemplate(template)
+	if err != ErrExists {
+		t.Fatalf("Expected ErrExists, got %#v", err)
+	}
+	// of concurrent inserts of an id one succeeds and the others get ErrExists
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			errs <- s.InsertTemplate(&common.Template{ID: "race", DefaultLocale: "en",
+				Variants: map[string]string{"en": "test"}})
+		}()
+	}
+	created := 0
+	for i := 0; i < 4; i++ {
+		err = <-errs
+		if err == nil {
+			created++
+		} else if err != ErrExists {
+			t.Fatal(err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("Expected one template to be created, got %d", created)
+	}
+	err = s.DeleteTemplate("race")
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.Variants = map[string]string{"en": "Code: {{code}}"}
+	err = s.UpdateTemplate(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.GetTemplate("otp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.DefaultLocale != "en" || fmt.Sprint(stored.Variants) != fmt.Sprint(template.Variants) {
+		t.Fatalf("Expected %#v, got %#v", template, stored)
+	}
+	templates, err := s.ListTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(templates) != 1 || templates[0].Variants["en"] != "Code: {{code}}" {
+		t.Fatalf("Expected the updated template, got %#v", templates)
+	}
+	err = s.DeleteTemplate("otp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err = range []error{s.DeleteTemplate("otp"), s.UpdateTemplate(template)} {
+		if err != ErrNotFound {
+			t.Fatalf("Expected ErrNotFound, got %#v", err)
+		}
+	}
+	_, err = s.GetTemplate("otp")
+	if err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %#v", err)
+	}
+}
+
+func testContacts(t *testing.T, s Store) {
+	contact := &common.Contact{
+		UUID:       "20000000-0000-0000-0000-000000000000",
+		Name:       "Olena",
+		Number:     "+380631234567",
+		Attributes: map[string]string{"order": "42"},
+	}
+	err := s.InsertContact(contact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicate := *contact
+	duplicate.UUID = "20000000-0000-0000-0000-000000000001"
+	err = s.InsertContact(&duplicate)
+	if err != ErrExists {
+		t.Fatalf("Expected ErrExists, got %#v", err)
+	}
+	err = s.InsertGroup(&common.Group{ID: "customers", Name: "Customers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AddGroupMembers("customers", []string{contact.UUID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AddGroupMembers("customers", []string{"unknown"})
+	if err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %#v", err)
+	}
+	imported := []*common.Contact{
+		{UUID: duplicate.UUID, Name: "Olena K", Number: "+380631234567", Locale: "uk"},
+		{UUID: "20000000-0000-0000-0000-000000000002", Name: "Taras", Number: "+380501234567"},
+	}
+	inserted, updated, err := s.ImportContacts(imported, "customers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted != 1 || updated != 1 || imported[0].UUID != contact.UUID {
+		t.Fatalf("Expected 1 inserted and 1 updated contact, got %d %d", inserted, updated)
+	}
+	group, err := s.GetGroup("customers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.Size != 2 {
+		t.Fatalf("Expected 2 members, got %#v", group)
+	}
+	members, err := s.ListContacts("customers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 || members[0].Name != "Olena K" || members[0].Locale != "uk" || members[1].Name != "Taras" {
+		t.Fatalf("Unexpected members %#v", members)
+	}
+	err = s.DeleteContact(contact.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RemoveGroupMember("customers", contact.UUID)
+	if err != ErrNotFound {
+		t.Fatalf("Expected the deleted contact to leave the group, got %#v", err)
+	}
+	err = s.DeleteGroup("customers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contacts, err := s.ListContacts("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 1 || contacts[0].Number != "+380501234567" {
+		t.Fatalf("Expected contacts to outlive the group, got %#v", contacts)
+	}
+}
+
+func testSuppressions(t *testing.T, s Store) {
+	suppression := &common.Suppression{Number: "+380631234567", Source: "keyword", Detail: "STOP"}
+	err := s.InsertSuppression(suppression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.InsertSuppression(suppression)
+	if err != ErrExists {
+		t.Fatalf("Expected ErrExists, got %#v", err)
+	}
+	stored, err := s.GetSuppression("+380631234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Source != "keyword" || stored.Detail != "STOP" {
+		t.Fatalf("Expected %#v, got %#v", suppression, stored)
+	}
+	suppressions, err := s.ListSuppressions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suppressions) != 1 {
+		t.Fatalf("Expected 1 suppression, got %#v", suppressions)
+	}
+	err = s.DeleteSuppression("+380631234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.GetSuppression("+380631234567")
+	if err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %#v", err)
+	}
+}
+
+func testSMPPDeliveries(t *testing.T, s Store) {
+	for i, systemID := range []string{"billing", "crm", "billing"} {
+		err := s.InsertSMPPDelivery(&SMPPDelivery{SystemID: systemID, UUID: fmt.Sprint(i), Body: []byte{0, byte(i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliveries, err := s.GetSMPPDeliveries("billing", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 || deliveries[0].UUID != "0" || deliveries[1].UUID != "2" ||
+		string(deliveries[1].Body) != "\x00\x02" {
+		t.Fatalf("Expected the deliveries of billing oldest first, got %#v", deliveries)
+	}
+	err = s.UpdateSMPPDeliveryAttempts(deliveries[0].ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DeleteSMPPDelivery(deliveries[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err = s.GetSMPPDeliveries("billing", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Attempts != 2 {
+		t.Fatalf("Expected 1 delivery after 2 attempts, got %#v", deliveries)
+	}
+}
+
+func testIdempotency(t *testing.T, s Store) {
+	newSMS := func(i int, client string) *common.SMS {
+		return &common.SMS{
+			UUID:   fmt.Sprintf("30000000-0000-0000-0000-%012d", i),
+			Mobile: "+380631234567",
+			Body:   "test",
+			Status: "pending",
+			Client: client}
+	}
+	first := newSMS(0, "crm")
+	created, err := s.InsertMessageOnce(first, "order-1", time.Hour)
+	if err != nil || !created {
+		t.Fatalf("Expected the message to be created, got %v %#v", created, err)
+	}
+	repeated := newSMS(1, "crm")
+	created, err = s.InsertMessageOnce(repeated, "order-1", time.Hour)
+	if err != nil || created || repeated.UUID != first.UUID {
+		t.Fatalf("Expected %s to be returned, got %v %#v %#v", first.UUID, created, repeated, err)
+	}
+	// keys are per client
+	other := newSMS(2, "ops")
+	created, err = s.InsertMessageOnce(other, "order-1", time.Hour)
+	if err != nil || !created {
+		t.Fatalf("Expected a message of another client to be created, got %v %#v", created, err)
+	}
+	// and expire after the window
+	late := newSMS(3, "crm")
+	late.CreatedAt = time.Now().Add(2 * time.Hour)
+	created, err = s.InsertMessageOnce(late, "order-1", time.Hour)
+	if err != nil || !created {
+		t.Fatalf("Expected the key to expire, got %v %#v", created, err)
+	}
+	pending, err := s.GetPendingMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(pending))
+	}
+}
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alexgear/sms/common"
+)
+
+func init() {
+	queries["insertSuppression"] = "INSERT INTO suppressions(number, source, detail, created_at) VALUES(?, ?, ?, ?)"
+	queries["deleteSuppression"] = "DELETE FROM suppressions WHERE number = ?"
+	queries["getSuppression"] = "SELECT number, source, detail, created_at FROM suppressions WHERE number = ?"
+	queries["listSuppressions"] = "SELECT number, source, detail, created_at FROM suppressions ORDER BY created_at DESC"
+}
+
+// InsertSuppression returns ErrExists if the number is already suppressed.
+func (s *sqlStore) InsertSuppression(suppression *common.Suppression) error {
+	log.Printf("InsertSuppression: %#v", suppression)
+	if suppression.CreatedAt.IsZero() {
+		suppression.CreatedAt = time.Now().UTC()
+	}
+	_, err := s.stmts["insertSuppression"].Exec(suppression.Number, suppression.Source, suppression.Detail,
+		suppression.CreatedAt.UTC())
+	if isUniqueViolation(err) {
+		return ErrExists
+	} else if err != nil {
+		return fmt.Errorf("InsertSuppression: %s", err.Error())
+	}
+	return nil
+}
+
+// DeleteSuppression returns ErrNotFound if the number is not suppressed.
+func (s *sqlStore) DeleteSuppression(number string) error {
+	log.Printf("DeleteSuppression: %#v", number)
+	result, err := s.stmts["deleteSuppression"].Exec(number)
+	if err != nil {
+		return fmt.Errorf("DeleteSuppression: %s", err.Error())
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetSuppression returns ErrNotFound if the number is not suppressed.
+func (s *sqlStore) GetSuppression(number string) (common.Suppression, error) {
+	var suppression common.Suppression
+	err := s.stmts["getSuppression"].QueryRow(number).Scan(&suppression.Number, &suppression.Source,
+		&suppression.Detail, &suppression.CreatedAt)
+	if err == sql.ErrNoRows {
+		return suppression, ErrNotFound
+	} else if err != nil {
+		return suppression, fmt.Errorf("GetSuppression: %s", err.Error())
+	}
+	return suppression, nil
+}
+
+// ListSuppressions returns the suppressed numbers, latest first.
+func (s *sqlStore) ListSuppressions() ([]common.Suppression, error) {
+	var suppressions []common.Suppression
+	rows, err := s.stmts["listSuppressions"].Query()
+	if err != nil {
+		return suppressions, fmt.Errorf("ListSuppressions: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var suppression common.Suppression
+		err = rows.Scan(&suppression.Number, &suppression.Source, &suppression.Detail, &suppression.CreatedAt)
+		if err != nil {
+			return suppressions, fmt.Errorf("ListSuppressions: %s", err.Error())
+		}
+		suppressions = append(suppressions, suppression)
+	}
+	return suppressions, rows.Err()
+}
@@ -0,0 +1,201 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrExists is returned when a row with the same key already exists.
+var ErrExists = errors.New("already exists")
+
+// isUniqueViolation reports whether err is an insert of an existing key.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func init() {
+	queries["insertTemplate"] = "INSERT INTO templates(id, default_locale, created_at, updated_at) VALUES(?, ?, ?, ?)"
+	queries["updateTemplate"] = "UPDATE templates SET default_locale = ?, updated_at = ? WHERE id = ?"
+	queries["deleteTemplate"] = "DELETE FROM templates WHERE id = ?"
+	queries["getTemplate"] = "SELECT id, default_locale, created_at, updated_at FROM templates WHERE id = ?"
+	queries["listTemplates"] = "SELECT id, default_locale, created_at, updated_at FROM templates ORDER BY id"
+	queries["insertVariant"] = "INSERT INTO template_variants(template_id, locale, body) VALUES(?, ?, ?)"
+	queries["deleteVariants"] = "DELETE FROM template_variants WHERE template_id = ?"
+	queries["getVariants"] = "SELECT template_id, locale, body FROM template_variants WHERE template_id = ?"
+	queries["listVariants"] = "SELECT template_id, locale, body FROM template_variants"
+}
+
+// InsertTemplate returns ErrExists if a template with the same id exists.
+func (s *sqlStore) InsertTemplate(t *common.Template) error {
+	log.Printf("InsertTemplate: %#v", t)
+	t.CreatedAt = time.Now().UTC()
+	t.UpdatedAt = t.CreatedAt
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("InsertTemplate: %s", err.Error())
+	}
+	_, err = tx.Stmt(s.stmts["insertTemplate"]).Exec(t.ID, t.DefaultLocale, t.CreatedAt, t.UpdatedAt)
+	if isUniqueViolation(err) {
+		tx.Rollback()
+		return ErrExists
+	}
+	if err == nil {
+		err = s.insertVariants(tx, t)
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("InsertTemplate: %s", err.Error())
+	}
+	return tx.Commit()
+}
+
+// UpdateTemplate replaces the variants of a template, returns ErrNotFound
+// for an unknown id.
+func (s *sqlStore) UpdateTemplate(t *common.Template) error {
+	log.Printf("UpdateTemplate: %#v", t)
+	t.UpdatedAt = time.Now().UTC()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("UpdateTemplate: %s", err.Error())
+	}
+	result, err := tx.Stmt(s.stmts["updateTemplate"]).Exec(t.DefaultLocale, t.UpdatedAt, t.ID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("UpdateTemplate: %s", err.Error())
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return ErrNotFound
+	}
+	_, err = tx.Stmt(s.stmts["deleteVariants"]).Exec(t.ID)
+	if err == nil {
+		err = s.insertVariants(tx, t)
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("UpdateTemplate: %s", err.Error())
+	}
+	err = tx.Stmt(s.stmts["getTemplate"]).QueryRow(t.ID).Scan(new(string), new(string), &t.CreatedAt, new(time.Time))
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("UpdateTemplate: %s", err.Error())
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) insertVariants(tx *sql.Tx, t *common.Template) error {
+	stmt := tx.Stmt(s.stmts["insertVariant"])
+	for locale, body := range t.Variants {
+		_, err := stmt.Exec(t.ID, locale, body)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteTemplate returns ErrNotFound for an unknown id.
+func (s *sqlStore) DeleteTemplate(id string) error {
+	log.Printf("DeleteTemplate: %#v", id)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("DeleteTemplate: %s", err.Error())
+	}
+	// sqlite does not enforce ON DELETE CASCADE unless foreign keys are enabled
+	_, err = tx.Stmt(s.stmts["deleteVariants"]).Exec(id)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("DeleteTemplate: %s", err.Error())
+	}
+	result, err := tx.Stmt(s.stmts["deleteTemplate"]).Exec(id)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("DeleteTemplate: %s", err.Error())
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+// GetTemplate returns ErrNotFound for an unknown id.
+func (s *sqlStore) GetTemplate(id string) (common.Template, error) {
+	t := common.Template{Variants: make(map[string]string)}
+	err := s.stmts["getTemplate"].QueryRow(id).Scan(&t.ID, &t.DefaultLocale, &t.CreatedAt, &t.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return t, ErrNotFound
+	} else if err != nil {
+		return t, fmt.Errorf("GetTemplate: %s", err.Error())
+	}
+	templates := map[string]*common.Template{t.ID: &t}
+	err = s.scanVariants(templates, "getVariants", id)
+	if err != nil {
+		return t, fmt.Errorf("GetTemplate: %s", err.Error())
+	}
+	return t, nil
+}
+
+// ListTemplates returns all templates ordered by id.
+func (s *sqlStore) ListTemplates() ([]common.Template, error) {
+	var list []common.Template
+	rows, err := s.stmts["listTemplates"].Query()
+	if err != nil {
+		return list, fmt.Errorf("ListTemplates: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t := common.Template{Variants: make(map[string]string)}
+		err = rows.Scan(&t.ID, &t.DefaultLocale, &t.CreatedAt, &t.UpdatedAt)
+		if err != nil {
+			return list, fmt.Errorf("ListTemplates: %s", err.Error())
+		}
+		list = append(list, t)
+	}
+	if err = rows.Err(); err != nil {
+		return list, fmt.Errorf("ListTemplates: %s", err.Error())
+	}
+	templates := make(map[string]*common.Template)
+	for i := range list {
+		templates[list[i].ID] = &list[i]
+	}
+	err = s.scanVariants(templates, "listVariants")
+	if err != nil {
+		return list, fmt.Errorf("ListTemplates: %s", err.Error())
+	}
+	return list, nil
+}
+
+func (s *sqlStore) scanVariants(templates map[string]*common.Template, name string, args ...interface{}) error {
+	rows, err := s.stmts[name].Query(args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, locale, body string
+		err = rows.Scan(&id, &locale, &body)
+		if err != nil {
+			return err
+		}
+		if t, ok := templates[id]; ok {
+			t.Variants[locale] = body
+		}
+	}
+	return rows.Err()
+}
@@ -12,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/alexgear/sms/common"
 	"github.com/tarm/serial"
 	pdu "github.com/xlab/at/pdu"
 )
@@ -19,6 +20,10 @@ import (
 var err error
 var lock sync.Mutex
 
+// session serializes exchanges of several commands, e.g. the prompt of
+// AT+CMGS or the PDU mode of AT+CUSD must not be interleaved with others.
+var session sync.Mutex
+
 const waitReps int = 5
 
 var m *modem
@@ -39,6 +44,16 @@ type message struct {
 	Date   time.Time
 	Body   string
 	Index  int
+	// Report is set for SMS-STATUS-REPORT messages
+	Report *statusReport
+}
+
+type statusReport struct {
+	Reference int
+	Recipient string
+	Delivered time.Time
+	// Status is TP-Status, 0-31 delivered, 32-63 still trying, 64+ failed
+	Status int
 }
 
 type Port interface {
@@ -154,7 +169,7 @@ func Reset() error {
 		"AT+CSCS=\"GSM\"\r",
 	}
 	// Send C^Z first
-	_, err = SendCommand(string(26), false)
+	_, err = SendCommand("\x1a", false)
 	for _, c := range InitCommands {
 		for i := 0; i < 10; i++ {
 			log.Printf("%v, %#v", i, c)
@@ -172,7 +187,13 @@ func Reset() error {
 	return nil
 }
 
-func GetBalance(ussdRequest string) (float64, error) {
+func GetBalance(ussdRequest string, pattern *regexp.Regexp) (*common.Balance, error) {
+	session.Lock()
+	defer session.Unlock()
+	return getBalance(ussdRequest, pattern)
+}
+
+func getBalance(ussdRequest string, pattern *regexp.Regexp) (*common.Balance, error) {
 	log.Println("GetBalance...")
 	//re-set encoding here?
 	//m.SendCommand("AT+CSCS=\"GSM\"\r", true)
@@ -182,7 +203,7 @@ func GetBalance(ussdRequest string) (float64, error) {
 	request := strings.ToUpper(fmt.Sprintf("%x", pdu.Encode7Bit(ussdRequest)))
 	_, err = SendCommand(fmt.Sprintf("AT+CUSD=1,\"%s\",15\r", request), true)
 	if err != nil {
-		return 0.0, err
+		return nil, err
 	}
 	status, err := WaitForOutput(10, "15\r\n")
 	regex := regexp.MustCompile(`\+CUSD: \d{1},\"([a-zA-Z0-9]*)\",\d*`)
@@ -192,47 +213,145 @@ func GetBalance(ussdRequest string) (float64, error) {
 		log.Println("Before decode", bytesWritten)
 		balanceRaw, _ = pdu.Decode7Bit(bytesWritten)
 		log.Println("After decode", balanceRaw)
-		balanceParsed := regexp.MustCompile(`\d+\.\d+`).FindString(balanceRaw)
-		if balanceParsed == "" {
-			return 0.0, fmt.Errorf("GetBalance: Failed to find balance string in \"%s\"", balanceRaw)
-		}
-		balance, err := strconv.ParseFloat(balanceParsed, 64)
+		return ParseBalance(balanceRaw, pattern)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, errors.New("GetBalace: Failed to get balance.")
+}
+
+// GetBalanceBySMS sends text to number and waits for a reply from it,
+// for operators which report the balance by SMS instead of USSD.
+func GetBalanceBySMS(number string, text string, pattern *regexp.Regexp, timeout time.Duration) (*common.Balance, error) {
+	log.Println("GetBalanceBySMS...", number, text)
+	knownIndexes, err := GetMessageIndexes()
+	if err != nil {
+		return nil, fmt.Errorf("GetBalanceBySMS: Failed to get message indexes.\n%s", err.Error())
+	}
+	known := make(map[int]bool)
+	for _, index := range knownIndexes {
+		known[index] = true
+	}
+	_, err = SendMessage(number, text)
+	if err != nil {
+		return nil, fmt.Errorf("GetBalanceBySMS: Failed to send request.\n%s", err.Error())
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		indexes, err := GetMessageIndexes()
 		if err != nil {
-			return 0.0, fmt.Errorf("GetBalance: Failed to convert to float64 \"%s\"", balanceRaw)
+			return nil, fmt.Errorf("GetBalanceBySMS: Failed to get message indexes.\n%s", err.Error())
 		}
-		return balance, nil
+		for _, index := range indexes {
+			if known[index] {
+				continue
+			}
+			known[index] = true
+			msg, err := GetMessage(index)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if !strings.HasSuffix(msg.Sender, strings.TrimPrefix(number, "+")) {
+				continue
+			}
+			DeleteMessage(index)
+			return ParseBalance(msg.Body, pattern)
+		}
+		time.Sleep(time.Second * 5)
 	}
-	if err != nil {
-		return 0.0, err
+	return nil, fmt.Errorf("GetBalanceBySMS: Timed out waiting for reply from %s", number)
+}
+
+// ParseBalance extracts the named groups "amount" and "currency" of pattern
+// from raw. Both "." and "," are accepted as decimal separator.
+func ParseBalance(raw string, pattern *regexp.Regexp) (*common.Balance, error) {
+	match := pattern.FindStringSubmatch(raw)
+	if match == nil {
+		return nil, fmt.Errorf("ParseBalance: Failed to find balance string in \"%s\"", raw)
 	}
-	return 0.0, errors.New("GetBalace: Failed to get balance.")
+	balance := &common.Balance{Raw: raw, Time: time.Now()}
+	for i, name := range pattern.SubexpNames() {
+		switch name {
+		case "amount":
+			amount, err := parseAmount(match[i])
+			if err != nil {
+				return nil, fmt.Errorf("ParseBalance: Failed to convert to float64 \"%s\"", match[i])
+			}
+			balance.Amount = amount
+		case "currency":
+			balance.Currency = match[i]
+		}
+	}
+	return balance, nil
 }
 
-func SendMessage(mobile string, message string) error {
+// parseAmount reads amounts such as "1 234,56", "1.234,56" or "1,234.56":
+// the last "." or "," separates the decimals, the others group thousands.
+func parseAmount(raw string) (float64, error) {
+	amount := strings.Replace(raw, " ", "", -1)
+	if i := strings.LastIndexAny(amount, ".,"); i >= 0 {
+		integer := strings.NewReplacer(".", "", ",", "").Replace(amount[:i])
+		amount = integer + "." + amount[i+1:]
+	}
+	return strconv.ParseFloat(amount, 64)
+}
+
+// SendMessage returns the message reference assigned by the network, which
+// is repeated in the status report of the message.
+func SendMessage(mobile string, message string) (int, error) {
+	session.Lock()
+	defer session.Unlock()
+	return sendMessage(mobile, message)
+}
+
+func sendMessage(mobile string, message string) (int, error) {
 	log.Println("SendMessage...", mobile, message)
 	// Put Modem in SMS Text Mode
 	_, err = SendCommand("AT+CMGF=1\r", true)
 	if err != nil {
-		return fmt.Errorf("SendMessage: Failed to send command.\n%s", err.Error())
+		return 0, fmt.Errorf("SendMessage: Failed to send command.\n%s", err.Error())
 	}
 	// Send message
 	_, err = SendCommand("AT+CMGS=\""+mobile+"\"\r", false)
 	if err != nil {
-		return fmt.Errorf("SendMessage: Failed to send command.\n%s", err.Error())
+		return 0, fmt.Errorf("SendMessage: Failed to send command.\n%s", err.Error())
 	}
 	_, err = WaitForOutput(waitReps, "\r\n> ")
 	if err != nil {
-		return fmt.Errorf("SendMessage: Failed to wait for output.\n%s", err.Error())
+		return 0, fmt.Errorf("SendMessage: Failed to wait for output.\n%s", err.Error())
 	}
 	// EOM CTRL-Z = 26
-	_, err = SendCommand(message+string(26), true)
+	status, err := SendCommand(message+"\x1a", true)
 	if err != nil {
-		return fmt.Errorf("SendMessage: Failed to send command.\n%s", err.Error())
+		return 0, fmt.Errorf("SendMessage: Failed to send command.\n%s", err.Error())
 	}
-	return nil
+	match := regexp.MustCompile(`\+CMGS: (\d+)`).FindStringSubmatch(status)
+	if match == nil {
+		log.Printf("SendMessage: No message reference in %#v", status)
+		return 0, nil
+	}
+	return strconv.Atoi(match[1])
+}
+
+// ErrorCode extracts the code of a "+CMS ERROR: 500" or "+CME ERROR: 10"
+// reply from an error returned by this package, e.g. "CMS 500".
+func ErrorCode(err error) string {
+	match := regexp.MustCompile(`(CM[ES]) ERROR:? *(\d+)`).FindStringSubmatch(err.Error())
+	if match == nil {
+		return ""
+	}
+	return match[1] + " " + match[2]
 }
 
 func DeleteMessage(messageIndex int) error {
+	session.Lock()
+	defer session.Unlock()
+	return deleteMessage(messageIndex)
+}
+
+func deleteMessage(messageIndex int) error {
 	log.Println("DeleteMessage...")
 	// Put Modem in SMS Text Mode
 	SendCommand("AT+CMGF=1\r", true)
@@ -244,12 +363,40 @@ func DeleteMessage(messageIndex int) error {
 }
 
 func GetMessage(messageIndex int) (*message, error) {
+	session.Lock()
+	defer session.Unlock()
+	return getMessage(messageIndex)
+}
+
+func getMessage(messageIndex int) (*message, error) {
 	log.Println("GetMessage...")
 	status, err := SendCommand(fmt.Sprintf("AT+CMGR=%d\r", messageIndex), true)
 	if err != nil {
 		return nil, fmt.Errorf("GetMessage: Failed to send command.\n%s", err.Error())
 	}
 	log.Printf("GetMessage: %#v\n", status)
+	// +CMGR: <stat>,<fo>,<mr>,<ra>,<tora>,<scts>,<dt>,<st>
+	report := regexp.MustCompile(`CMGR: "([A-Z ]*)",\d+,(\d+),"([+\d]*)",\d*,"([0-9/,:\+]*)","([0-9/,:\+]*)",(\d+)`)
+	if report.MatchString(status) {
+		msg := report.FindStringSubmatch(status)
+		reference, _ := strconv.Atoi(msg[2])
+		sentDate, _ := time.Parse("06/01/02,15:04:05-07", msg[4])
+		deliveredDate, _ := time.Parse("06/01/02,15:04:05-07", msg[5])
+		reportStatus, _ := strconv.Atoi(msg[6])
+		log.Printf("GetMessage: %v status report %v %#v %v\n", messageIndex, reference, msg[3], reportStatus)
+		return &message{
+			Labels: msg[1],
+			Date:   sentDate,
+			Sender: msg[3],
+			Index:  messageIndex,
+			Report: &statusReport{
+				Reference: reference,
+				Recipient: msg[3],
+				Delivered: deliveredDate,
+				Status:    reportStatus,
+			},
+		}, nil
+	}
 	regex := regexp.MustCompile(`(?Us)CMGR: "([A-Z ]*)","([+\d]*)",,"([0-9/,:\+]*)"\r\n(.*)\r\n\r\nOK`)
 	if regex.MatchString(status) {
 		msg := regex.FindStringSubmatch(status)
@@ -288,6 +435,12 @@ func GetMessage(messageIndex int) (*message, error) {
 }
 
 func GetMessageIndexes() ([]int, error) {
+	session.Lock()
+	defer session.Unlock()
+	return getMessageIndexes()
+}
+
+func getMessageIndexes() ([]int, error) {
 	var messageIndexes []int
 	log.Println("GetMessageIndexes...")
 	// Put Modem in SMS Text Mode
@@ -319,15 +472,17 @@ func GetMessageIndexes() ([]int, error) {
 }
 
 func GetMessages() ([]*message, error) {
+	session.Lock()
+	defer session.Unlock()
 	log.Println("GetMesages...")
 	var messages []*message
-	messageIndexes, err := GetMessageIndexes()
+	messageIndexes, err := getMessageIndexes()
 	if err != nil {
 		return messages, err
 	}
 	log.Println("GetMessages:", messageIndexes)
 	for _, messageIndex := range messageIndexes {
-		msg, err := GetMessage(messageIndex)
+		msg, err := getMessage(messageIndex)
 		if err != nil {
 			return messages, err
 		} else {
@@ -3,6 +3,7 @@ package modem
 import (
 	"bytes"
 	"reflect"
+	"regexp"
 	"testing"
 	"time"
 )
@@ -44,7 +45,8 @@ func (p *FakePort) Write(b []byte) (n int, err error) {
 		"AT+CMGR=3\r":                    "\r\n+CMGR: \"REC READ\",\"53525151\",,\"15/10/29,17:49:08+08\"\r\n42616C616E732034362E303068726E2C20626F6E757320302E303068726E2E0A2A2A2A0A5A616C7973686F6B207363686F64656E6E6F676F2070616B65747520706F736C75673A203435534D533B2042657A6C696D69746E69206876796C796E79206E61206C6966653A293B2035302E304D4220496E7465726E6574753B20447A76696E6B7920706F203235206B6F702F6876206E6120696E\r\n\r\nOK\r\n",
 		"AT+CMGR=17\r":                   "\r\n+CMGR: \"REC READ\",\"+380631234567\",,\"15/11/01,03:20:05+08\"\r\ntest\r\n\r\nOK\r\n",
 		"AT+CMGS=\"+380631234567\"\r":    "\r\n> ",
-		"test" + string(26):              "\r\nOK\r\n",
+		"test\x1a":                       "\r\n+CMGS: 12\r\n\r\nOK\r\n",
+		"AT+CMGR=5\r":                    "\r\n+CMGR: \"REC UNREAD\",6,12,\"+380631234567\",145,\"15/11/02,17:34:06+08\",\"15/11/02,17:34:10+08\",0\r\n\r\nOK\r\n",
 	}
 	if KnownCommands[string(b)] != "" {
 		p.buffer = ([]byte(KnownCommands[string(b)]))
@@ -175,10 +177,37 @@ func TestGetMessages(t *testing.T) {
 }
 
 func TestSendMessage(t *testing.T) {
-	err = SendMessage("+380631234567", "test")
+	reference, err := SendMessage("+380631234567", "test")
 	if err != nil {
 		t.Fatal(err)
 	}
+	if reference != 12 {
+		t.Fatalf("Expected reference 12, got %#v", reference)
+	}
+}
+
+func TestGetStatusReport(t *testing.T) {
+	expectedTime, _ := time.Parse("06/01/02,15:04:05-07", "15/11/02,17:34:10+08")
+	msg, err := GetMessage(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Report == nil {
+		t.Fatal("Expected a status report")
+	}
+	if msg.Report.Reference != 12 || msg.Report.Recipient != "+380631234567" ||
+		msg.Report.Status != 0 || !msg.Report.Delivered.Equal(expectedTime) {
+		t.Fatalf("Unexpected status report %#v", msg.Report)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	m.Port.Flush()
+	m.Port.(*FakePort).buffer = []byte("\r\n+CMS ERROR: 500\r\n")
+	_, err := WaitForOutput(waitReps, "OK\r\n")
+	if ErrorCode(err) != "CMS 500" {
+		t.Fatalf("Expected \"CMS 500\", got %#v from %v", ErrorCode(err), err)
+	}
 }
 
 func TestDeleteMessage(t *testing.T) {
@@ -190,12 +219,37 @@ func TestDeleteMessage(t *testing.T) {
 
 func TestGetBalance(t *testing.T) {
 	balanceExpected := 107.0
-	balance, err := GetBalance(`*111#`)
+	balance, err := GetBalance(`*111#`, regexp.MustCompile(`(?P<amount>\d+\.\d+)(?P<currency>[a-z]+)`))
 	if err != nil {
 		t.Fatal(err)
 	}
-	if balance != balanceExpected {
-		t.Fatalf("Expected %#v\nGot %#v", balanceExpected, balance)
+	if balance.Amount != balanceExpected {
+		t.Fatalf("Expected %#v\nGot %#v", balanceExpected, balance.Amount)
+	}
+	if balance.Currency != "hrn" {
+		t.Fatalf("Expected \"hrn\", got %#v", balance.Currency)
+	}
+}
+
+func TestParseBalance(t *testing.T) {
+	pattern := regexp.MustCompile(`Balance: (?P<amount>[\d ]+,\d+) (?P<currency>\w+)`)
+	balance, err := ParseBalance("Bonus 5,00 UAH. Balance: 1 234,56 UAH", pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Amount != 1234.56 || balance.Currency != "UAH" {
+		t.Fatalf("Expected 1234.56 UAH, got %#v %#v", balance.Amount, balance.Currency)
+	}
+	pattern = regexp.MustCompile(`Balance: (?P<amount>[\d.,]+)`)
+	for raw, expected := range map[string]float64{"1.234,56": 1234.56, "1,234.56": 1234.56, "12,50": 12.5, "7": 7} {
+		balance, err = ParseBalance("Balance: "+raw, pattern)
+		if err != nil || balance.Amount != expected {
+			t.Fatalf("Expected %v for %s, got %#v %v", expected, raw, balance, err)
+		}
+	}
+	_, err = ParseBalance("Service unavailable", pattern)
+	if err == nil {
+		t.Fatal("Expected error for reply without balance")
 	}
 }
 
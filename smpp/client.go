@@ -0,0 +1,248 @@
+package smpp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrNotBound is returned by Submit while the client is not bound.
+var ErrNotBound = errors.New("not bound")
+
+// StatusError is a request rejected by the SMSC.
+type StatusError struct {
+	CommandID uint32
+	Status    uint32
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("command %#08x failed with status %#08x", e.CommandID, e.Status)
+}
+
+// reconnectDelay after a failed connection or bind
+const reconnectDelay = 5 * time.Second
+
+// Client is bound as transceiver to an SMSC. It reconnects when the
+// connection fails and keeps it alive with enquire_link.
+type Client struct {
+	// Address of the SMSC as host:port
+	Address string
+	Bind    Bind
+	// Window is the number of requests awaiting a response
+	Window int
+	// EnquireLink is the interval of keepalives
+	EnquireLink time.Duration
+	// Timeout of responses
+	Timeout time.Duration
+	// OnDeliver is called with every deliver_sm, which is acknowledged once
+	// it returns
+	OnDeliver func(m *ShortMessage)
+
+	mu      sync.Mutex
+	conn    *Conn
+	pending map[uint32]chan *PDU
+	window  chan struct{}
+	closed  chan struct{}
+}
+
+// Start connects in the background.
+func (c *Client) Start() {
+	c.window = make(chan struct{}, c.Window)
+	c.closed = make(chan struct{})
+	go c.run()
+}
+
+// Close unbinds and stops reconnecting.
+func (c *Client) Close() {
+	close(c.closed)
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		// the response is not awaited
+		conn.Request(Unbind, nil)
+		conn.Close()
+	}
+}
+
+// Bound reports whether the client is bound.
+func (c *Client) Bound() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+func (c *Client) run() {
+	for {
+		err := c.session()
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+		log.Printf("smpp: %s %s", c.Address, err.Error())
+		select {
+		case <-c.closed:
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// session connects, binds and reads until the connection fails.
+func (c *Client) session() error {
+	netConn, err := net.DialTimeout("tcp", c.Address, c.Timeout)
+	if err != nil {
+		return err
+	}
+	conn := NewConn(netConn)
+	defer conn.Close()
+	sequence, err := conn.Request(BindTransceiver, c.Bind.Encode())
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	resp, err := conn.ReadPDU()
+	if err != nil {
+		return fmt.Errorf("bind: %s", err.Error())
+	}
+	if resp.CommandID != BindTransceiverResp || resp.Sequence != sequence || resp.Status != StatusOK {
+		return fmt.Errorf("bind: %s", &StatusError{CommandID: BindTransceiver, Status: resp.Status})
+	}
+	log.Printf("smpp: bound to %s as %s", c.Address, c.Bind.SystemID)
+
+	c.mu.Lock()
+	c.conn = conn
+	c.pending = make(map[uint32]chan *PDU)
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		// waiting requests fail on their closed channels
+		for _, ch := range c.pending {
+			close(ch)
+		}
+		c.pending = nil
+		c.mu.Unlock()
+	}()
+	go c.keepAlive(conn)
+	for {
+		// enquire_link responses arrive well within two intervals
+		conn.SetReadDeadline(time.Now().Add(2*c.EnquireLink + c.Timeout))
+		p, err := conn.ReadPDU()
+		if err != nil {
+			return err
+		}
+		switch {
+		case p.IsResponse():
+			c.mu.Lock()
+			ch, ok := c.pending[p.Sequence]
+			delete(c.pending, p.Sequence)
+			c.mu.Unlock()
+			if ok {
+				ch <- p
+			}
+		case p.CommandID == DeliverSM:
+			m, err := DecodeShortMessage(p.Body)
+			if err != nil {
+				log.Printf("smpp: %s %s", c.Address, err.Error())
+				conn.Respond(p, StatusInvalidCmdLen, EncodeCString(""))
+				continue
+			}
+			if c.OnDeliver != nil {
+				c.OnDeliver(m)
+			}
+			conn.Respond(p, StatusOK, EncodeCString(""))
+		case p.CommandID == EnquireLink:
+			conn.Respond(p, StatusOK, nil)
+		case p.CommandID == Unbind:
+			conn.Respond(p, StatusOK, nil)
+			return fmt.Errorf("unbound by the SMSC")
+		default:
+			conn.WritePDU(&PDU{CommandID: GenericNack, Status: StatusInvalidCmdID, Sequence: p.Sequence})
+		}
+	}
+}
+
+func (c *Client) keepAlive(conn *Conn) {
+	ticker := time.NewTicker(c.EnquireLink)
+	defer ticker.Stop()
+	for range ticker.C {
+		// sent outside the window, a busy bind is still alive
+		resp, err := c.send(conn, EnquireLink, nil)
+		if err == ErrNotBound {
+			return
+		} else if err != nil && resp == nil {
+			log.Printf("smpp: %s enquire_link failed. %s", c.Address, err.Error())
+			conn.Close()
+			return
+		}
+	}
+}
+
+// request sends a request on conn within the window and waits for its
+// response.
+func (c *Client) request(conn *Conn, commandID uint32, body []byte) (*PDU, error) {
+	select {
+	case c.window <- struct{}{}:
+		defer func() { <-c.window }()
+	case <-time.After(c.Timeout):
+		return nil, fmt.Errorf("window of %d requests is full", c.Window)
+	}
+	return c.send(conn, commandID, body)
+}
+
+// send sends a request on conn and waits for its response.
+func (c *Client) send(conn *Conn, commandID uint32, body []byte) (*PDU, error) {
+	ch := make(chan *PDU, 1)
+	sequence := conn.NextSequence()
+	// registered before writing, the response may come right away
+	c.mu.Lock()
+	if c.conn != conn || c.pending == nil {
+		c.mu.Unlock()
+		return nil, ErrNotBound
+	}
+	c.pending[sequence] = ch
+	c.mu.Unlock()
+	err := conn.WritePDU(&PDU{CommandID: commandID, Sequence: sequence, Body: body})
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(c.Timeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, ErrNotBound
+		}
+		if resp.Status != StatusOK {
+			return resp, &StatusError{CommandID: commandID, Status: resp.Status}
+		}
+		return resp, nil
+	case <-timer.C:
+		c.mu.Lock()
+		if c.pending != nil {
+			delete(c.pending, sequence)
+		}
+		c.mu.Unlock()
+		return nil, fmt.Errorf("no response to %#08x within %s", commandID, c.Timeout)
+	}
+}
+
+// Submit sends a submit_sm and returns the message_id given by the SMSC.
+func (c *Client) Submit(m *ShortMessage) (string, error) {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return "", ErrNotBound
+	}
+	resp, err := c.request(conn, SubmitSM, m.Encode())
+	if err != nil {
+		return "", err
+	}
+	return DecodeCString(resp.Body)
+}
@@ -0,0 +1,152 @@
+package smpp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// stubSMSC accepts one connection, binds it, answers submit_sm with id and
+// then sends a receipt of it.
+func stubSMSC(t *testing.T, listener net.Listener, id string, enquired chan bool) {
+	netConn, err := listener.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conn := NewConn(netConn)
+	defer conn.Close()
+	for {
+		p, err := conn.ReadPDU()
+		if err != nil {
+			return
+		}
+		switch p.CommandID {
+		case BindTransceiver:
+			b, err := DecodeBind(p.Body)
+			if err != nil || b.Password != "secret" {
+				conn.Respond(p, StatusBindFailed, nil)
+				continue
+			}
+			conn.Respond(p, StatusOK, EncodeCString("smsc"))
+		case SubmitSM:
+			m, err := DecodeShortMessage(p.Body)
+			if err == nil && m.Dest == "slow" {
+				// left without a response until the client times out
+				continue
+			}
+			if err != nil || m.Dest != "380631234567" {
+				conn.Respond(p, StatusInvalidDstAddr, nil)
+				continue
+			}
+			conn.Respond(p, StatusOK, EncodeCString(id))
+			receipt := &ShortMessage{ESMClass: ESMClassReceipt,
+				TLVs: map[uint16][]byte{TagReceiptedMessageID: EncodeCString(id)}}
+			receipt.DataCoding, receipt.Message = EncodeText((&Receipt{ID: id, Stat: "DELIVRD"}).String())
+			conn.Request(DeliverSM, receipt.Encode())
+		case EnquireLink:
+			conn.Respond(p, StatusOK, nil)
+			select {
+			case enquired <- true:
+			default:
+			}
+		case Unbind:
+			conn.Respond(p, StatusOK, nil)
+			return
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	enquired := make(chan bool, 1)
+	go stubSMSC(t, listener, "abc123", enquired)
+
+	delivered := make(chan *ShortMessage, 1)
+	c := &Client{
+		Address:     listener.Addr().String(),
+		Bind:        Bind{SystemID: "gateway", Password: "secret", InterfaceVersion: 0x34},
+		Window:      2,
+		EnquireLink: 100 * time.Millisecond,
+		Timeout:     time.Second,
+		OnDeliver:   func(m *ShortMessage) { delivered <- m },
+	}
+	_, err = c.Submit(&ShortMessage{Dest: "380631234567"})
+	if err != ErrNotBound {
+		t.Fatalf("Expected ErrNotBound before Start, got %v", err)
+	}
+	c.Start()
+	defer c.Close()
+	for i := 0; !c.Bound(); i++ {
+		if i > 100 {
+			t.Fatal("Expected the client to bind")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m := &ShortMessage{Dest: "380631234567", DestTON: TONInternational}
+	m.DataCoding, m.Message = EncodeText("hello")
+	id, err := c.Submit(m)
+	if err != nil || id != "abc123" {
+		t.Fatalf("Expected message id abc123, got %q %v", id, err)
+	}
+	select {
+	case m := <-delivered:
+		text, _ := DecodeText(m.DataCoding, m.Message)
+		r, err := ParseReceipt(text)
+		if err != nil || r.ID != "abc123" || r.Stat != "DELIVRD" {
+			t.Fatalf("Unexpected receipt %q %v", text, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the receipt to be delivered")
+	}
+
+	_, err = c.Submit(&ShortMessage{Dest: "12"})
+	statusErr, ok := err.(*StatusError)
+	if !ok || statusErr.Status != StatusInvalidDstAddr {
+		t.Fatalf("Expected a StatusError, got %v", err)
+	}
+	select {
+	case <-enquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected an enquire_link")
+	}
+
+	// a full window must not hold back enquire_link
+	for i := 0; i < c.Window; i++ {
+		go c.Submit(&ShortMessage{Dest: "slow"})
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-enquired:
+	default:
+	}
+	select {
+	case <-enquired:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Expected an enquire_link with a full window")
+	}
+	if !c.Bound() {
+		t.Fatal("Expected the client to stay bound")
+	}
+}
+
+func TestParseReceipt(t *testing.T) {
+	r, err := ParseReceipt("id:7Fe0 sub:001 dlvrd:000 submit date:2610191200 done date:2610191201 " +
+		"stat:undeliv err:034 text:hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != "7Fe0" || r.Stat != "UNDELIV" || r.Err != 34 || r.Text != "hello" ||
+		!r.Done.Equal(time.Date(2026, 10, 19, 12, 1, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected receipt %#v", r)
+	}
+	_, err = ParseReceipt("hello")
+	if err == nil {
+		t.Fatal("Expected a text without id and stat to be rejected")
+	}
+}
@@ -0,0 +1,53 @@
+package smpp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// writeTimeout of a PDU, a peer not reading is considered gone
+const writeTimeout = 10 * time.Second
+
+// Conn reads and writes PDUs. Writes may happen from several goroutines.
+type Conn struct {
+	net.Conn
+	mu       sync.Mutex
+	sequence uint32
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{Conn: conn}
+}
+
+func (c *Conn) ReadPDU() (*PDU, error) {
+	return ReadPDU(c.Conn)
+}
+
+func (c *Conn) WritePDU(p *PDU) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.Conn.Write(p.Bytes())
+	return err
+}
+
+// NextSequence returns the sequence number of the next request.
+func (c *Conn) NextSequence() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// sequence numbers range from 1 to 0x7FFFFFFF
+	c.sequence = c.sequence%0x7FFFFFFF + 1
+	return c.sequence
+}
+
+// Request sends a request with the next sequence number and returns it.
+func (c *Conn) Request(commandID uint32, body []byte) (uint32, error) {
+	sequence := c.NextSequence()
+	return sequence, c.WritePDU(&PDU{CommandID: commandID, Sequence: sequence, Body: body})
+}
+
+// Respond answers req with status.
+func (c *Conn) Respond(req *PDU, status uint32, body []byte) error {
+	return c.WritePDU(&PDU{CommandID: req.CommandID | GenericNack, Status: status, Sequence: req.Sequence, Body: body})
+}
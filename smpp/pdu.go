@@ -0,0 +1,361 @@
+// Package smpp implements the parts of SMPP 3.4 used by the gateway: binds,
+// submit_sm, deliver_sm, enquire_link and unbind.
+package smpp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Command ids
+const (
+	GenericNack         uint32 = 0x80000000
+	BindReceiver        uint32 = 0x00000001
+	BindReceiverResp    uint32 = 0x80000001
+	BindTransmitter     uint32 = 0x00000002
+	BindTransmitterResp uint32 = 0x80000002
+	SubmitSM            uint32 = 0x00000004
+	SubmitSMResp        uint32 = 0x80000004
+	DeliverSM           uint32 = 0x00000005
+	DeliverSMResp       uint32 = 0x80000005
+	Unbind              uint32 = 0x00000006
+	UnbindResp          uint32 = 0x80000006
+	BindTransceiver     uint32 = 0x00000009
+	BindTransceiverResp uint32 = 0x80000009
+	EnquireLink         uint32 = 0x00000015
+	EnquireLinkResp     uint32 = 0x80000015
+)
+
+// Command statuses
+const (
+	StatusOK             uint32 = 0x00000000
+	StatusInvalidMsgLen  uint32 = 0x00000001
+	StatusInvalidCmdLen  uint32 = 0x00000002
+	StatusInvalidCmdID   uint32 = 0x00000003
+	StatusInvalidBindSts uint32 = 0x00000004
+	StatusAlreadyBound   uint32 = 0x00000005
+	StatusSysErr         uint32 = 0x00000008
+	StatusInvalidSrcAddr uint32 = 0x0000000A
+	StatusInvalidDstAddr uint32 = 0x0000000B
+	StatusBindFailed     uint32 = 0x0000000D
+	StatusMsgQueueFull   uint32 = 0x00000014
+	StatusInvalidESM     uint32 = 0x00000043
+	StatusSubmitFailed   uint32 = 0x00000045
+	StatusThrottled      uint32 = 0x00000058
+)
+
+// Optional parameter tags
+const (
+	TagReceiptedMessageID uint16 = 0x001E
+	TagMessagePayload     uint16 = 0x0424
+	TagMessageState       uint16 = 0x0427
+)
+
+// Message states of delivery receipts
+const (
+	StateEnroute       byte = 1
+	StateDelivered     byte = 2
+	StateExpired       byte = 3
+	StateDeleted       byte = 4
+	StateUndeliverable byte = 5
+	StateAccepted      byte = 6
+	StateUnknown       byte = 7
+	StateRejected      byte = 8
+)
+
+// ESMClassReceipt marks a deliver_sm as a delivery receipt
+const ESMClassReceipt byte = 0x04
+
+// ESMClassUDHI marks a short message starting with a user data header
+const ESMClassUDHI byte = 0x40
+
+// Address types of number
+const (
+	TONInternational byte = 0x01
+	TONAlphanumeric  byte = 0x05
+)
+
+// headerLength of every PDU
+const headerLength = 16
+
+// maxLength of a PDU, longer ones are rejected
+const maxLength = 64 * 1024
+
+// PDU is a protocol data unit with its body still encoded.
+type PDU struct {
+	CommandID uint32
+	Status    uint32
+	Sequence  uint32
+	Body      []byte
+}
+
+// IsResponse reports whether p answers a request.
+func (p *PDU) IsResponse() bool {
+	return p.CommandID&GenericNack != 0
+}
+
+func (p *PDU) String() string {
+	return fmt.Sprintf("PDU{command: %#08x, status: %#x, sequence: %d, length: %d}",
+		p.CommandID, p.Status, p.Sequence, len(p.Body))
+}
+
+// ReadPDU reads one PDU from r.
+func ReadPDU(r io.Reader) (*PDU, error) {
+	header := make([]byte, headerLength)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length < headerLength || length > maxLength {
+		return nil, fmt.Errorf("ReadPDU: invalid command length %d", length)
+	}
+	p := &PDU{
+		CommandID: binary.BigEndian.Uint32(header[4:]),
+		Status:    binary.BigEndian.Uint32(header[8:]),
+		Sequence:  binary.BigEndian.Uint32(header[12:]),
+		Body:      make([]byte, length-headerLength)}
+	_, err = io.ReadFull(r, p.Body)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Bytes encodes p with its header.
+func (p *PDU) Bytes() []byte {
+	buf := make([]byte, headerLength, headerLength+len(p.Body))
+	binary.BigEndian.PutUint32(buf, uint32(headerLength+len(p.Body)))
+	binary.BigEndian.PutUint32(buf[4:], p.CommandID)
+	binary.BigEndian.PutUint32(buf[8:], p.Status)
+	binary.BigEndian.PutUint32(buf[12:], p.Sequence)
+	return append(buf, p.Body...)
+}
+
+// encoder appends fields of a PDU body.
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) cstring(s string) {
+	e.WriteString(s)
+	e.WriteByte(0)
+}
+
+func (e *encoder) tlv(tag uint16, value []byte) {
+	var header [4]byte
+	binary.BigEndian.PutUint16(header[:], tag)
+	binary.BigEndian.PutUint16(header[2:], uint16(len(value)))
+	e.Write(header[:])
+	e.Write(value)
+}
+
+// decoder reads fields of a PDU body and keeps the first error.
+type decoder struct {
+	body []byte
+	err  error
+}
+
+func (d *decoder) cstring(max int) string {
+	if d.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(d.body, 0)
+	if i < 0 || i >= max {
+		d.err = fmt.Errorf("invalid C-Octet String")
+		return ""
+	}
+	s := string(d.body[:i])
+	d.body = d.body[i+1:]
+	return s
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.body) < 1 {
+		d.err = fmt.Errorf("body too short")
+		return 0
+	}
+	b := d.body[0]
+	d.body = d.body[1:]
+	return b
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.body) < n {
+		d.err = fmt.Errorf("body too short")
+		return nil
+	}
+	b := d.body[:n]
+	d.body = d.body[n:]
+	return b
+}
+
+// tlvs reads the optional parameters at the end of the body.
+func (d *decoder) tlvs() map[uint16][]byte {
+	tlvs := make(map[uint16][]byte)
+	for d.err == nil && len(d.body) > 0 {
+		header := d.bytes(4)
+		if d.err != nil {
+			break
+		}
+		tag := binary.BigEndian.Uint16(header)
+		tlvs[tag] = d.bytes(int(binary.BigEndian.Uint16(header[2:])))
+	}
+	return tlvs
+}
+
+// Bind is the body of bind_transmitter, bind_receiver and bind_transceiver.
+type Bind struct {
+	SystemID         string
+	Password         string
+	SystemType       string
+	InterfaceVersion byte
+	AddrTON          byte
+	AddrNPI          byte
+	AddressRange     string
+}
+
+func (b *Bind) Encode() []byte {
+	var e encoder
+	e.cstring(b.SystemID)
+	e.cstring(b.Password)
+	e.cstring(b.SystemType)
+	e.WriteByte(b.InterfaceVersion)
+	e.WriteByte(b.AddrTON)
+	e.WriteByte(b.AddrNPI)
+	e.cstring(b.AddressRange)
+	return e.Bytes()
+}
+
+func DecodeBind(body []byte) (*Bind, error) {
+	d := &decoder{body: body}
+	b := &Bind{
+		SystemID:         d.cstring(16),
+		Password:         d.cstring(9),
+		SystemType:       d.cstring(13),
+		InterfaceVersion: d.byte(),
+		AddrTON:          d.byte(),
+		AddrNPI:          d.byte(),
+		AddressRange:     d.cstring(41)}
+	if d.err != nil {
+		return nil, fmt.Errorf("DecodeBind: %s", d.err.Error())
+	}
+	return b, nil
+}
+
+// EncodeCString is the body of bind responses (system_id) and submit_sm_resp
+// (message_id).
+func EncodeCString(s string) []byte {
+	var e encoder
+	e.cstring(s)
+	return e.Bytes()
+}
+
+// DecodeCString returns the first C-Octet String of body.
+func DecodeCString(body []byte) (string, error) {
+	d := &decoder{body: body}
+	s := d.cstring(len(body))
+	return s, d.err
+}
+
+// ShortMessage is the body of submit_sm and deliver_sm.
+type ShortMessage struct {
+	ServiceType          string
+	SourceTON            byte
+	SourceNPI            byte
+	Source               string
+	DestTON              byte
+	DestNPI              byte
+	Dest                 string
+	ESMClass             byte
+	ProtocolID           byte
+	PriorityFlag         byte
+	ScheduleDeliveryTime string
+	ValidityPeriod       string
+	RegisteredDelivery   byte
+	ReplaceIfPresent     byte
+	DataCoding           byte
+	SMDefaultMsgID       byte
+	Message              []byte
+	TLVs                 map[uint16][]byte
+}
+
+func (m *ShortMessage) Encode() []byte {
+	var e encoder
+	e.cstring(m.ServiceType)
+	e.WriteByte(m.SourceTON)
+	e.WriteByte(m.SourceNPI)
+	e.cstring(m.Source)
+	e.WriteByte(m.DestTON)
+	e.WriteByte(m.DestNPI)
+	e.cstring(m.Dest)
+	e.WriteByte(m.ESMClass)
+	e.WriteByte(m.ProtocolID)
+	e.WriteByte(m.PriorityFlag)
+	e.cstring(m.ScheduleDeliveryTime)
+	e.cstring(m.ValidityPeriod)
+	e.WriteByte(m.RegisteredDelivery)
+	e.WriteByte(m.ReplaceIfPresent)
+	e.WriteByte(m.DataCoding)
+	e.WriteByte(m.SMDefaultMsgID)
+	message, payload := m.Message, []byte(nil)
+	if len(message) > 254 {
+		// too long for short_message
+		message, payload = nil, m.Message
+	}
+	e.WriteByte(byte(len(message)))
+	e.Write(message)
+	var tags []int
+	for tag := range m.TLVs {
+		tags = append(tags, int(tag))
+	}
+	sort.Ints(tags)
+	for _, tag := range tags {
+		e.tlv(uint16(tag), m.TLVs[uint16(tag)])
+	}
+	if payload != nil {
+		e.tlv(TagMessagePayload, payload)
+	}
+	return e.Bytes()
+}
+
+func DecodeShortMessage(body []byte) (*ShortMessage, error) {
+	d := &decoder{body: body}
+	m := &ShortMessage{
+		ServiceType:          d.cstring(6),
+		SourceTON:            d.byte(),
+		SourceNPI:            d.byte(),
+		Source:               d.cstring(21),
+		DestTON:              d.byte(),
+		DestNPI:              d.byte(),
+		Dest:                 d.cstring(21),
+		ESMClass:             d.byte(),
+		ProtocolID:           d.byte(),
+		PriorityFlag:         d.byte(),
+		ScheduleDeliveryTime: d.cstring(17),
+		ValidityPeriod:       d.cstring(17),
+		RegisteredDelivery:   d.byte(),
+		ReplaceIfPresent:     d.byte(),
+		DataCoding:           d.byte(),
+		SMDefaultMsgID:       d.byte()}
+	length := d.byte()
+	m.Message = d.bytes(int(length))
+	m.TLVs = d.tlvs()
+	if d.err != nil {
+		return nil, fmt.Errorf("DecodeShortMessage: %s", d.err.Error())
+	}
+	if payload, ok := m.TLVs[TagMessagePayload]; ok && len(m.Message) == 0 {
+		m.Message = payload
+		delete(m.TLVs, TagMessagePayload)
+	}
+	return m, nil
+}
@@ -0,0 +1,55 @@
+package smpp
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPDU(t *testing.T) {
+	bind := &Bind{SystemID: "billing", Password: "secret", InterfaceVersion: 0x34}
+	p := &PDU{CommandID: BindTransceiver, Sequence: 7, Body: bind.Encode()}
+	read, err := ReadPDU(bytes.NewReader(p.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, p) {
+		t.Fatalf("Expected %s, got %s", p, read)
+	}
+	decoded, err := DecodeBind(read.Body)
+	if err != nil || *decoded != *bind {
+		t.Fatalf("Expected %#v, got %#v %v", bind, decoded, err)
+	}
+	_, err = DecodeBind(EncodeCString(strings.Repeat("x", 16)))
+	if err == nil {
+		t.Fatal("Expected a too long system_id to be rejected")
+	}
+	_, err = ReadPDU(bytes.NewReader([]byte{0, 0, 0, 8, 0, 0, 0, 0}))
+	if err == nil {
+		t.Fatal("Expected an invalid length to be rejected")
+	}
+}
+
+func TestShortMessage(t *testing.T) {
+	for _, text := range []string{"hello", "привіт", strings.Repeat("long ", 60)} {
+		m := &ShortMessage{Source: "380631234567", SourceTON: TONInternational, RegisteredDelivery: 1,
+			TLVs: map[uint16][]byte{TagMessageState: {StateDelivered}}}
+		m.DataCoding, m.Message = EncodeText(text)
+		decoded, err := DecodeShortMessage(m.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, m) {
+			t.Fatalf("Expected %#v, got %#v", m, decoded)
+		}
+		decodedText, err := DecodeText(decoded.DataCoding, decoded.Message)
+		if err != nil || decodedText != text {
+			t.Fatalf("Expected %q, got %q %v", text, decodedText, err)
+		}
+	}
+	_, err := DecodeText(CodingUCS2, []byte{0, 0x41, 0})
+	if err == nil {
+		t.Fatal("Expected an odd UCS-2 length to be rejected")
+	}
+}
@@ -0,0 +1,70 @@
+package smpp
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// receiptTime is the format of dates in delivery receipts
+const receiptTime = "0601021504"
+
+// Receipt is the text of a delivery receipt in the format of SMPP 3.4
+// appendix B.
+type Receipt struct {
+	ID        string
+	Submitted time.Time
+	Done      time.Time
+	// Stat is DELIVRD, EXPIRED, DELETED, UNDELIV, ACCEPTD, UNKNOWN or REJECTD
+	Stat string
+	Err  int
+	Text string
+}
+
+func (r *Receipt) String() string {
+	text := []rune(r.Text)
+	if len(text) > 20 {
+		text = text[:20]
+	}
+	return fmt.Sprintf("id:%s sub:001 dlvrd:%03d submit date:%s done date:%s stat:%s err:%03d text:%s",
+		r.ID, r.delivered(), r.Submitted.Format(receiptTime), r.Done.Format(receiptTime), r.Stat, r.Err,
+		string(text))
+}
+
+func (r *Receipt) delivered() int {
+	if r.Stat == "DELIVRD" {
+		return 1
+	}
+	return 0
+}
+
+var receiptFields = regexp.MustCompile(`(?i)(id|stat|err|submit date|done date):(\S*)`)
+
+// ParseReceipt parses the text of a delivery receipt. Fields other than id
+// and stat are optional.
+func ParseReceipt(text string) (*Receipt, error) {
+	r := &Receipt{}
+	if i := strings.Index(strings.ToLower(text), "text:"); i >= 0 {
+		text, r.Text = text[:i], text[i+len("text:"):]
+	}
+	for _, field := range receiptFields.FindAllStringSubmatch(text, -1) {
+		switch strings.ToLower(field[1]) {
+		case "id":
+			r.ID = field[2]
+		case "stat":
+			r.Stat = strings.ToUpper(field[2])
+		case "err":
+			r.Err, _ = strconv.Atoi(field[2])
+		case "submit date":
+			r.Submitted, _ = time.Parse(receiptTime, field[2])
+		case "done date":
+			r.Done, _ = time.Parse(receiptTime, field[2])
+		}
+	}
+	if r.ID == "" || r.Stat == "" {
+		return nil, fmt.Errorf("ParseReceipt: not a delivery receipt %q", text)
+	}
+	return r, nil
+}
@@ -0,0 +1,57 @@
+package smpp
+
+import (
+	"fmt"
+	"unicode/utf16"
+)
+
+// Data codings
+const (
+	CodingDefault byte = 0x00
+	CodingIA5     byte = 0x01
+	CodingLatin1  byte = 0x03
+	CodingUCS2    byte = 0x08
+)
+
+// DecodeText returns the text of a short message. The default alphabet is
+// taken as ASCII, like most clients send it.
+func DecodeText(coding byte, b []byte) (string, error) {
+	switch coding {
+	case CodingDefault, CodingIA5, CodingLatin1:
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes), nil
+	case CodingUCS2:
+		if len(b)%2 != 0 {
+			return "", fmt.Errorf("DecodeText: odd length of UCS-2 text")
+		}
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			units[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		}
+		return string(utf16.Decode(units)), nil
+	}
+	return "", fmt.Errorf("DecodeText: unsupported data coding %#x", coding)
+}
+
+// EncodeText encodes ASCII text with the default alphabet and any other
+// text as UCS-2.
+func EncodeText(text string) (byte, []byte) {
+	ascii := true
+	for _, r := range text {
+		if r >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return CodingDefault, []byte(text)
+	}
+	var b []byte
+	for _, unit := range utf16.Encode([]rune(text)) {
+		b = append(b, byte(unit>>8), byte(unit))
+	}
+	return CodingUCS2, b
+}
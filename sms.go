@@ -1,9 +1,14 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strconv"
 
 	"github.com/alexgear/sms/api"
+	"github.com/alexgear/sms/common"
 	"github.com/alexgear/sms/config"
 	"github.com/alexgear/sms/database"
 	"github.com/alexgear/sms/modem"
@@ -11,16 +16,37 @@ import (
 )
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n  %s\t\tstart the gateway\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s migrate status\tshow applied and pending migrations\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s migrate up\t\tapply pending migrations\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s migrate down [version]\trevert migrations down to version, one step by default\n", os.Args[0])
+	}
+	flag.Parse()
+
 	cfg, err := config.New("config.toml")
 	if err != nil {
 		log.Fatalf("main: Invalid config: %s", err.Error())
 	}
 
-	db, err := database.InitDB("db.sqlite")
-	defer db.Close()
+	common.DefaultCountryCode = cfg.DefaultCountryCode
+
+	if flag.Arg(0) == "migrate" {
+		err := migrate(cfg.Database, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("main: %s", err.Error())
+		}
+		return
+	} else if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := database.InitDB(cfg.Database)
 	if err != nil {
 		log.Fatalf("main: Error initializing database: %s", err.Error())
 	}
+	defer db.Close()
 
 	err = modem.InitModem(cfg.ComPort, cfg.BaudRate)
 	if err != nil {
@@ -30,9 +56,70 @@ func main() {
 	if err != nil {
 		log.Fatalf("main: error reseting modem. %s", err)
 	}
-	worker.InitWorker()
-	err = api.InitServer(cfg.ServerHost, cfg.ServerPort)
+	err = api.InitSMPP(db, cfg)
+	if err != nil {
+		log.Fatalf("main: Error starting SMPP server: %s", err.Error())
+	}
+	err = api.InitEmail(db, cfg)
+	if err != nil {
+		log.Fatalf("main: Error starting SMTP server: %s", err.Error())
+	}
+	api.InitKannel(cfg.Kannel)
+	api.InitTwilio(cfg.Twilio)
+	api.InitForward(cfg.Forward)
+	worker.InitWorker(db, cfg)
+	worker.InitNotifier(cfg.StatusWebhook)
+	worker.InitReceiver(cfg)
+	err = worker.InitBalance(cfg.Balance)
+	if err != nil {
+		log.Fatalf("main: error initializing balance worker. %s", err)
+	}
+	err = api.InitServer(db, cfg)
 	if err != nil {
 		log.Fatalf("main: Error starting server: %s", err.Error())
 	}
 }
+
+func migrate(dsn string, args []string) error {
+	db, err := database.Open(dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if len(args) == 0 {
+		args = []string{"status"}
+	}
+	switch args[0] {
+	case "status":
+		status, err := db.GetMigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-30s %s\n", s.Version, s.Description, applied)
+		}
+		return nil
+	case "up":
+		return db.MigrateUp()
+	case "down":
+		current, err := db.SchemaVersion()
+		if err != nil {
+			return err
+		}
+		target := current - 1
+		if len(args) > 1 {
+			target, err = strconv.Atoi(args[1])
+			if err != nil || target > current {
+				return fmt.Errorf("migrate: invalid version %s", args[1])
+			}
+		}
+		return db.MigrateTo(target)
+	}
+	flag.Usage()
+	os.Exit(2)
+	return nil
+}
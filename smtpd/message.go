@@ -0,0 +1,186 @@
+package smtpd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Text is the plain text of a message and the headers used by the gateway.
+type Text struct {
+	From      string
+	Subject   string
+	Body      string
+	MessageID string
+	// InReplyTo and References of a reply
+	InReplyTo  string
+	References []string
+}
+
+// wordDecoder decodes encoded words of headers in the charsets of decode
+var wordDecoder = &mime.WordDecoder{CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+	b, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	text, err := decode(charset, b)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(text), nil
+}}
+
+// ReadText parses a message and returns its text, the first text/plain part
+// or else a text/html one without the markup.
+func ReadText(data []byte) (*Text, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("ReadText: %s", err.Error())
+	}
+	subject, err := wordDecoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	t := &Text{
+		Subject:    subject,
+		MessageID:  msg.Header.Get("Message-Id"),
+		InReplyTo:  msg.Header.Get("In-Reply-To"),
+		References: strings.Fields(msg.Header.Get("References"))}
+	if from, err := msg.Header.AddressList("From"); err == nil && len(from) > 0 {
+		t.From = from[0].Address
+	}
+	plain, markup, err := readPart(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ReadText: %s", err.Error())
+	}
+	if plain == "" && markup != "" {
+		plain = stripHTML(markup)
+	}
+	t.Body = strings.Replace(plain, "\r\n", "\n", -1)
+	return t, nil
+}
+
+// readPart returns the first text/plain and text/html texts of a part.
+func readPart(contentType string, encoding string, body io.Reader) (string, string, error) {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", "", err
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var plain, markup string
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := r.NextPart()
+			if err == io.EOF {
+				return plain, markup, nil
+			} else if err != nil {
+				return "", "", err
+			}
+			if strings.HasPrefix(part.Header.Get("Content-Disposition"), "attachment") {
+				continue
+			}
+			// quoted-printable parts are decoded by multipart already
+			p, m, err := readPart(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				return "", "", err
+			}
+			if plain == "" {
+				plain = p
+			}
+			if markup == "" {
+				markup = m
+			}
+		}
+	}
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return "", "", nil
+	}
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &newlineSkipper{body})
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", "", err
+	}
+	text, err := decode(params["charset"], b)
+	if err != nil {
+		return "", "", err
+	}
+	if mediaType == "text/html" {
+		return "", text, nil
+	}
+	return text, "", nil
+}
+
+// newlineSkipper drops the line breaks of base64 bodies.
+type newlineSkipper struct {
+	r io.Reader
+}
+
+func (n *newlineSkipper) Read(p []byte) (int, error) {
+	for {
+		count, err := n.r.Read(p)
+		kept := 0
+		for _, b := range p[:count] {
+			if b != '\r' && b != '\n' {
+				p[kept] = b
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// decode returns text in charset as UTF-8. Only UTF-8, US-ASCII and
+// ISO-8859-1 are known, unlabelled text is taken as UTF-8 if valid.
+func decode(charset string, b []byte) (string, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii":
+		if utf8.Valid(b) {
+			return string(b), nil
+		}
+		if charset != "" {
+			return "", fmt.Errorf("invalid %s text", charset)
+		}
+		fallthrough
+	case "iso-8859-1", "latin1":
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes), nil
+	}
+	return "", fmt.Errorf("unsupported charset %s", charset)
+}
+
+var tags = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>|<br\s*/?>|</p>|<[^>]*>`)
+
+// stripHTML returns the text of markup, with line breaks for <br> and </p>.
+func stripHTML(markup string) string {
+	text := tags.ReplaceAllStringFunc(markup, func(tag string) string {
+		lower := strings.ToLower(tag)
+		if strings.HasPrefix(lower, "<br") || lower == "</p>" {
+			return "\n"
+		}
+		return ""
+	})
+	return html.UnescapeString(text)
+}
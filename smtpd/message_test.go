@@ -0,0 +1,37 @@
+package smtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadText(t *testing.T) {
+	messages := map[string]string{
+		"plain": "From: Monitoring <alerts@example.com>\r\nSubject: =?UTF-8?B?0KLQtdGB0YI=?=\r\n\r\nDisk full\r\n",
+		"quoted-printable": "From: alerts@example.com\r\nSubject: =?UTF-8?B?0KLQtdGB0YI=?=\r\n" +
+			"Content-Type: text/plain; charset=iso-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+			"Disk=20full\r\n",
+		"multipart": "From: alerts@example.com\r\nSubject: =?UTF-8?B?0KLQtdGB0YI=?=\r\nMIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+			"--b\r\nContent-Type: text/html\r\n\r\n<p>Disk <b>full</b></p>\r\n" +
+			"--b\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+			"RGlzayBm\r\ndWxs\r\n--b--\r\n",
+		"html": "From: alerts@example.com\r\nSubject: =?UTF-8?B?0KLQtdGB0YI=?=\r\n" +
+			"Content-Type: text/html\r\n\r\n<style>p {}</style><p>Disk&nbsp;full</p>",
+	}
+	for name, message := range messages {
+		text, err := ReadText([]byte(message))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		// &nbsp; of the html is kept as a no-break space
+		body := strings.Replace(strings.TrimSpace(text.Body), "\u00a0", " ", -1)
+		if text.From != "alerts@example.com" || text.Subject != "Тест" || body != "Disk full" {
+			t.Fatalf("%s: unexpected text %#v", name, text)
+		}
+	}
+	_, err := ReadText([]byte("Content-Type: text/plain; charset=koi8-r\r\n\r\ntest"))
+	if err == nil {
+		t.Fatal("Expected an unknown charset to be rejected")
+	}
+}
@@ -0,0 +1,317 @@
+// Package smtpd implements the parts of an SMTP server (RFC 5321) used by
+// the gateway to accept mail: EHLO, AUTH PLAIN and LOGIN, MAIL, RCPT, DATA,
+// RSET, NOOP and QUIT. It does not offer STARTTLS.
+package smtpd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Envelope is a message accepted by the server.
+type Envelope struct {
+	RemoteAddr net.Addr
+	// Username of the session, empty without AUTH
+	Username string
+	From     string
+	To       []string
+	Data     []byte
+}
+
+// Error is returned by the callbacks of a Server to answer with Code.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+// Server accepts mail for the recipients Recipient accepts.
+type Server struct {
+	Hostname string
+	// Auth checks the credentials of AUTH, nil disables AUTH
+	Auth func(username string, password string) bool
+	// Allow reports whether a session without AUTH may send, nil allows
+	// every one
+	Allow func(addr net.Addr) bool
+	// Sender checks the address of MAIL FROM, nil accepts any
+	Sender func(from string) error
+	// Recipient checks an address of RCPT TO of a session authenticated as
+	// username
+	Recipient func(username string, to string) error
+	// Deliver is called with every message, its error rejects the message
+	Deliver func(e *Envelope) error
+	// MaxSize of a message in bytes
+	MaxSize int
+	// Timeout of a command
+	Timeout time.Duration
+}
+
+// Serve accepts connections until listener is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			log.Printf("smtpd: %s", err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+type session struct {
+	s        *Server
+	conn     net.Conn
+	text     *textproto.Conn
+	username string
+	envelope *Envelope
+}
+
+func (s *Server) handle(conn net.Conn) {
+	c := &session{s: s, conn: conn, text: textproto.NewConn(conn)}
+	defer c.text.Close()
+	c.reply(220, s.Hostname+" ESMTP ready")
+	for {
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+		line, err := c.text.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("smtpd: %s %s", conn.RemoteAddr(), err.Error())
+			}
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		if !c.command(strings.ToUpper(verb), arg) {
+			return
+		}
+	}
+}
+
+func (c *session) reply(code int, lines ...string) {
+	for i, line := range lines {
+		separator := " "
+		if i < len(lines)-1 {
+			separator = "-"
+		}
+		c.text.PrintfLine("%d%s%s", code, separator, line)
+	}
+}
+
+// replyError answers with the code of err, 451 if it is not an Error.
+func (c *session) replyError(err error) {
+	var e *Error
+	if errors.As(err, &e) {
+		c.reply(e.Code, e.Message)
+		return
+	}
+	log.Printf("smtpd: %s %s", c.conn.RemoteAddr(), err.Error())
+	c.reply(451, "Local error")
+}
+
+// command answers a command and returns false when the session ends.
+func (c *session) command(verb string, arg string) bool {
+	switch verb {
+	case "HELO":
+		c.envelope = nil
+		c.reply(250, c.s.Hostname)
+	case "EHLO":
+		c.envelope = nil
+		extensions := []string{c.s.Hostname, "8BITMIME", "PIPELINING", fmt.Sprintf("SIZE %d", c.s.MaxSize)}
+		if c.s.Auth != nil {
+			extensions = append(extensions, "AUTH PLAIN LOGIN")
+		}
+		c.reply(250, extensions...)
+	case "AUTH":
+		c.auth(arg)
+	case "MAIL":
+		c.mail(arg)
+	case "RCPT":
+		c.rcpt(arg)
+	case "DATA":
+		c.data()
+	case "RSET":
+		c.envelope = nil
+		c.reply(250, "OK")
+	case "NOOP":
+		c.reply(250, "OK")
+	case "QUIT":
+		c.reply(221, "Bye")
+		return false
+	default:
+		c.reply(502, "Command not implemented")
+	}
+	return true
+}
+
+func (c *session) auth(arg string) {
+	if c.s.Auth == nil {
+		c.reply(502, "Command not implemented")
+		return
+	}
+	if c.username != "" {
+		c.reply(503, "Already authenticated")
+		return
+	}
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		c.reply(501, "Syntax: AUTH mechanism")
+		return
+	}
+	var username, password string
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		response := ""
+		if len(fields) > 1 {
+			response = fields[1]
+		} else {
+			response = c.challenge("")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(response)
+		parts := bytes.Split(decoded, []byte{0})
+		if err != nil || len(parts) != 3 {
+			c.reply(501, "Invalid PLAIN response")
+			return
+		}
+		username, password = string(parts[1]), string(parts[2])
+	case "LOGIN":
+		decoded, err := base64.StdEncoding.DecodeString(c.challenge("Username:"))
+		if err != nil {
+			c.reply(501, "Invalid LOGIN response")
+			return
+		}
+		username = string(decoded)
+		decoded, err = base64.StdEncoding.DecodeString(c.challenge("Password:"))
+		if err != nil {
+			c.reply(501, "Invalid LOGIN response")
+			return
+		}
+		password = string(decoded)
+	default:
+		c.reply(504, "Unrecognized authentication type")
+		return
+	}
+	if username == "" || !c.s.Auth(username, password) {
+		log.Printf("smtpd: invalid credentials of %#v from %s", username, c.conn.RemoteAddr())
+		c.reply(535, "Authentication credentials invalid")
+		return
+	}
+	c.username = username
+	c.reply(235, "Authentication successful")
+}
+
+// challenge sends a 334 with prompt and returns the response.
+func (c *session) challenge(prompt string) string {
+	c.reply(334, base64.StdEncoding.EncodeToString([]byte(prompt)))
+	line, _ := c.text.ReadLine()
+	return strings.TrimSpace(line)
+}
+
+// address returns the address of a "FROM:<address> params" argument.
+func address(arg string, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", false
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", false
+	}
+	return arg[1:end], true
+}
+
+func (c *session) mail(arg string) {
+	if c.envelope != nil {
+		c.reply(503, "Nested MAIL command")
+		return
+	}
+	if c.username == "" && c.s.Allow != nil && !c.s.Allow(c.conn.RemoteAddr()) {
+		c.reply(530, "Authentication required")
+		return
+	}
+	from, ok := address(arg, "FROM:")
+	if !ok {
+		c.reply(501, "Syntax: MAIL FROM:<address>")
+		return
+	}
+	if c.s.Sender != nil {
+		err := c.s.Sender(from)
+		if err != nil {
+			c.replyError(err)
+			return
+		}
+	}
+	c.envelope = &Envelope{RemoteAddr: c.conn.RemoteAddr(), Username: c.username, From: from}
+	c.reply(250, "OK")
+}
+
+func (c *session) rcpt(arg string) {
+	if c.envelope == nil {
+		c.reply(503, "Need MAIL command")
+		return
+	}
+	to, ok := address(arg, "TO:")
+	if !ok {
+		c.reply(501, "Syntax: RCPT TO:<address>")
+		return
+	}
+	if c.s.Recipient != nil {
+		err := c.s.Recipient(c.username, to)
+		if err != nil {
+			c.replyError(err)
+			return
+		}
+	}
+	c.envelope.To = append(c.envelope.To, to)
+	c.reply(250, "OK")
+}
+
+func (c *session) data() {
+	if c.envelope == nil || len(c.envelope.To) == 0 {
+		c.reply(503, "Need RCPT command")
+		return
+	}
+	c.reply(354, "End data with <CR><LF>.<CR><LF>")
+	r := c.text.DotReader()
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(c.s.MaxSize)+1))
+	if err != nil {
+		log.Printf("smtpd: %s %s", c.conn.RemoteAddr(), err.Error())
+		c.reply(451, "Error reading data")
+		c.envelope = nil
+		return
+	}
+	envelope := c.envelope
+	c.envelope = nil
+	if len(data) > c.s.MaxSize {
+		// the rest of the message is read and discarded
+		io.Copy(ioutil.Discard, r)
+		c.reply(552, "Message exceeds the maximum size")
+		return
+	}
+	envelope.Data = data
+	err = c.s.Deliver(envelope)
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	c.reply(250, "OK")
+}
@@ -0,0 +1,73 @@
+package smtpd
+
+import (
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	delivered := make(chan *Envelope, 1)
+	server := &Server{
+		Hostname: "sms.local",
+		Auth:     func(username, password string) bool { return username == "user" && password == "secret" },
+		Allow:    func(addr net.Addr) bool { return false },
+		Recipient: func(username string, to string) error {
+			if !strings.HasSuffix(to, "@sms.local") {
+				return &Error{Code: 550, Message: "No such recipient"}
+			}
+			return nil
+		},
+		Deliver: func(e *Envelope) error {
+			delivered <- e
+			return nil
+		},
+		MaxSize: 1024,
+		Timeout: time.Minute}
+	go server.Serve(listener)
+	address := listener.Addr().String()
+
+	err = smtp.SendMail(address, nil, "alerts@example.com", []string{"380631234567@sms.local"},
+		[]byte("Subject: test\r\n\r\ntest\r\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "530") {
+		t.Fatalf("Expected AUTH to be required, got %v", err)
+	}
+	auth := smtp.PlainAuth("", "user", "wrong", "127.0.0.1")
+	err = smtp.SendMail(address, auth, "alerts@example.com", []string{"380631234567@sms.local"},
+		[]byte("Subject: test\r\n\r\ntest\r\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "535") {
+		t.Fatalf("Expected invalid credentials to be rejected, got %v", err)
+	}
+	auth = smtp.PlainAuth("", "user", "secret", "127.0.0.1")
+	err = smtp.SendMail(address, auth, "alerts@example.com", []string{"test@example.com"},
+		[]byte("Subject: test\r\n\r\ntest\r\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Fatalf("Expected the recipient to be rejected, got %v", err)
+	}
+	err = smtp.SendMail(address, auth, "alerts@example.com", []string{"380631234567@sms.local"},
+		[]byte(strings.Repeat("x", 2048)))
+	if err == nil || !strings.HasPrefix(err.Error(), "552") {
+		t.Fatalf("Expected a too large message to be rejected, got %v", err)
+	}
+	err = smtp.SendMail(address, auth, "alerts@example.com", []string{"380631234567@sms.local"},
+		[]byte("Subject: test\r\n\r\n.leading dot\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-delivered:
+		if e.Username != "user" || e.From != "alerts@example.com" || len(e.To) != 1 ||
+			string(e.Data) != "Subject: test\n\n.leading dot\n" {
+			t.Fatalf("Unexpected envelope %#v %q", e, e.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the message to be delivered")
+	}
+}
@@ -0,0 +1,128 @@
+package worker
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+	"github.com/alexgear/sms/modem"
+	"github.com/satori/go.uuid"
+)
+
+const sendRateWindow = 7 * 24 * time.Hour
+
+var balanceConf config.BalanceConfig
+var balancePattern *regexp.Regexp
+
+func InitBalance(conf config.BalanceConfig) error {
+	balanceConf = conf
+	balancePattern, err = regexp.Compile(conf.Pattern)
+	if err != nil {
+		return fmt.Errorf("InitBalance: Invalid pattern. %s", err.Error())
+	}
+	if conf.PollInterval > 0 {
+		go balancePoller(time.Duration(conf.PollInterval) * time.Second)
+	}
+	return nil
+}
+
+// QueryBalance asks the operator for the current balance, by SMS when
+// SMSNumber is configured and by USSD otherwise.
+func QueryBalance() (*common.Balance, error) {
+	var balance *common.Balance
+	var err error
+	if balanceConf.SMSNumber != "" {
+		timeout := time.Duration(balanceConf.SMSTimeout) * time.Second
+		balance, err = modem.GetBalanceBySMS(balanceConf.SMSNumber, balanceConf.SMSText, balancePattern, timeout)
+	} else {
+		balance, err = modem.GetBalance(balanceConf.USSD, balancePattern)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if balance.Currency == "" {
+		balance.Currency = balanceConf.Currency
+	}
+	err = store.InsertBalance(balance)
+	if err != nil {
+		log.Println(err)
+	}
+	return balance, nil
+}
+
+// EstimateSpend derives the cost of a message from the balance drops between
+// consecutive readings and the messages sent meanwhile, and projects how long
+// the latest balance lasts at the send rate of the last sendRateWindow. Drops
+// without sent messages, like subscription fees, are not counted.
+func EstimateSpend(balances []common.Balance, now time.Time) (*common.SpendEstimate, error) {
+	estimate := &common.SpendEstimate{}
+	var spent float64
+	var sent int
+	for i := 1; i < len(balances); i++ {
+		drop := balances[i-1].Amount - balances[i].Amount
+		if drop <= 0 {
+			// top-up or no traffic
+			continue
+		}
+		count, err := store.CountSentMessages(balances[i-1].Time, balances[i].Time)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			continue
+		}
+		spent += drop
+		sent += count
+	}
+	if sent > 0 {
+		estimate.CostPerMessage = spent / float64(sent)
+	}
+	count, err := store.CountSentMessages(now.Add(-sendRateWindow), now)
+	if err != nil {
+		return nil, err
+	}
+	estimate.MessagesPerDay = float64(count) / (sendRateWindow.Hours() / 24)
+	if len(balances) > 0 && estimate.CostPerMessage > 0 && estimate.MessagesPerDay > 0 {
+		daysLeft := balances[len(balances)-1].Amount / (estimate.CostPerMessage * estimate.MessagesPerDay)
+		estimate.DaysLeft = &daysLeft
+	}
+	return estimate, nil
+}
+
+func balancePoller(interval time.Duration) {
+	alerted := false
+	for {
+		balance, err := QueryBalance()
+		if err != nil {
+			log.Printf("balancePoller: failed to get balance. %s", err.Error())
+		} else if balance.Amount < balanceConf.LowThreshold {
+			log.Printf("balancePoller: low balance %.2f %s", balance.Amount, balance.Currency)
+			// alert only once per drop below the threshold
+			if !alerted {
+				sendBalanceAlert(balance)
+				alerted = true
+			}
+		} else {
+			alerted = false
+		}
+		time.Sleep(interval)
+	}
+}
+
+func sendBalanceAlert(balance *common.Balance) {
+	for _, mobile := range balanceConf.AlertMobiles {
+		sms := &common.SMS{
+			UUID:     uuid.NewV1().String(),
+			Mobile:   mobile,
+			Body:     fmt.Sprintf("Low balance: %.2f %s", balance.Amount, balance.Currency),
+			Status:   "pending",
+			Priority: common.PriorityHigh}
+		err := store.InsertMessage(sms)
+		if err != nil {
+			log.Printf("sendBalanceAlert: failed to queue alert to %s. %s", mobile, err.Error())
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package worker
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/alexgear/sms/common"
+)
+
+func TestEstimateSpend(t *testing.T) {
+	cleanup := initTestStore(t)
+	defer cleanup()
+	now := time.Now()
+	start := now.Add(-3 * time.Hour)
+	for i := 0; i < 2; i++ {
+		err := store.InsertEvent(fmt.Sprintf("80000000-0000-0000-0000-%012d", i),
+			common.Event{Event: common.EventSent, Time: start.Add(time.Duration(i+1) * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	balances := []common.Balance{
+		{Amount: 100, Time: start},
+		{Amount: 90, Time: start.Add(time.Hour)},
+		// a fee without sent messages
+		{Amount: 85, Time: start.Add(2 * time.Hour)},
+		// a top-up
+		{Amount: 95, Time: start.Add(3 * time.Hour)},
+	}
+	estimate, err := EstimateSpend(balances, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate.CostPerMessage != 5 || estimate.MessagesPerDay != 2.0/7 || estimate.DaysLeft == nil ||
+		math.Abs(*estimate.DaysLeft-66.5) > 1e-9 {
+		t.Fatalf("Unexpected estimate %#v", estimate)
+	}
+}
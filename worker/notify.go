@@ -0,0 +1,114 @@
+package worker
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/alexgear/sms/common"
+)
+
+// StatusNotification is posted to the status webhook when a message is sent,
+// fails, is delivered or undelivered, or is suppressed.
+type StatusNotification struct {
+	UUID      string          `json:"uuid"`
+	To        string          `json:"to"`
+	Status    string          `json:"status"`
+	Retries   int             `json:"retries"`
+	Client    string          `json:"client,omitempty"`
+	ClientRef string          `json:"client_ref,omitempty"`
+	Metadata  json.RawMessage `json:"metadata,omitempty"`
+	Reference string          `json:"reference,omitempty"`
+	Event     common.Event    `json:"event"`
+}
+
+// notifyAttempts per notification before it is dropped
+const notifyAttempts = 3
+
+var statusWebhook string
+
+var notifications = make(chan StatusNotification, 100)
+
+// statusEvents are the events which change the status of a message
+var statusEvents = map[string]bool{
+	common.EventSent:        true,
+	common.EventError:       true,
+	common.EventDelivered:   true,
+	common.EventUndelivered: true,
+	common.EventSuppressed:  true,
+}
+
+// StatusHook is called with a message after event changed its status. It
+// must not block.
+type StatusHook func(sms common.SMS, event common.Event)
+
+var statusHooks []StatusHook
+
+// OnStatus adds a hook called on status changes. Hooks are added before the
+// worker starts.
+func OnStatus(hook StatusHook) {
+	statusHooks = append(statusHooks, hook)
+}
+
+// InitNotifier posts status changes of messages to url, nothing is posted if
+// it is empty.
+func InitNotifier(url string) {
+	statusWebhook = url
+	if url != "" {
+		go notifier()
+	}
+}
+
+func notifier() {
+	for n := range notifications {
+		for attempt := 1; ; attempt++ {
+			err := postJSON(statusWebhook, n)
+			if err == nil {
+				break
+			}
+			log.Printf("notifier: attempt %d for %s failed. %s", attempt, n.UUID, err.Error())
+			if attempt == notifyAttempts {
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+}
+
+// notify queues a notification of event if it changed the status of the
+// message and calls the status hooks. Notifications are dropped when the
+// webhook falls behind.
+func notify(uuid string, event common.Event) {
+	if (statusWebhook == "" && len(statusHooks) == 0) || !statusEvents[event.Event] {
+		return
+	}
+	sms, err := store.GetMessageByUuid(uuid)
+	if err != nil {
+		log.Printf("notify: %s", err.Error())
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, hook := range statusHooks {
+		hook(sms, event)
+	}
+	if statusWebhook == "" {
+		return
+	}
+	n := StatusNotification{
+		UUID:      sms.UUID,
+		To:        sms.Mobile,
+		Status:    sms.Status,
+		Retries:   sms.Retries,
+		Client:    sms.Client,
+		ClientRef: sms.ClientRef,
+		Metadata:  sms.Metadata,
+		Reference: sms.Reference,
+		Event:     event}
+	select {
+	case notifications <- n:
+	default:
+		log.Printf("notify: dropped %s of %s, the webhook is too slow", event.Event, uuid)
+	}
+}
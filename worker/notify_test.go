@@ -0,0 +1,55 @@
+package worker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alexgear/sms/common"
+)
+
+func TestNotify(t *testing.T) {
+	cleanup := initTestStore(t)
+	defer cleanup()
+	received := make(chan StatusNotification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n StatusNotification
+		json.NewDecoder(r.Body).Decode(&n)
+		received <- n
+	}))
+	defer server.Close()
+	InitNotifier(server.URL)
+	defer func() { statusWebhook = "" }()
+
+	sms := &common.SMS{
+		UUID:      "40000000-0000-0000-0000-000000000000",
+		Mobile:    "+380631234567",
+		Body:      "test",
+		Status:    "pending",
+		ClientRef: "order-42",
+		Metadata:  []byte(`{"ticket":7}`)}
+	err := store.InsertMessage(sms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// attempts do not change the status
+	recordEvent(sms.UUID, common.Event{Event: common.EventAttempt, Attempt: 1})
+	sms.Status = "sent"
+	sms.Reference = "12"
+	err = store.UpdateMessageStatus(*sms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordEvent(sms.UUID, common.Event{Event: common.EventSent, Attempt: 1, Reference: "12"})
+	select {
+	case n := <-received:
+		if n.UUID != sms.UUID || n.Status != "sent" || n.Event.Event != common.EventSent ||
+			n.ClientRef != "order-42" || string(n.Metadata) != `{"ticket":7}` {
+			t.Fatalf("Unexpected notification %#v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a notification")
+	}
+}
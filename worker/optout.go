@@ -0,0 +1,105 @@
+package worker
+
+import (
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+	"github.com/alexgear/sms/database"
+	"github.com/satori/go.uuid"
+)
+
+var optOutConf config.OptOutConfig
+
+// matchKeyword reports whether the whole body is one of keywords, ignoring
+// case, spaces and punctuation around it.
+func matchKeyword(body string, keywords []string) bool {
+	body = strings.TrimFunc(body, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	})
+	for _, keyword := range keywords {
+		if strings.EqualFold(body, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleOptOut updates the suppression list if msg is a stop or start
+// keyword and confirms the change to the sender. Returns false for other
+// messages.
+func handleOptOut(msg *common.Inbound) bool {
+	if matchKeyword(msg.Body, optOutConf.StopKeywords) {
+		suppression := &common.Suppression{Number: msg.Sender, Source: "keyword", Detail: strings.TrimSpace(msg.Body)}
+		err := store.InsertSuppression(suppression)
+		if err == database.ErrExists {
+			log.Printf("handleOptOut: %s already opted out", msg.Sender)
+			return true
+		} else if err != nil {
+			log.Println(err)
+			return true
+		}
+		log.Printf("handleOptOut: %s opted out", msg.Sender)
+		if optOutConf.StopReply != "" {
+			// queued messages to the number are suppressed from now on
+			err = queueStopReply(msg.Sender)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		return true
+	} else if matchKeyword(msg.Body, optOutConf.StartKeywords) {
+		err := store.DeleteSuppression(msg.Sender)
+		if err == database.ErrNotFound {
+			return true
+		} else if err != nil {
+			log.Println(err)
+			return true
+		}
+		log.Printf("handleOptOut: %s opted in", msg.Sender)
+		if optOutConf.StartReply != "" {
+			err = queueMessage(msg.Sender, optOutConf.StartReply)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// queueStopReply queues the confirmation of an opt-out at high priority. It
+// is the only message sent to the number until it opts in again.
+func queueStopReply(mobile string) error {
+	sms := &common.SMS{
+		UUID:              uuid.NewV1().String(),
+		Mobile:            mobile,
+		Body:              optOutConf.StopReply,
+		Status:            "pending",
+		Priority:          common.PriorityHigh,
+		IgnoreSuppression: true}
+	return store.InsertMessage(sms)
+}
+
+// recipientOptedOut reports whether a message must not be sent because its
+// recipient opted out.
+func recipientOptedOut(sms common.SMS) (bool, error) {
+	if sms.IgnoreSuppression {
+		return false, nil
+	}
+	return suppressed(sms.Mobile)
+}
+
+// suppressed reports whether the recipient of a message opted out. Database
+// errors are returned so that the message is not sent.
+func suppressed(mobile string) (bool, error) {
+	_, err := store.GetSuppression(mobile)
+	if err == database.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,51 @@
+package worker
+
+import (
+	"testing"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+)
+
+func TestMatchKeyword(t *testing.T) {
+	keywords := []string{"STOP", "СТОП"}
+	bodies := map[string]bool{
+		"STOP":        true,
+		" stop\n":     true,
+		"Stop.":       true,
+		"стоп!":       true,
+		"STOP please": false,
+		"don't stop":  false,
+		"":            false,
+	}
+	for body, expected := range bodies {
+		if matched := matchKeyword(body, keywords); matched != expected {
+			t.Errorf("Expected %v for %#v, got %v", expected, body, matched)
+		}
+	}
+}
+
+func TestStopReply(t *testing.T) {
+	cleanup := initTestStore(t)
+	defer cleanup()
+	optOutConf = config.OptOutConfig{StopKeywords: []string{"STOP"}, StopReply: "You will get no more messages"}
+	defer func() { optOutConf = config.OptOutConfig{} }()
+	if !handleOptOut(&common.Inbound{Sender: "+380631234567", Body: "stop"}) {
+		t.Fatal("Expected STOP to be handled")
+	}
+	messages, err := store.GetPendingMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Body != optOutConf.StopReply ||
+		messages[0].Priority != common.PriorityHigh || !messages[0].IgnoreSuppression {
+		t.Fatalf("Expected the confirmation to be queued, got %#v", messages)
+	}
+	// the confirmation is the only message sent to the number
+	if optedOut, err := recipientOptedOut(messages[0]); optedOut || err != nil {
+		t.Fatalf("Expected the confirmation to be sent, got %v %v", optedOut, err)
+	}
+	if optedOut, err := recipientOptedOut(common.SMS{Mobile: "+380631234567"}); !optedOut || err != nil {
+		t.Fatalf("Expected other messages to be suppressed, got %v %v", optedOut, err)
+	}
+}
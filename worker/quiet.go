@@ -0,0 +1,65 @@
+package worker
+
+import (
+	"log"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+)
+
+var quietConf config.QuietHoursConfig
+var quietHours common.QuietHours
+
+// locations caches loaded time zones, it is only used by the consumer
+var locations = map[string]*time.Location{}
+
+func initQuietHours(conf config.QuietHoursConfig) {
+	quietConf = conf
+	quietHours = common.QuietHours{}
+	if conf.Hours != "" {
+		// validated with the config
+		quietHours, _ = common.ParseQuietHours(conf.Hours)
+	}
+}
+
+// location returns the time zone of the recipient of a message.
+func location(sms common.SMS) *time.Location {
+	zone := sms.TimeZone
+	if zone == "" {
+		zone = common.TimeZone(sms.Mobile, quietConf.TimeZones)
+	}
+	if zone == "" {
+		zone = quietConf.TimeZone
+	}
+	if loc, ok := locations[zone]; ok {
+		return loc
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		log.Printf("location: %s", err.Error())
+		loc = time.Local
+	}
+	locations[zone] = loc
+	return loc
+}
+
+// quietUntil returns when the quiet hours of the recipient of a message end,
+// now if the message may be sent.
+func quietUntil(sms common.SMS, now time.Time) time.Time {
+	q := quietHours
+	switch {
+	case sms.QuietHours == common.QuietHoursOff:
+		return now
+	case sms.QuietHours != "":
+		var err error
+		q, err = common.ParseQuietHours(sms.QuietHours)
+		if err != nil {
+			log.Printf("quietUntil: %s %s", sms.UUID, err.Error())
+			return now
+		}
+	case sms.Priority == common.PriorityHigh && quietConf.BypassHigh:
+		return now
+	}
+	return q.Next(now.In(location(sms)))
+}
@@ -0,0 +1,46 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+)
+
+func TestQuietUntil(t *testing.T) {
+	kyiv, err := time.LoadLocation("Europe/Kyiv")
+	if err != nil {
+		t.Skip(err)
+	}
+	initQuietHours(config.QuietHoursConfig{
+		Hours:      "21:00-08:00",
+		TimeZones:  map[string]string{"+1": "America/New_York"},
+		TimeZone:   "UTC",
+		BypassHigh: true})
+	defer initQuietHours(config.QuietHoursConfig{})
+	// 23:00 in Kyiv, 16:00 in New York, 20:00 UTC
+	now := time.Date(2026, 10, 19, 23, 0, 0, 0, kyiv)
+	morning := time.Date(2026, 10, 20, 8, 0, 0, 0, kyiv)
+	tests := []struct {
+		sms   common.SMS
+		until time.Time
+	}{
+		{common.SMS{Mobile: "+380631234567"}, morning},
+		{common.SMS{Mobile: "+12125550100"}, now},
+		{common.SMS{Mobile: "+12125550100", TimeZone: "Europe/Kyiv"}, morning},
+		{common.SMS{Mobile: "+380631234567", Priority: common.PriorityHigh}, now},
+		{common.SMS{Mobile: "+380631234567", QuietHours: common.QuietHoursOff}, now},
+		// explicit quiet hours apply to high priority messages too
+		{common.SMS{Mobile: "+12125550100", Priority: common.PriorityHigh, QuietHours: "15:00-17:30"},
+			time.Date(2026, 10, 19, 17, 30, 0, 0, location(common.SMS{Mobile: "+1"}))},
+		// unknown numbers use the default time zone, where it is 20:00
+		{common.SMS{Mobile: "+79161234567"}, now},
+		{common.SMS{Mobile: "+79161234567", QuietHours: "19:00-07:00"}, time.Date(2026, 10, 20, 7, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		if until := quietUntil(test.sms, now); !until.Equal(test.until) {
+			t.Errorf("Expected %#v to wait until %v, got %v", test.sms, test.until, until)
+		}
+	}
+}
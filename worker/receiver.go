@@ -0,0 +1,127 @@
+package worker
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+	"github.com/alexgear/sms/database"
+	"github.com/alexgear/sms/modem"
+	"github.com/satori/go.uuid"
+)
+
+// InboundHook is called with every received message which is not an opt-out
+// keyword. It must not block.
+type InboundHook func(msg common.Inbound)
+
+var inboundHooks []InboundHook
+
+// OnInbound adds a hook called on received messages. Hooks are added before
+// the receiver starts.
+func OnInbound(hook InboundHook) {
+	inboundHooks = append(inboundHooks, hook)
+}
+
+// InitReceiver polls the modem for received messages and status reports of
+// sent messages.
+func InitReceiver(conf config.Config) {
+	optOutConf = conf.OptOut
+	initRules(conf.Rules)
+	go receiver(time.Duration(conf.Inbound.PollInterval) * time.Second)
+}
+
+func receiver(interval time.Duration) {
+	for {
+		err := receive()
+		if err != nil {
+			log.Printf("receiver: %s", err.Error())
+		}
+		time.Sleep(interval)
+	}
+}
+
+func receive() error {
+	messages, err := modem.GetMessages()
+	if err != nil {
+		return fmt.Errorf("failed to read messages. %s", err.Error())
+	}
+	for _, msg := range messages {
+		if msg.Report == nil {
+			if balanceConf.SMSNumber != "" && common.NormalizeNumber(msg.Sender) == common.NormalizeNumber(balanceConf.SMSNumber) {
+				// left for GetBalanceBySMS
+				continue
+			}
+			err = receiveInbound(msg.Sender, msg.Body, msg.Date)
+			if err != nil {
+				// keep the message to retry on the next poll
+				log.Println(err)
+				continue
+			}
+			err = modem.DeleteMessage(msg.Index)
+			if err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		status := msg.Report.Status
+		if status >= 32 && status < 64 {
+			// the network is still trying, wait for the final report
+			log.Printf("receiver: message %d pending with status %d", msg.Report.Reference, status)
+		} else {
+			reference := strconv.Itoa(msg.Report.Reference)
+			detail := fmt.Sprintf("status %d at %s", status, msg.Report.Delivered.Format(time.RFC3339))
+			err = applyReport(reference, status < 32, detail)
+			if err == database.ErrNotFound {
+				log.Printf("receiver: no message sent with reference %s", reference)
+			} else if err != nil {
+				// keep the report to retry on the next poll
+				log.Println(err)
+				continue
+			}
+		}
+		err = modem.DeleteMessage(msg.Index)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
+}
+
+// receiveInbound stores a received message and answers or routes it.
+func receiveInbound(sender string, body string, receivedAt time.Time) error {
+	inbound := &common.Inbound{
+		UUID:       uuid.NewV1().String(),
+		Sender:     common.NormalizeNumber(sender),
+		Body:       body,
+		ReceivedAt: receivedAt,
+	}
+	err := store.InsertInbound(inbound)
+	if err != nil {
+		return err
+	}
+	if !handleOptOut(inbound) {
+		applyRules(inbound, time.Now())
+		for _, hook := range inboundHooks {
+			hook(*inbound)
+		}
+	}
+	return nil
+}
+
+// applyReport marks the message sent with reference delivered or not.
+func applyReport(reference string, delivered bool, detail string) error {
+	uuid, err := store.MarkDelivered(reference, delivered, detail)
+	if err != nil {
+		return err
+	}
+	log.Printf("applyReport: %s reported %s", uuid, detail)
+	event := common.Event{Event: common.EventDelivered, Detail: detail, Reference: reference}
+	if !delivered {
+		event.Event = common.EventUndelivered
+	}
+	notify(uuid, event)
+	return nil
+}
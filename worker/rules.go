@@ -0,0 +1,237 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+	"github.com/satori/go.uuid"
+)
+
+type rule struct {
+	config.RuleConfig
+	sender *regexp.Regexp
+	body   *regexp.Regexp
+}
+
+// rules in the order of evaluation
+var rules []rule
+
+// cooldowns maps a rule and a sender to the time the rule may act again.
+// Messages are received from the modem and from SMPP transports concurrently.
+var cooldowns = struct {
+	sync.Mutex
+	until map[string]time.Time
+}{until: make(map[string]time.Time)}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// inboundWebhook is posted to the URL of a webhook rule.
+type inboundWebhook struct {
+	Rule string `json:"rule"`
+	common.Inbound
+}
+
+// ruleWebhook is an inboundWebhook queued for url
+type ruleWebhook struct {
+	url  string
+	body inboundWebhook
+}
+
+var ruleWebhooks = make(chan ruleWebhook, 100)
+
+var startRuleWebhooks sync.Once
+
+// initRules compiles the rules, they are validated by config.New.
+func initRules(conf []config.RuleConfig) {
+	rules = nil
+	for _, c := range conf {
+		r := rule{RuleConfig: c}
+		if c.Sender != "" {
+			r.sender = regexp.MustCompile(c.Sender)
+		}
+		if c.Body != "" {
+			r.body = regexp.MustCompile(c.Body)
+		}
+		rules = append(rules, r)
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Priority > rules[j].Priority })
+}
+
+// match returns the template variables of msg if the rule matches it.
+func (r *rule) match(msg *common.Inbound) (map[string]string, bool) {
+	if r.sender != nil && !r.sender.MatchString(msg.Sender) {
+		return nil, false
+	}
+	vars := map[string]string{
+		"inbound.uuid":   msg.UUID,
+		"inbound.sender": msg.Sender,
+		"inbound.body":   msg.Body,
+	}
+	if len(r.Keywords) == 0 && r.body == nil {
+		return vars, true
+	}
+	if matchKeyword(msg.Body, r.Keywords) {
+		return vars, true
+	}
+	if r.body == nil {
+		return nil, false
+	}
+	groups := r.body.FindStringSubmatch(msg.Body)
+	if groups == nil {
+		return nil, false
+	}
+	for i, name := range r.body.SubexpNames() {
+		if name != "" {
+			vars["match."+name] = groups[i]
+		}
+	}
+	return vars, true
+}
+
+// applyRules runs the actions of the rules matching msg.
+func applyRules(msg *common.Inbound, now time.Time) {
+	cooldowns.Lock()
+	for key, until := range cooldowns.until {
+		if !now.Before(until) {
+			delete(cooldowns.until, key)
+		}
+	}
+	cooldowns.Unlock()
+	for i := range rules {
+		r := &rules[i]
+		vars, ok := r.match(msg)
+		if !ok {
+			continue
+		}
+		if !r.coolDown(msg.Sender, now) {
+			log.Printf("applyRules: %s is cooling down for %s", r.Name, msg.Sender)
+		} else {
+			log.Printf("applyRules: %s matched %s", r.Name, msg.UUID)
+			err := r.act(msg, vars)
+			if err != nil {
+				log.Printf("applyRules: %s failed for %s. %s", r.Name, msg.UUID, err.Error())
+			}
+		}
+		if !r.Continue {
+			return
+		}
+	}
+}
+
+// coolDown returns false if the rule is cooling down for sender, else it
+// starts the cooldown and returns true.
+func (r *rule) coolDown(sender string, now time.Time) bool {
+	key := r.Name + "\x00" + sender
+	cooldowns.Lock()
+	defer cooldowns.Unlock()
+	if _, cooling := cooldowns.until[key]; cooling {
+		return false
+	}
+	if r.Cooldown > 0 {
+		cooldowns.until[key] = now.Add(time.Duration(r.Cooldown) * time.Second)
+	}
+	return true
+}
+
+func (r *rule) act(msg *common.Inbound, vars map[string]string) error {
+	if len(r.Tags) > 0 {
+		err := store.TagInbound(msg.UUID, r.Tags)
+		if err != nil {
+			return err
+		}
+		msg.Tags = append(msg.Tags, r.Tags...)
+	}
+	switch r.Action {
+	case "reply":
+		text, err := r.render(vars)
+		if err != nil {
+			return err
+		}
+		return queueMessage(msg.Sender, text)
+	case "forward":
+		text := fmt.Sprintf("From %s: %s", msg.Sender, msg.Body)
+		if r.Template != "" {
+			var err error
+			text, err = r.render(vars)
+			if err != nil {
+				return err
+			}
+		}
+		return queueMessage(common.NormalizeNumber(r.ForwardTo), text)
+	case "webhook":
+		return queueRuleWebhook(ruleWebhook{url: r.URL, body: inboundWebhook{Rule: r.Name, Inbound: *msg}})
+	}
+	return nil
+}
+
+// queueRuleWebhook queues a post of a webhook rule, received messages are
+// not held up by slow webhooks. It fails when the webhooks fall behind.
+func queueRuleWebhook(w ruleWebhook) error {
+	startRuleWebhooks.Do(func() { go ruleWebhookSender() })
+	select {
+	case ruleWebhooks <- w:
+		return nil
+	default:
+		return fmt.Errorf("webhook queue full, dropped %s", w.body.UUID)
+	}
+}
+
+func ruleWebhookSender() {
+	for w := range ruleWebhooks {
+		for attempt := 1; ; attempt++ {
+			err := postJSON(w.url, w.body)
+			if err == nil {
+				break
+			}
+			log.Printf("ruleWebhookSender: attempt %d of %s for %s failed. %s", attempt, w.body.Rule, w.body.UUID,
+				err.Error())
+			if attempt == notifyAttempts {
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+}
+
+func (r *rule) render(vars map[string]string) (string, error) {
+	t, err := store.GetTemplate(r.Template)
+	if err != nil {
+		return "", fmt.Errorf("template %s. %s", r.Template, err.Error())
+	}
+	return t.Render(r.Locale, vars)
+}
+
+func queueMessage(mobile string, text string) error {
+	sms := &common.SMS{
+		UUID:   uuid.NewV1().String(),
+		Mobile: mobile,
+		Body:   text,
+		Status: "pending"}
+	return store.InsertMessage(sms)
+}
+
+// postJSON posts v to url and fails unless the response is 2xx.
+func postJSON(url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+)
+
+func TestApplyRules(t *testing.T) {
+	cleanup := initTestStore(t)
+	defer cleanup()
+	err := store.InsertTemplate(&common.Template{
+		ID:            "order",
+		DefaultLocale: "en",
+		Variants:      map[string]string{"en": "Order {{match.id}} is on its way"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	initRules([]config.RuleConfig{
+		{Name: "catch-all", Action: "tag", Tags: []string{"unanswered"}},
+		{Name: "order", Priority: 10, Body: `(?i)order (?P<id>\d+)`, Action: "reply", Template: "order", Cooldown: 60},
+		{Name: "support", Priority: 20, Keywords: []string{"HELP"}, Action: "forward", ForwardTo: "+380500000000",
+			Tags: []string{"support"}, Continue: true},
+	})
+	now := time.Now()
+	bodies := []string{"order 42?", "Order 43", "help", "hello"}
+	for i, body := range bodies {
+		msg := &common.Inbound{UUID: body, Sender: "+380631234567", Body: body, ReceivedAt: now}
+		err = store.InsertInbound(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		applyRules(msg, now.Add(time.Duration(i)*time.Second))
+	}
+	outbound, inbound, err := store.GetConversation("+380631234567", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second order is within the cooldown
+	if len(outbound) != 1 || outbound[0].Body != "Order 42 is on its way" {
+		t.Fatalf("Expected one reply, got %#v", outbound)
+	}
+	forwarded, _, err := store.GetConversation("+380500000000", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forwarded) != 1 || forwarded[0].Body != "From +380631234567: help" {
+		t.Fatalf("Expected help to be forwarded, got %#v", forwarded)
+	}
+	tags := make(map[string]string)
+	for _, msg := range inbound {
+		tags[msg.Body] = fmt.Sprint(msg.Tags)
+	}
+	expected := map[string]string{"order 42?": "[]", "Order 43": "[]", "help": "[support unanswered]", "hello": "[unanswered]"}
+	if fmt.Sprint(tags) != fmt.Sprint(expected) {
+		t.Fatalf("Expected tags %v, got %v", expected, tags)
+	}
+}
+
+func TestCoolDownConcurrently(t *testing.T) {
+	r := &rule{RuleConfig: config.RuleConfig{Name: "concurrent", Cooldown: 60}}
+	now := time.Now()
+	started := make(chan bool, 8)
+	for i := 0; i < 8; i++ {
+		go func() { started <- r.coolDown("+380631234567", now) }()
+	}
+	count := 0
+	for i := 0; i < 8; i++ {
+		if <-started {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Fatalf("Expected the rule to act once, got %d", count)
+	}
+}
+
+func TestWebhookRule(t *testing.T) {
+	received := make(chan inboundWebhook, 1)
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body inboundWebhook
+		json.NewDecoder(r.Body).Decode(&body)
+		// a slow webhook
+		<-release
+		received <- body
+	}))
+	defer server.Close()
+	defer close(release)
+	initRules([]config.RuleConfig{{Name: "crm", Action: "webhook", URL: server.URL}})
+	defer initRules(nil)
+
+	done := make(chan bool)
+	go func() {
+		applyRules(&common.Inbound{UUID: "inbound", Sender: "+380631234567", Body: "hello"}, time.Now())
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected applyRules not to wait for the webhook")
+	}
+	release <- true
+	select {
+	case body := <-received:
+		if body.Rule != "crm" || body.UUID != "inbound" || body.Body != "hello" {
+			t.Fatalf("Unexpected webhook %#v", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the webhook to be posted")
+	}
+}
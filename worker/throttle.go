@@ -0,0 +1,151 @@
+package worker
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+)
+
+// throttle enforces the send limits of the modem. Sends of the last day are
+// loaded from the store at start, so a restart does not reset the limits.
+type throttle struct {
+	mu   sync.Mutex
+	conf config.ThrottleConfig
+	// sent holds the times of sends within the last day, oldest first
+	sent []time.Time
+	// next is the earliest time of the next send
+	next time.Time
+}
+
+// window allows limit sends per period, any number if limit is 0
+type window struct {
+	limit  int
+	period time.Duration
+}
+
+var sendThrottle = &throttle{}
+
+func initThrottle(conf config.ThrottleConfig) {
+	sendThrottle.mu.Lock()
+	defer sendThrottle.mu.Unlock()
+	sendThrottle.conf = conf
+}
+
+// load counts the sends of the modem recorded in the store since a day
+// before now.
+func (t *throttle) load(now time.Time) error {
+	sent, err := store.GetModemSendTimes(now.Add(-24 * time.Hour))
+	if err != nil {
+		return fmt.Errorf("load: %s", err.Error())
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent = sent
+	return nil
+}
+
+func (t *throttle) windows() []window {
+	return []window{
+		{t.conf.PerMinute, time.Minute},
+		{t.conf.PerHour, time.Hour},
+		{t.conf.PerDay, 24 * time.Hour},
+	}
+}
+
+// count returns the number of sends in (now-period, now].
+func (t *throttle) count(now time.Time, period time.Duration) int {
+	from := now.Add(-period)
+	i := sort.Search(len(t.sent), func(i int) bool { return t.sent[i].After(from) })
+	return len(t.sent) - i
+}
+
+// delay returns how long the next send has to wait, 0 if it may happen now.
+func (t *throttle) delay(now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.next.Sub(now)
+	for _, w := range t.windows() {
+		if w.limit == 0 || t.count(now, w.period) < w.limit {
+			continue
+		}
+		// wait until all but limit-1 sends left the window
+		oldest := t.sent[len(t.sent)-w.limit]
+		if wait := oldest.Add(w.period).Sub(now); wait > d {
+			d = wait
+		}
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// available returns how many messages may be sent before a limit is
+// reached, at most max.
+func (t *throttle) available(now time.Time, max int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, w := range t.windows() {
+		if w.limit == 0 {
+			continue
+		}
+		if left := w.limit - t.count(now, w.period); left < max {
+			max = left
+		}
+	}
+	if max < 0 {
+		return 0
+	}
+	return max
+}
+
+// wait blocks until a message may be sent.
+func (t *throttle) wait() {
+	for {
+		d := t.delay(time.Now())
+		if d == 0 {
+			return
+		}
+		time.Sleep(d)
+	}
+}
+
+// record counts a send at now and schedules the earliest next one.
+func (t *throttle) record(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	from := now.Add(-24 * time.Hour)
+	i := sort.Search(len(t.sent), func(i int) bool { return t.sent[i].After(from) })
+	t.sent = append(t.sent[i:], now)
+	t.next = now.Add(time.Duration(t.conf.MinGap) * time.Second)
+	if t.conf.Jitter > 0 {
+		t.next = t.next.Add(time.Duration(rand.Int63n(int64(time.Duration(t.conf.Jitter) * time.Second))))
+	}
+}
+
+func (t *throttle) state(now time.Time) common.ThrottleState {
+	delay := t.delay(now)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return common.ThrottleState{
+		PerMinute:  t.conf.PerMinute,
+		PerHour:    t.conf.PerHour,
+		PerDay:     t.conf.PerDay,
+		LastMinute: t.count(now, time.Minute),
+		LastHour:   t.count(now, time.Hour),
+		LastDay:    t.count(now, 24*time.Hour),
+		NextSendAt: now.Add(delay),
+		Throttled:  delay > 0,
+	}
+}
+
+// ThrottleState returns the current send limits of the modem and how much of
+// them is used.
+func ThrottleState() common.ThrottleState {
+	return sendThrottle.state(time.Now())
+}
@@ -0,0 +1,87 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+)
+
+func TestThrottle(t *testing.T) {
+	th := &throttle{conf: config.ThrottleConfig{PerMinute: 2, PerHour: 3, MinGap: 5}}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	if d := th.delay(now); d != 0 {
+		t.Fatalf("Expected no delay, got %v", d)
+	}
+	if n := th.available(now, 10); n != 2 {
+		t.Fatalf("Expected 2 available, got %d", n)
+	}
+	th.record(now)
+	if d := th.delay(now.Add(time.Second)); d != 4*time.Second {
+		t.Fatalf("Expected the gap to be kept, got %v", d)
+	}
+	th.record(now.Add(10 * time.Second))
+	// the per minute limit is reached until the first send leaves the window
+	if d := th.delay(now.Add(20 * time.Second)); d != 40*time.Second {
+		t.Fatalf("Expected 40s delay, got %v", d)
+	}
+	if n := th.available(now.Add(20*time.Second), 10); n != 0 {
+		t.Fatalf("Expected nothing available, got %d", n)
+	}
+	th.record(now.Add(time.Minute))
+	// then the per hour one
+	if d := th.delay(now.Add(2 * time.Minute)); d != 58*time.Minute {
+		t.Fatalf("Expected 58m delay, got %v", d)
+	}
+	state := th.state(now.Add(2 * time.Minute))
+	if state.LastMinute != 0 || state.LastHour != 3 || !state.Throttled ||
+		!state.NextSendAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Unexpected state %#v", state)
+	}
+	if d := th.delay(now.Add(time.Hour)); d != 0 {
+		t.Fatalf("Expected no delay after an hour, got %v", d)
+	}
+}
+
+func TestThrottleJitter(t *testing.T) {
+	th := &throttle{conf: config.ThrottleConfig{MinGap: 1, Jitter: 2}}
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		th.record(now)
+		d := th.delay(now)
+		if d < time.Second || d >= 3*time.Second {
+			t.Fatalf("Expected a delay of 1 to 3s, got %v", d)
+		}
+	}
+}
+
+func TestThrottleLoad(t *testing.T) {
+	cleanup := initTestStore(t)
+	defer cleanup()
+	messages := []*common.SMS{
+		{UUID: "70000000-0000-0000-0000-000000000001", Mobile: "+380631234567", Body: "modem", Status: "pending"},
+		{UUID: "70000000-0000-0000-0000-000000000002", Mobile: "+380631234567", Body: "smpp", Status: "pending"},
+		{UUID: "70000000-0000-0000-0000-000000000003", Mobile: "+380631234567", Body: "queued", Status: "pending"},
+	}
+	err := store.InsertMessages(messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, reference := range []string{"12", "smsc:abc"} {
+		messages[i].Status = "sent"
+		messages[i].Reference = reference
+		err = store.UpdateMessageStatus(*messages[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	th := &throttle{conf: config.ThrottleConfig{PerHour: 1}}
+	err = th.load(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := th.state(time.Now()); state.LastHour != 1 || !state.Throttled {
+		t.Fatalf("Expected the send of the modem to be counted, got %#v", state)
+	}
+}
@@ -0,0 +1,290 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+	"github.com/alexgear/sms/database"
+	"github.com/alexgear/sms/modem"
+	"github.com/alexgear/sms/smpp"
+)
+
+// Transport sends messages, through the modem or an upstream SMSC.
+type Transport interface {
+	Name() string
+	// Up reports whether the transport can send right now
+	Up() bool
+	// Send returns the reference the status report of the message carries
+	Send(sms common.SMS) (string, error)
+}
+
+// maxThrottleWait of the consumer for the modem, longer waits defer the
+// message instead of holding its claim
+const maxThrottleWait = time.Minute
+
+// reportRetryDelay before a receipt of a message not marked sent yet is
+// applied again
+const reportRetryDelay = 5 * time.Second
+
+var transports = map[string]Transport{config.ModemTransport: modemTransport{}}
+var routes []config.RouteConfig
+
+type modemTransport struct{}
+
+func (modemTransport) Name() string {
+	return config.ModemTransport
+}
+
+func (modemTransport) Up() bool {
+	return true
+}
+
+func (modemTransport) Send(sms common.SMS) (string, error) {
+	sendThrottle.wait()
+	reference, err := modem.SendMessage(sms.Mobile, sms.Body)
+	sendThrottle.record(time.Now())
+	return strconv.Itoa(reference), err
+}
+
+// smppTransport references are prefixed with its name, message ids of
+// different SMSCs and modem references may be the same.
+type smppTransport struct {
+	name   string
+	source string
+	client *smpp.Client
+	// window holds a slot for every message being submitted
+	window chan struct{}
+}
+
+func (t *smppTransport) Name() string {
+	return t.name
+}
+
+func (t *smppTransport) Up() bool {
+	return t.client.Bound()
+}
+
+var digits = regexp.MustCompile(`^\+?\d+$`)
+
+func (t *smppTransport) Send(sms common.SMS) (string, error) {
+	m := &smpp.ShortMessage{
+		Source:             t.source,
+		Dest:               strings.TrimPrefix(sms.Mobile, "+"),
+		RegisteredDelivery: 1}
+	if strings.HasPrefix(sms.Mobile, "+") {
+		m.DestTON = smpp.TONInternational
+	}
+	if strings.HasPrefix(t.source, "+") {
+		m.Source, m.SourceTON = t.source[1:], smpp.TONInternational
+	} else if t.source != "" && !digits.MatchString(t.source) {
+		m.SourceTON = smpp.TONAlphanumeric
+	}
+	if sms.Priority == common.PriorityHigh {
+		m.PriorityFlag = 1
+	}
+	m.DataCoding, m.Message = smpp.EncodeText(sms.Body)
+	id, err := t.client.Submit(m)
+	if err != nil {
+		return "", fmt.Errorf("Send: %s %w", t.name, err)
+	}
+	return t.name + ":" + id, nil
+}
+
+func initTransports(conf config.Config) {
+	routes = conf.Routes
+	for _, c := range conf.Transports {
+		name := c.Name
+		client := &smpp.Client{
+			Address: c.Address,
+			Bind: smpp.Bind{
+				SystemID:         c.SystemID,
+				Password:         c.Password,
+				SystemType:       c.SystemType,
+				InterfaceVersion: 0x34},
+			Window:      c.Window,
+			EnquireLink: time.Duration(c.EnquireLink) * time.Second,
+			Timeout:     time.Duration(c.Timeout) * time.Second,
+			OnDeliver:   func(m *smpp.ShortMessage) { receiveSMPP(name, m) },
+		}
+		client.Start()
+		transports[name] = &smppTransport{name: name, source: c.Source, client: client,
+			window: make(chan struct{}, c.Window)}
+	}
+}
+
+// route returns the transports of the first route matching a message.
+func route(sms common.SMS) []Transport {
+	for _, r := range routes {
+		if len(r.Prefixes) > 0 && !hasPrefix(sms.Mobile, r.Prefixes) {
+			continue
+		}
+		if len(r.Clients) > 0 && !contains(r.Clients, sms.Client) {
+			continue
+		}
+		var route []Transport
+		for _, name := range r.Transports {
+			route = append(route, transports[name])
+		}
+		return route
+	}
+	return []Transport{transports[config.ModemTransport]}
+}
+
+func hasPrefix(number string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(number, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// transportsFor returns the transports of a message which are up, all of its
+// route if none is. When the modem is throttled it is skipped if others are
+// up, otherwise the time the message may be sent is returned instead.
+func transportsFor(sms common.SMS, now time.Time) ([]Transport, time.Time) {
+	all := route(sms)
+	var up, others []Transport
+	for _, t := range all {
+		if t.Up() {
+			up = append(up, t)
+			if t.Name() != config.ModemTransport {
+				others = append(others, t)
+			}
+		}
+	}
+	if len(up) == 0 {
+		return all, now
+	}
+	if delay := sendThrottle.delay(now); delay > 0 && len(others) < len(up) {
+		if len(others) > 0 {
+			return others, now
+		}
+		if delay > maxThrottleWait {
+			return nil, now.Add(delay)
+		}
+	}
+	return up, now
+}
+
+// submitWindow returns the window of the first of candidates, nil if the
+// modem is one of them. Messages are sent through the modem one at a time.
+func submitWindow(candidates []Transport) chan struct{} {
+	for _, t := range candidates {
+		if t.Name() == config.ModemTransport {
+			return nil
+		}
+	}
+	if t, ok := candidates[0].(*smppTransport); ok {
+		return t.window
+	}
+	return nil
+}
+
+// send tries the transports in order and returns the reference and the
+// name of the one which sent the message, or the last error.
+func send(sms common.SMS, candidates []Transport) (string, string, error) {
+	var err error
+	for _, t := range candidates {
+		var reference string
+		reference, err = t.Send(sms)
+		if err == nil {
+			return reference, t.Name(), nil
+		}
+		log.Printf("send: %s failed to send %s. %s", t.Name(), sms.UUID, err.Error())
+	}
+	return "", "", err
+}
+
+// errorCode returns the code of a failed send, such as "CMS 500" or
+// "SMPP 0x00000045".
+func errorCode(err error) string {
+	var statusErr *smpp.StatusError
+	if errors.As(err, &statusErr) {
+		return fmt.Sprintf("SMPP %#08x", statusErr.Status)
+	}
+	return modem.ErrorCode(err)
+}
+
+// receiptStats maps the message_state of receipts to their stat
+var receiptStats = map[byte]string{
+	smpp.StateEnroute:       "ENROUTE",
+	smpp.StateDelivered:     "DELIVRD",
+	smpp.StateExpired:       "EXPIRED",
+	smpp.StateDeleted:       "DELETED",
+	smpp.StateUndeliverable: "UNDELIV",
+	smpp.StateAccepted:      "ACCEPTD",
+	smpp.StateUnknown:       "UNKNOWN",
+	smpp.StateRejected:      "REJECTD",
+}
+
+// receiveSMPP applies a delivery receipt or stores a message received from
+// the SMSC of transport name.
+func receiveSMPP(name string, m *smpp.ShortMessage) {
+	text, err := smpp.DecodeText(m.DataCoding, m.Message)
+	if err != nil {
+		log.Printf("receiveSMPP: %s %s", name, err.Error())
+		return
+	}
+	if m.ESMClass&0x3C != smpp.ESMClassReceipt {
+		sender := m.Source
+		if m.SourceTON == smpp.TONInternational {
+			sender = "+" + sender
+		}
+		err = receiveInbound(sender, text, time.Now())
+		if err != nil {
+			log.Printf("receiveSMPP: %s %s", name, err.Error())
+		}
+		return
+	}
+	receipt, err := smpp.ParseReceipt(text)
+	if err != nil {
+		receipt = &smpp.Receipt{}
+	}
+	// the optional parameters take precedence over the text
+	if id, ok := m.TLVs[smpp.TagReceiptedMessageID]; ok {
+		receipt.ID, _ = smpp.DecodeCString(id)
+	}
+	if state, ok := m.TLVs[smpp.TagMessageState]; ok && len(state) == 1 {
+		receipt.Stat = receiptStats[state[0]]
+	}
+	if receipt.ID == "" || receipt.Stat == "" {
+		log.Printf("receiveSMPP: %s invalid receipt %q", name, text)
+		return
+	}
+	if receipt.Stat == "ENROUTE" || receipt.Stat == "ACCEPTD" {
+		// not final
+		return
+	}
+	reference := name + ":" + receipt.ID
+	detail := fmt.Sprintf("stat %s err %03d", receipt.Stat, receipt.Err)
+	err = applyReport(reference, receipt.Stat == "DELIVRD", detail)
+	if err == database.ErrNotFound {
+		// the receipt may overtake marking the message sent
+		go func() {
+			time.Sleep(reportRetryDelay)
+			err := applyReport(reference, receipt.Stat == "DELIVRD", detail)
+			if err != nil {
+				log.Printf("receiveSMPP: %s receipt of %s. %s", name, receipt.ID, err.Error())
+			}
+		}()
+	} else if err != nil {
+		log.Printf("receiveSMPP: %s %s", name, err.Error())
+	}
+}
@@ -0,0 +1,150 @@
+package worker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
+	"github.com/alexgear/sms/smpp"
+)
+
+type fakeTransport struct {
+	name string
+	up   bool
+	err  error
+}
+
+func (t *fakeTransport) Name() string {
+	return t.name
+}
+
+func (t *fakeTransport) Up() bool {
+	return t.up
+}
+
+func (t *fakeTransport) Send(sms common.SMS) (string, error) {
+	return t.name + ":1", t.err
+}
+
+func TestTransportsFor(t *testing.T) {
+	primary := &fakeTransport{name: "primary", up: true, err: &smpp.StatusError{Status: smpp.StatusThrottled}}
+	backup := &fakeTransport{name: "backup", up: true}
+	transports = map[string]Transport{config.ModemTransport: modemTransport{}, "primary": primary, "backup": backup}
+	routes = []config.RouteConfig{
+		{Name: "ua", Prefixes: []string{"+380"}, Transports: []string{"primary", "backup", "modem"}},
+		{Name: "alerts", Clients: []string{"alerts"}, Transports: []string{"backup"}},
+	}
+	defer func() {
+		transports = map[string]Transport{config.ModemTransport: modemTransport{}}
+		routes = nil
+	}()
+	now := time.Now()
+	sms := common.SMS{UUID: "60000000-0000-0000-0000-000000000000", Mobile: "+380631234567", Client: "alerts"}
+
+	candidates, _ := transportsFor(sms, now)
+	if len(candidates) != 3 || candidates[0] != primary {
+		t.Fatalf("Expected the first matching route, got %v", candidates)
+	}
+	reference, via, err := send(sms, candidates)
+	if err != nil || via != "backup" || reference != "backup:1" {
+		t.Fatalf("Expected a failover to backup, got %q %q %v", reference, via, err)
+	}
+	backup.err = errors.New("connection reset")
+	primary.up = false
+	candidates, _ = transportsFor(sms, now)
+	if len(candidates) != 2 || candidates[0] != backup {
+		t.Fatalf("Expected transports which are down to be skipped, got %v", candidates)
+	}
+	_, _, err = send(sms, candidates[:1])
+	if err != backup.err {
+		t.Fatalf("Expected the error of the last transport, got %v", err)
+	}
+	if code := errorCode(&smpp.StatusError{Status: smpp.StatusThrottled}); code != "SMPP 0x00000058" {
+		t.Fatalf("Expected SMPP 0x00000058, got %q", code)
+	}
+
+	sms.Mobile = "+48123456789"
+	candidates, _ = transportsFor(sms, now)
+	if len(candidates) != 1 || candidates[0] != backup {
+		t.Fatalf("Expected the route of the client, got %v", candidates)
+	}
+	sms.Client = "billing"
+	candidates, _ = transportsFor(sms, now)
+	if len(candidates) != 1 || candidates[0].Name() != config.ModemTransport {
+		t.Fatalf("Expected the modem without a matching route, got %v", candidates)
+	}
+
+	// a throttled modem defers the message unless another transport is up
+	initThrottle(config.ThrottleConfig{PerHour: 1})
+	defer initThrottle(config.ThrottleConfig{})
+	sendThrottle.record(now)
+	defer func() { sendThrottle.sent = nil }()
+	candidates, until := transportsFor(sms, now)
+	if candidates != nil || !until.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Expected the message to be deferred for an hour, got %v %v", candidates, until)
+	}
+	sms.Mobile = "+380631234567"
+	primary.up = true
+	candidates, _ = transportsFor(sms, now)
+	if len(candidates) != 2 || candidates[0] != primary {
+		t.Fatalf("Expected the throttled modem to be skipped, got %v", candidates)
+	}
+}
+
+func TestReceiveSMPP(t *testing.T) {
+	cleanup := initTestStore(t)
+	defer cleanup()
+	sms := &common.SMS{
+		UUID:   "60000000-0000-0000-0000-000000000001",
+		Mobile: "+380631234567",
+		Body:   "test",
+		Status: "pending"}
+	err := store.InsertMessage(sms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sms.Status = "sent"
+	sms.Reference = "smsc:7fe0"
+	err = store.UpdateMessageStatus(*sms)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ENROUTE is not final
+	m := &smpp.ShortMessage{ESMClass: smpp.ESMClassReceipt,
+		TLVs: map[uint16][]byte{smpp.TagMessageState: {smpp.StateEnroute}}}
+	m.DataCoding, m.Message = smpp.EncodeText("id:7fe0 stat:DELIVRD err:000")
+	receiveSMPP("smsc", m)
+	stored, err := store.GetMessageByUuid(sms.UUID)
+	if err != nil || stored.Status != "sent" {
+		t.Fatalf("Expected the message to stay sent, got %q %v", stored.Status, err)
+	}
+	delete(m.TLVs, smpp.TagMessageState)
+	receiveSMPP("smsc", m)
+	stored, err = store.GetMessageByUuid(sms.UUID)
+	if err != nil || stored.Status != common.EventDelivered {
+		t.Fatalf("Expected the message to be delivered, got %q %v", stored.Status, err)
+	}
+
+	m = &smpp.ShortMessage{Source: "380501234567", SourceTON: smpp.TONInternational}
+	m.DataCoding, m.Message = smpp.EncodeText("hello")
+	receiveSMPP("smsc", m)
+	_, inbound, err := store.GetConversation("+380501234567", 10)
+	if err != nil || len(inbound) != 1 || inbound[0].Body != "hello" {
+		t.Fatalf("Expected the message to be received, got %#v %v", inbound, err)
+	}
+}
+
+func TestSubmitWindow(t *testing.T) {
+	smsc := &smppTransport{name: "smsc", window: make(chan struct{}, 2)}
+	modem := &fakeTransport{name: config.ModemTransport, up: true}
+	if window := submitWindow([]Transport{smsc}); window != smsc.window {
+		t.Fatal("Expected the window of the SMPP transport")
+	}
+	// the modem sends one message at a time, also as a fallback
+	if window := submitWindow([]Transport{smsc, modem}); window != nil {
+		t.Fatal("Expected no window with the modem as a candidate")
+	}
+}
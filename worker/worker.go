@@ -1,17 +1,46 @@
 package worker
 
 import (
+	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/config"
 	"github.com/alexgear/sms/database"
-	"github.com/alexgear/sms/modem"
 )
 
+// claimBatch is the number of messages claimed per database scan
+const claimBatch = 10
+
 var err error
+var store database.Store
+var owner string
+
+// highReserve is the percentage of a batch kept for high priority messages
+var highReserve int
+
+// scanInterval is the longest the producer waits between claims
+var scanInterval = time.Minute
+
+// retryDelay before the first retry of a failed message
+var retryDelay = 30 * time.Second
 
-func InitWorker() {
+func InitWorker(s database.Store, conf config.Config) {
+	store = s
+	highReserve = conf.Queue.HighReserve
+	scanInterval = time.Duration(conf.Queue.ScanInterval) * time.Second
+	retryDelay = time.Duration(conf.Queue.RetryDelay) * time.Second
+	initThrottle(conf.Throttle)
+	err := sendThrottle.load(time.Now())
+	if err != nil {
+		log.Println("InitWorker: failed to load the sends of the modem", err)
+	}
+	initQuietHours(conf.QuietHours)
+	initTransports(conf)
+	hostname, _ := os.Hostname()
+	owner = fmt.Sprintf("%s:%d", hostname, os.Getpid())
 	messages := make(chan common.SMS)
 	go producer(messages)
 	go consumer(messages)
@@ -21,30 +50,149 @@ func consumer(messages chan common.SMS) {
 	for {
 		message := <-messages
 		log.Println("consumer: processing", message.UUID)
-		err = modem.SendMessage(message.Mobile, message.Body)
+		optedOut, err := recipientOptedOut(message)
 		if err != nil {
-			message.Status = "error"
-			log.Println("consumer: failed to process", message.UUID, err)
-		} else {
-			message.Status = "sent"
+			// the claim expires and the message is tried again
+			log.Println("consumer: failed to check suppression of", message.UUID, err)
+			continue
+		}
+		if optedOut {
+			log.Println("consumer: recipient opted out", message.UUID)
+			message.Status = common.EventSuppressed
+			store.UpdateMessageStatus(message)
+			recordEvent(message.UUID, common.Event{Event: common.EventSuppressed})
+			continue
+		}
+		now := time.Now()
+		if until := quietUntil(message, now); until.After(now) {
+			log.Println("consumer: quiet hours of", message.UUID, "until", until)
+			message.DueAt = until
+			store.UpdateMessageStatus(message)
+			recordEvent(message.UUID, common.Event{Event: common.EventDeferred, Detail: "quiet hours until " +
+				until.Format(time.RFC3339)})
+			continue
 		}
-		message.Retries++
-		// TODO: make this update a goroutine?
-		database.UpdateMessageStatus(message)
+		candidates, until := transportsFor(message, now)
+		if candidates == nil {
+			log.Println("consumer: modem throttled for", message.UUID, "until", until)
+			message.DueAt = until
+			store.UpdateMessageStatus(message)
+			recordEvent(message.UUID, common.Event{Event: common.EventDeferred, Detail: "throttled until " +
+				until.Format(time.RFC3339)})
+			continue
+		}
+		if window := submitWindow(candidates); window != nil {
+			// SMPP transports have up to Window messages awaiting a response
+			window <- struct{}{}
+			go func(message common.SMS) {
+				defer func() { <-window }()
+				attempt(message, candidates)
+			}(message)
+			continue
+		}
+		attempt(message, candidates)
+	}
+}
+
+// attempt sends a message through the first of candidates able to and
+// stores the outcome.
+func attempt(message common.SMS, candidates []Transport) {
+	message.Retries++
+	recordEvent(message.UUID, common.Event{Event: common.EventAttempt, Attempt: message.Retries})
+	reference, via, err := send(message, candidates)
+	event := common.Event{Attempt: message.Retries}
+	if err != nil {
+		message.Status = "error"
+		message.DueAt = time.Now().Add(retryDelay << uint(message.Retries-1))
+		event.Event = common.EventError
+		event.Detail = err.Error()
+		event.Code = errorCode(err)
+		log.Println("attempt: failed to process", message.UUID, err)
+	} else {
+		message.Status = "sent"
+		message.Reference = reference
+		event.Event = common.EventSent
+		event.Reference = message.Reference
+		log.Println("attempt: sent", message.UUID, "via", via)
+	}
+	// TODO: make this update a goroutine?
+	store.UpdateMessageStatus(message)
+	recordEvent(message.UUID, event)
+}
+
+func recordEvent(uuid string, event common.Event) {
+	err := store.InsertEvent(uuid, event)
+	if err != nil {
+		log.Println(err)
 	}
+	notify(uuid, event)
 }
 
 func producer(messages chan common.SMS) {
 	for {
-		pendingMsgs, err := database.GetPendingMessages()
+		batch := claimBatch
+		if len(transports) == 1 {
+			// messages wait in the queue unclaimed while the modem is throttled
+			sendThrottle.wait()
+			batch = sendThrottle.available(time.Now(), claimBatch)
+		}
+		pendingMsgs, err := claim(batch)
 		if err != nil {
-			log.Println("producer: failed to get messages. %s", err.Error())
+			log.Printf("producer: failed to get messages. %s", err.Error())
 		}
 		log.Printf("producer: %d pending messages found", len(pendingMsgs))
 		for _, msg := range pendingMsgs {
 			log.Printf("producer: Processing %#v", msg)
 			messages <- msg
 		}
-		time.Sleep(10000 * time.Millisecond)
+		if err == nil && len(pendingMsgs) > 0 {
+			// more may have been queued meanwhile
+			continue
+		}
+		wait()
+	}
+}
+
+// wait blocks until a message is queued, the next pending message is due or
+// scanInterval passes.
+func wait() {
+	timeout := scanInterval
+	due, err := store.NextDue()
+	if err != nil {
+		log.Printf("wait: %s", err.Error())
+	} else if !due.IsZero() && time.Until(due) < timeout {
+		timeout = time.Until(due)
+	}
+	if timeout < time.Second {
+		// a due message was claimed by another instance meanwhile
+		timeout = time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-store.Wakeup():
+	case <-timer.C:
+	}
+}
+
+// claim returns up to batch messages, high priority ones first, and leaves
+// the reserved part of the batch unused by other ones.
+func claim(batch int) ([]common.SMS, error) {
+	messages, err := store.ClaimPendingMessages(owner, batch, common.PriorityHigh)
+	if err != nil {
+		return messages, err
+	}
+	otherBatch := batch * (100 - highReserve) / 100
+	if otherBatch < 1 {
+		otherBatch = 1
+	}
+	limit := batch - len(messages)
+	if limit > otherBatch {
+		limit = otherBatch
+	}
+	if limit == 0 {
+		return messages, nil
 	}
+	others, err := store.ClaimPendingMessages(owner, limit, common.PriorityBulk)
+	return append(messages, others...), err
 }
@@ -0,0 +1,74 @@
+package worker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alexgear/sms/common"
+	"github.com/alexgear/sms/database"
+)
+
+// initTestStore opens a fresh sqlite store as the worker's store.
+func initTestStore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "sms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err = database.InitDB(filepath.Join(dir, "db.sqlite"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestWait(t *testing.T) {
+	cleanup := initTestStore(t)
+	defer cleanup()
+	scanInterval = time.Hour
+	defer func() { scanInterval = time.Minute }()
+
+	done := make(chan bool)
+	go func() {
+		wait()
+		done <- true
+	}()
+	sms := &common.SMS{
+		UUID:   "50000000-0000-0000-0000-000000000000",
+		Mobile: "+380631234567",
+		Body:   "test",
+		Status: "pending",
+		DueAt:  time.Now().Add(time.Hour)}
+	err := store.InsertMessage(sms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a queued message to wake the producer")
+	}
+
+	// a message due soon ends the wait without a wakeup
+	sms.Status = "error"
+	sms.DueAt = time.Now().Add(time.Second)
+	err = store.UpdateMessageStatus(*sms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		wait()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the producer to wake when the message is due")
+	}
+}